@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/leader"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/redis_ts"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/selector"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// The /api/v1 endpoints follow the Prometheus HTTP API, so that Grafana and
+// other Prometheus clients can use them directly.
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&apiResponse{Status: "success", Data: data}); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Error("Encode error")
+	}
+}
+
+func respondError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()}); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Error("Encode error")
+	}
+}
+
+// parseTime parses a Prometheus API timestamp, either Unix seconds or
+// RFC 3339, into milliseconds.
+func parseTime(s string, defaultMs int64) (int64, error) {
+	if s == "" {
+		return defaultMs, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func parseTimeRange(r *http.Request) (start int64, end int64, err error) {
+	start, err = parseTime(r.FormValue("start"), math.MinInt64)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = parseTime(r.FormValue("end"), math.MaxInt64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end timestamp must not be before start time")
+	}
+	return start, end, nil
+}
+
+func labelsMap(labels []*prompb.Label) map[string]string {
+	result := make(map[string]string, len(labels))
+	for _, l := range labels {
+		result[l.Name] = l.Value
+	}
+	return result
+}
+
+// querier serves the /api/v1 endpoints.
+type querier interface {
+	QueryExemplars(selectors [][]*prompb.LabelMatcher, start int64, end int64) ([]redis_ts.SeriesExemplars, error)
+	Metadata(metric string) ([]*remotepb.MetricMetadata, error)
+}
+
+type exemplarData struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp float64           `json:"timestamp"`
+}
+
+type seriesExemplarsData struct {
+	SeriesLabels map[string]string `json:"seriesLabels"`
+	Exemplars    []exemplarData    `json:"exemplars"`
+}
+
+func queryExemplarsHandler(querier querier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		selectors, err := selector.Parse(r.FormValue("query"))
+		if err == nil {
+			err = checkMatchers(selectors)
+		}
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+
+		series, err := querier.QueryExemplars(selectors, start, end)
+		if err != nil {
+			log.WithFields(log.Fields{"query": r.FormValue("query"), "err": err}).Error("Error querying exemplars")
+			respondError(w, http.StatusInternalServerError, "execution", err)
+			return
+		}
+
+		data := make([]seriesExemplarsData, 0, len(series))
+		for _, s := range series {
+			exemplars := make([]exemplarData, 0, len(s.Exemplars))
+			for _, e := range s.Exemplars {
+				exemplars = append(exemplars, exemplarData{
+					Labels:    labelsMap(e.Labels),
+					Value:     strconv.FormatFloat(e.Value, 'f', -1, 64),
+					Timestamp: float64(e.Timestamp) / 1000,
+				})
+			}
+			data = append(data, seriesExemplarsData{SeriesLabels: labelsMap(s.SeriesLabels), Exemplars: exemplars})
+		}
+		respond(w, data)
+	}
+}
+
+// checkMatchers rejects the regex matchers, which TS.MRANGE filters cannot
+// express.
+func checkMatchers(selectors [][]*prompb.LabelMatcher) error {
+	for _, matchers := range selectors {
+		for _, m := range matchers {
+			if m.Type == prompb.LabelMatcher_RE || m.Type == prompb.LabelMatcher_NRE {
+				return fmt.Errorf("regex matcher on %q is not supported", m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+type metadataData struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+func metadataHandler(querier querier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := -1
+		if s := r.FormValue("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil {
+				respondError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("limit must be a number"))
+				return
+			}
+		}
+
+		metadata, err := querier.Metadata(r.FormValue("metric"))
+		if err != nil {
+			log.WithFields(log.Fields{"metric": r.FormValue("metric"), "err": err}).Error("Error querying metadata")
+			respondError(w, http.StatusInternalServerError, "execution", err)
+			return
+		}
+
+		data := make(map[string][]metadataData, len(metadata))
+		for _, m := range metadata {
+			if limit >= 0 && len(data) >= limit {
+				break
+			}
+			data[m.MetricFamilyName] = []metadataData{{Type: m.Type.String(), Help: m.Help, Unit: m.Unit}}
+		}
+		respond(w, data)
+	}
+}
+
+type leaderData struct {
+	ID       string   `json:"id"`
+	Leader   string   `json:"leader"`
+	Token    int64    `json:"token"`
+	IsLeader bool     `json:"isLeader"`
+	Tasks    []string `json:"tasks"`
+}
+
+func leaderStatusHandler(elector *leader.Elector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := elector.Status()
+		respond(w, leaderData{
+			ID:       status.ID,
+			Leader:   status.Leader,
+			Token:    status.Token,
+			IsLeader: status.IsLeader,
+			Tasks:    status.Tasks,
+		})
+	}
+}
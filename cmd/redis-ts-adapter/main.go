@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/go-redis/redis"
-	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/aggregation"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/enrichment"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/fallback"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/forward"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/hatracker"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/leader"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readcache"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
 	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/redis_ts"
-	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/validation"
 	"github.com/pkg/profile"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/prompb"
 	log "github.com/sirupsen/logrus"
 )
@@ -29,6 +44,71 @@ type config struct {
 	IdleTimeout             time.Duration
 	IdleCheckFrequency      time.Duration
 	WriteTimeout            time.Duration
+	maxExemplarsPerSeries   int
+	validationMode          string
+	maxLabelNames           int
+	maxLabelNameLength      int
+	maxLabelValueLength     int
+	labelNamePattern        string
+	maxSampleFuture         time.Duration
+	maxSampleAge            time.Duration
+	latePolicy              string
+	latePolicyOverrides     string
+	haEnabled               bool
+	haClusterLabel          string
+	haReplicaLabel          string
+	haUpdateTimeout         time.Duration
+	haFailoverTimeout       time.Duration
+	aggregationRulesFile    string
+	aggregationFlushPeriod  time.Duration
+	thinningRules           string
+	thinningFlushPeriod     time.Duration
+	enrichmentKey           string
+	enrichmentSourceLabels  string
+	enrichmentRefresh       time.Duration
+	forwardURLs             string
+	forwardQueueSize        int
+	forwardMaxRetries       int
+	forwardTimeout          time.Duration
+	waitReplicas            int
+	waitTimeout             time.Duration
+	migrationAddress        string
+	migrationCutover        string
+	migrationBackfill       bool
+	partitionPeriod         time.Duration
+	partitionRetention      time.Duration
+	gcMaxAge                time.Duration
+	gcMaxAgeOverrides       string
+	gcInterval              time.Duration
+	gcBatchSize             int
+	gcBatchInterval         time.Duration
+	gcDryRun                bool
+	leaderEnabled           bool
+	leaderID                string
+	leaderLeaseDuration     time.Duration
+	leaderRenewInterval     time.Duration
+	readWindow              time.Duration
+	readPageSize            int
+	readBatchSize           int
+	readConcurrency         int
+	readMaxSeries           int
+	readMaxSamples          int
+	readMaxBytes            int
+	readLimitsOverrides     string
+	readTenantHeader        string
+	readCacheEnabled        bool
+	readCacheBucketSize     time.Duration
+	readCacheMaxFreshness   time.Duration
+	readCacheTTL            time.Duration
+	readCacheMaxBytes       int
+	fallbackURL             string
+	fallbackTimeout         time.Duration
+	fallbackRetention       time.Duration
+	headWindow              time.Duration
+	headMaxSamples          int
+	readReplicasEnabled     bool
+	readReplicasMaxStale    time.Duration
+	readReplicasInterval    time.Duration
 }
 
 var cfg = &config{}
@@ -67,6 +147,136 @@ func parseFlags() {
 		"Frequency of idle checks made by client.")
 	flag.DurationVar(&cfg.WriteTimeout, "redis-write-timeout", 1*time.Minute,
 		"Redis write timeout.")
+	flag.IntVar(&cfg.waitReplicas, "redis-wait-replicas", 0,
+		"Number of replicas that must acknowledge each write before it succeeds. 0 does not wait.")
+	flag.DurationVar(&cfg.waitTimeout, "redis-wait-timeout", time.Second,
+		"How long to wait for replicas to acknowledge a write.")
+	flag.StringVar(&cfg.migrationAddress, "migration.new-redis-address", "",
+		"The host:port of the Redis server being migrated to. Writes go to both servers until the migration is over. empty, if empty.")
+	flag.StringVar(&cfg.migrationCutover, "migration.cutover", "",
+		"When writes to the new Redis server started, as Unix seconds or RFC 3339. Earlier data is read from the old server until it is backfilled.")
+	flag.BoolVar(&cfg.migrationBackfill, "migration.backfill", false,
+		"Copy the data before the cutover from the old Redis server to the new one.")
+	flag.DurationVar(&cfg.partitionPeriod, "partition.period", 0,
+		"Split each series into a key per period of this length, e.g. 24h. 0 keeps a single key per series.")
+	flag.DurationVar(&cfg.partitionRetention, "partition.retention", 0,
+		"Drop the keys of periods that ended longer than this ago. 0 keeps every period.")
+	flag.DurationVar(&cfg.gcMaxAge, "gc.max-age", 0,
+		"Delete series whose last sample is older than this. 0 keeps the series of metrics without an override.")
+	flag.StringVar(&cfg.gcMaxAgeOverrides, "gc.max-age-overrides", "",
+		"Per metric maximum ages, as metric=duration,metric=duration. 0s keeps the metric's series.")
+	flag.DurationVar(&cfg.gcInterval, "gc.interval", time.Hour,
+		"How often stale series are looked for.")
+	flag.IntVar(&cfg.gcBatchSize, "gc.batch-size", 100,
+		"Keys checked, and stale series deleted, in each garbage collection batch.")
+	flag.DurationVar(&cfg.gcBatchInterval, "gc.batch-interval", time.Second,
+		"Pause between two garbage collection batches.")
+	flag.BoolVar(&cfg.gcDryRun, "gc.dry-run", false,
+		"Only log the stale series found, by metric, without deleting them.")
+	flag.BoolVar(&cfg.leaderEnabled, "leader.enabled", false,
+		"Only run garbage collection, partition drops and the migration backfill on the adapter elected among those sharing the Redis server.")
+	flag.StringVar(&cfg.leaderID, "leader.id", "",
+		"Unique ID of this adapter in the leader election. Defaults to the host name and process ID.")
+	flag.DurationVar(&cfg.leaderLeaseDuration, "leader.lease-duration", 15*time.Second,
+		"How long the leader may stay silent before another adapter takes over.")
+	flag.DurationVar(&cfg.leaderRenewInterval, "leader.renew-interval", 5*time.Second,
+		"How often the leader renews its lease, and the other adapters campaign.")
+	flag.DurationVar(&cfg.readWindow, "read.window", 0,
+		"Read the time range of each remote read query in windows of this length, one after the other. 0 reads the whole range at once.")
+	flag.IntVar(&cfg.readPageSize, "read.page-size", 0,
+		"Maximum samples read per series in one Redis command. Longer series are read page by page. 0 reads them whole.")
+	flag.IntVar(&cfg.readBatchSize, "read.batch-size", 0,
+		fmt.Sprintf("Maximum series read from Redis at once. 0 means %d with the other read bounds, and every series at once without them.", redis_ts.DefaultReadBatchSize))
+	flag.IntVar(&cfg.readConcurrency, "read.concurrency", redis_ts.DefaultReadConcurrency,
+		"Maximum queries of a remote read request read from Redis at once.")
+	flag.IntVar(&cfg.readMaxSeries, "read.max-series", 0,
+		"Maximum series a remote read request may return. Requests matching more fail with a 400 naming the limit. 0 means no limit.")
+	flag.IntVar(&cfg.readMaxSamples, "read.max-samples", 0,
+		"Maximum samples and histograms a remote read request may return. 0 means no limit.")
+	flag.IntVar(&cfg.readMaxBytes, "read.max-bytes", 0,
+		"Maximum size in bytes of the series a remote read request may return, before compression. 0 means no limit.")
+	flag.StringVar(&cfg.readLimitsOverrides, "read.limits-overrides", "",
+		"Per tenant read limits, as tenant=series:samples:bytes,tenant=series:samples:bytes. 0 means no limit.")
+	flag.StringVar(&cfg.readTenantHeader, "read.tenant-header", "X-Scope-OrgID",
+		"Header naming the tenant of a remote read request, whose limits override the defaults.")
+	flag.BoolVar(&cfg.readCacheEnabled, "read-cache.enabled", false,
+		"Cache remote read results by time bucket, and only read the recent edge of repeated queries from Redis.")
+	flag.DurationVar(&cfg.readCacheBucketSize, "read-cache.bucket-size", 10*time.Minute,
+		"Length of the time buckets remote read results are cached by.")
+	flag.DurationVar(&cfg.readCacheMaxFreshness, "read-cache.max-freshness", 10*time.Minute,
+		"How far back data may still change, from late samples. Buckets are only cached once they ended longer ago.")
+	flag.DurationVar(&cfg.readCacheTTL, "read-cache.ttl", time.Hour,
+		"How long a bucket stays cached.")
+	flag.IntVar(&cfg.readCacheMaxBytes, "read-cache.max-bytes", 256*1024*1024,
+		"Maximum estimated size in bytes of the cached buckets. The least recently used ones are evicted beyond.")
+	flag.StringVar(&cfg.fallbackURL, "fallback.url", "",
+		"Remote read URL of another store to read what Redis lacks from: data older than --fallback.retention, and queries Redis has no data for.")
+	flag.DurationVar(&cfg.fallbackTimeout, "fallback.timeout", 30*time.Second,
+		"Timeout for reads from the fallback store.")
+	flag.DurationVar(&cfg.fallbackRetention, "fallback.retention", 0,
+		"How far back Redis has data. Older parts of queries are only read from the fallback store. 0 reads every query from Redis first.")
+	flag.DurationVar(&cfg.headWindow, "head.window", 0,
+		"Keep the samples written in this last window in memory, and answer reads of it from there. Only for adapters receiving every write of the series they serve. 0 disables the head.")
+	flag.IntVar(&cfg.headMaxSamples, "head.max-samples", 1000000,
+		"Maximum samples and histograms held in the head. Beyond, the older half of its window is evicted.")
+	flag.BoolVar(&cfg.readReplicasEnabled, "read-replicas.enabled", false,
+		"Send remote reads to the replicas of the Sentinel master, falling back to the master when none is in sync. Requires redis-sentinel-address.")
+	flag.DurationVar(&cfg.readReplicasMaxStale, "read-replicas.max-staleness", 5*time.Second,
+		"How far behind the master a replica may be and still serve reads.")
+	flag.DurationVar(&cfg.readReplicasInterval, "read-replicas.check-interval", time.Second,
+		"How often replicas are discovered through Sentinel, and their lag measured.")
+	flag.IntVar(&cfg.maxExemplarsPerSeries, "exemplars.max-per-series", 10,
+		"Maximum number of exemplars kept for each series. 0 disables exemplar storage.")
+	flag.StringVar(&cfg.validationMode, "validation.mode", "lenient",
+		"How to treat series with unsorted labels, empty label values or repeated labels. One of: [lenient, strict]. lenient repairs them, strict rejects them.")
+	flag.IntVar(&cfg.maxLabelNames, "validation.max-label-names", 30,
+		"Maximum number of labels per series, including __name__. 0 means no limit.")
+	flag.IntVar(&cfg.maxLabelNameLength, "validation.max-label-name-length", 1024,
+		"Maximum length of a label name in bytes. 0 means no limit.")
+	flag.IntVar(&cfg.maxLabelValueLength, "validation.max-label-value-length", 2048,
+		"Maximum length of a label value in bytes. 0 means no limit.")
+	flag.StringVar(&cfg.labelNamePattern, "validation.label-name-pattern", validation.DefaultLabelNamePattern.String(),
+		"Regular expression label names must match.")
+	flag.DurationVar(&cfg.maxSampleFuture, "ingest.max-future", 10*time.Minute,
+		"Samples with timestamps further than this ahead of the adapter's clock are rejected. 0 means no limit.")
+	flag.DurationVar(&cfg.maxSampleAge, "ingest.max-age", 0,
+		"Samples with timestamps further than this behind the adapter's clock are late. 0 means no limit.")
+	flag.StringVar(&cfg.latePolicy, "ingest.late-sample-policy", "reject",
+		"What to do with late samples. One of: [reject, clamp, accept]. clamp moves them to the start of the window, accept leaves them to the series' duplicate policy.")
+	flag.StringVar(&cfg.latePolicyOverrides, "ingest.late-sample-policy-overrides", "",
+		"Per metric late sample policies, as metric=policy,metric=policy.")
+	flag.BoolVar(&cfg.haEnabled, "ha.enabled", false,
+		"Only accept samples of HA Prometheus pairs from the elected replica of each cluster.")
+	flag.StringVar(&cfg.haClusterLabel, "ha.cluster-label", "cluster",
+		"Label identifying the HA cluster a series comes from.")
+	flag.StringVar(&cfg.haReplicaLabel, "ha.replica-label", "__replica__",
+		"Label identifying the replica a series comes from. It is removed from accepted series.")
+	flag.DurationVar(&cfg.haUpdateTimeout, "ha.update-timeout", 15*time.Second,
+		"How long an election result is trusted before checking it in Redis again.")
+	flag.DurationVar(&cfg.haFailoverTimeout, "ha.failover-timeout", 30*time.Second,
+		"How long the elected replica may stay silent before another replica takes over.")
+	flag.StringVar(&cfg.aggregationRulesFile, "aggregation.rules-file", "",
+		"YAML file with streaming aggregation rules. empty, if empty.")
+	flag.DurationVar(&cfg.aggregationFlushPeriod, "aggregation.flush-interval", 10*time.Second,
+		"How often closed aggregation windows are written.")
+	flag.StringVar(&cfg.thinningRules, "thinning.rules", "",
+		"Per metric rules keeping at most one sample per interval of each series, as metric=interval:mode,... where mode is one of [first, last, avg].")
+	flag.DurationVar(&cfg.thinningFlushPeriod, "thinning.flush-interval", time.Minute,
+		"How often the pending last and avg samples of series that stopped reporting are written.")
+	flag.StringVar(&cfg.enrichmentKey, "enrichment.key", "",
+		"Redis hash holding the label enrichment table. empty, if empty.")
+	flag.StringVar(&cfg.enrichmentSourceLabels, "enrichment.source-labels", "namespace,service",
+		"Comma separated labels looked up in the enrichment table, in order.")
+	flag.DurationVar(&cfg.enrichmentRefresh, "enrichment.refresh-interval", time.Minute,
+		"How often the enrichment table is reloaded.")
+	flag.StringVar(&cfg.forwardURLs, "forward.urls", "",
+		"Comma separated remote write URLs accepted write requests are also sent to. empty, if empty.")
+	flag.IntVar(&cfg.forwardQueueSize, "forward.queue-size", 1000,
+		"Write requests queued for each forward URL before new ones are dropped.")
+	flag.IntVar(&cfg.forwardMaxRetries, "forward.max-retries", 10,
+		"Retries of a failed forwarded write request before it is dropped.")
+	flag.DurationVar(&cfg.forwardTimeout, "forward.timeout", 30*time.Second,
+		"The timeout to use when forwarding a write request.")
 	flag.BoolVar(&cfg.Profile, "profile", false, "Run with profile")
 
 	flag.Parse()
@@ -83,6 +293,56 @@ func validateConfiguration() {
 		log.Error("Invalid configuration: Sentinel configuration requires both sentinel address and master name")
 		os.Exit(1)
 	}
+
+	if cfg.validationMode != "lenient" && cfg.validationMode != "strict" {
+		log.WithFields(log.Fields{"validation.mode": cfg.validationMode}).Error("Invalid configuration: Validation mode must be lenient or strict")
+		os.Exit(1)
+	}
+
+	if cfg.partitionRetention > 0 && cfg.partitionPeriod <= 0 {
+		log.Error("Invalid configuration: Partition retention requires a partition period")
+		os.Exit(1)
+	}
+
+	if cfg.readConcurrency <= 0 {
+		log.WithFields(log.Fields{"read.concurrency": cfg.readConcurrency}).Error("Invalid configuration: Read concurrency must be positive")
+		os.Exit(1)
+	}
+
+	if cfg.readWindow < 0 || cfg.readPageSize < 0 || cfg.readBatchSize < 0 {
+		log.Error("Invalid configuration: Read window, page size and batch size must not be negative")
+		os.Exit(1)
+	}
+
+	if cfg.readCacheEnabled && (cfg.readCacheBucketSize <= 0 || cfg.readCacheMaxFreshness < 0 || cfg.readCacheTTL <= 0 || cfg.readCacheMaxBytes <= 0) {
+		log.Error("Invalid configuration: Read cache bucket size, TTL and maximum bytes must be positive")
+		os.Exit(1)
+	}
+
+	if cfg.fallbackURL != "" && (cfg.fallbackTimeout <= 0 || cfg.fallbackRetention < 0) {
+		log.Error("Invalid configuration: Fallback timeout must be positive, and retention not negative")
+		os.Exit(1)
+	}
+
+	if cfg.readReplicasEnabled && cfg.redisSentinelAddress == "" {
+		log.Error("Invalid configuration: Reading from replicas requires redis-sentinel-address")
+		os.Exit(1)
+	}
+
+	if cfg.readReplicasEnabled && (cfg.readReplicasMaxStale <= 0 || cfg.readReplicasInterval <= 0) {
+		log.Error("Invalid configuration: Replica maximum staleness and check interval must be positive")
+		os.Exit(1)
+	}
+
+	if cfg.headWindow > 0 && cfg.headMaxSamples <= 0 {
+		log.WithFields(log.Fields{"head.max-samples": cfg.headMaxSamples}).Error("Invalid configuration: Head maximum samples must be positive")
+		os.Exit(1)
+	}
+
+	if cfg.readMaxSeries < 0 || cfg.readMaxSamples < 0 || cfg.readMaxBytes < 0 {
+		log.Error("Invalid configuration: Read limits must not be negative")
+		os.Exit(1)
+	}
 }
 
 func setupLogger() {
@@ -98,19 +358,45 @@ func setupLogger() {
 }
 
 type writer interface {
-	Write(samples []*prompb.TimeSeries) error
+	Ingest(req *remotepb.WriteRequest) (redis_ts.WriteStats, error)
 	Name() string
 }
 
 type reader interface {
-	Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error)
+	Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error)
 	Name() string
 }
 
+// streamer is a reader that passes the float series of a query on as it
+// reads them, counting them against tracker, instead of answering whole.
+// HasHistograms tells whether native histograms, which Stream leaves out,
+// match a query.
+type streamer interface {
+	reader
+	Stream(q *prompb.Query, tracker *readlimit.Tracker, emit func(*remotepb.TimeSeries) error) error
+	HasHistograms(q *prompb.Query) (bool, error)
+}
+
+// trackedReader is a reader that counts what it reads against the tracker of
+// the request, instead of its own limits.
+type trackedReader interface {
+	QueryTracked(req *prompb.ReadRequest, tracker *readlimit.Tracker) (*remotepb.ReadResponse, error)
+}
+
+// storage is what the adapter writes to and reads from: a client, or a
+// migration between two of them.
+type storage interface {
+	writer
+	reader
+	querier
+	FlushThinned(until int64) error
+}
+
 func buildClient(cfg *config) *redis_ts.Client {
+	var client *redis_ts.Client
 	if cfg.redisSentinelAddress != "" {
 		log.WithFields(log.Fields{"sentinel_address": cfg.redisSentinelAddress}).Info("Creating redis sentinel client")
-		client := redis_ts.NewFailoverClient(&redis.FailoverOptions{
+		client = redis_ts.NewFailoverClient(&redis.FailoverOptions{
 			MasterName:         cfg.redisSentinelMasterName,
 			SentinelAddrs:      []string{cfg.redisSentinelAddress},
 			PoolSize:           cfg.PoolSize,
@@ -119,97 +405,400 @@ func buildClient(cfg *config) *redis_ts.Client {
 			WriteTimeout:       cfg.WriteTimeout,
 			Password:           cfg.redisAuth,
 		})
-		return client
-	}
-	if cfg.redisAddress != "" {
+		if cfg.readReplicasEnabled {
+			err := client.ReadFromReplicas(redis_ts.ReplicaConfig{
+				SentinelAddrs: []string{cfg.redisSentinelAddress},
+				MasterName:    cfg.redisSentinelMasterName,
+				Password:      cfg.redisAuth,
+				MaxStaleness:  cfg.readReplicasMaxStale,
+				CheckInterval: cfg.readReplicasInterval,
+			})
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Error("Could not set up replica reads")
+				os.Exit(1)
+			}
+		}
+	} else if cfg.redisAddress != "" {
 		log.WithFields(log.Fields{"redis_ts_address": cfg.redisAddress}).Info("Creating redis TS client")
-		client := redis_ts.NewClient(
+		client = redis_ts.NewClient(
 			cfg.redisAddress,
 			cfg.redisAuth)
-		return client
+	} else {
+		// TODO: build redis reader here
+		log.Info("Starting up...")
+		return nil
 	}
-	// TODO: build redis reader here
-	log.Info("Starting up...")
-	return nil
+	configureClient(cfg, client)
+	return client
 }
 
-func serve(addr string, writer writer, reader reader) error {
-	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Read error")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+func configureClient(cfg *config, client *redis_ts.Client) {
+	client.MaxExemplarsPerSeries = cfg.maxExemplarsPerSeries
+	client.WaitReplicas = cfg.waitReplicas
+	client.WaitTimeout = cfg.waitTimeout
+	client.PartitionPeriod = cfg.partitionPeriod
+	client.ReadWindow = cfg.readWindow
+	client.ReadPageSize = cfg.readPageSize
+	client.ReadBatchSize = cfg.readBatchSize
+	client.ReadConcurrency = cfg.readConcurrency
+	// Each request's own limits are checked by the read handler: those of
+	// readers that cannot count with them only stop reading at the largest.
+	client.ReadLimits = readlimit.Ceiling(append([]readlimit.Limits{readLimits(cfg)}, overrideLimits(cfg)...)...)
+	if cfg.headWindow > 0 {
+		client.EnableHead(cfg.headWindow, cfg.headMaxSamples)
+	}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Decode error")
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	rules, err := redis_ts.ParseThinningRules(cfg.thinningRules)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot parse thinning rules")
+		os.Exit(1)
+	}
+	client.SetThinningRules(rules)
+}
 
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Unmarshal error")
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		sendSamples(writer, req.Timeseries)
+// buildReader returns what remote reads are served from: the store, completed
+// from the fallback store if one is configured, behind the result cache if it
+// is enabled.
+func buildReader(cfg *config, store storage) reader {
+	if store == nil {
+		return nil
+	}
+	var r reader = store
+	if cfg.fallbackURL != "" {
+		r = fallback.New(r, fallback.Config{
+			URL:       cfg.fallbackURL,
+			Timeout:   cfg.fallbackTimeout,
+			Retention: cfg.fallbackRetention,
+		})
+	}
+	if !cfg.readCacheEnabled {
+		return r
+	}
+	return readcache.New(r, readcache.Config{
+		BucketSize:   cfg.readCacheBucketSize,
+		MaxFreshness: cfg.readCacheMaxFreshness,
+		TTL:          cfg.readCacheTTL,
+		MaxBytes:     cfg.readCacheMaxBytes,
 	})
+}
 
-	http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Read error")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// buildMigration returns the migration to the new Redis server, and its
+// client, if one is configured.
+func buildMigration(cfg *config, client *redis_ts.Client) (*redis_ts.Migration, *redis_ts.Client) {
+	if cfg.migrationAddress == "" {
+		return nil, nil
+	}
+	if client == nil {
+		log.Error("Invalid configuration: Migration requires a Redis address to migrate from")
+		os.Exit(1)
+	}
+	cutover, err := parseTime(cfg.migrationCutover, 0)
+	if err != nil || cutover == 0 {
+		log.WithFields(log.Fields{"cutover": cfg.migrationCutover}).Error("Invalid configuration: Migration requires a valid cutover time")
+		os.Exit(1)
+	}
+
+	log.WithFields(log.Fields{"redis_ts_address": cfg.migrationAddress}).Info("Creating redis TS client to migrate to")
+	newClient := redis_ts.NewClient(cfg.migrationAddress, cfg.redisAuth)
+	configureClient(cfg, newClient)
+	migration, err := redis_ts.NewMigration(client, newClient, cutover)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Could not read the migration progress")
+		os.Exit(1)
+	}
+	return migration, newClient
+}
+
+// backfill runs the migration's backfill, retrying after failures.
+func backfill(migration *redis_ts.Migration, fence redis_ts.Fence, stop <-chan struct{}) {
+	for {
+		err := migration.Backfill(fence, stop)
+		if err == nil {
 			return
 		}
-
-		reqBuf, err := snappy.Decode(nil, compressed)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Decode error")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		log.WithFields(log.Fields{"err": err}).Warn("Backfill failed, retrying")
+		select {
+		case <-time.After(time.Minute):
+		case <-stop:
 			return
 		}
+	}
+}
 
-		var req prompb.ReadRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			log.WithFields(log.Fields{"err": err.Error()}).Error("Unmarshal error")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+// flushThinned periodically writes the thinned samples that would otherwise
+// wait for their series' next sample.
+func flushThinned(client storage, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.FlushThinned(time.Now().UnixNano() / int64(time.Millisecond)); err != nil {
+				log.WithFields(log.Fields{"storage": client.Name(), "err": err}).Warn("Could not write thinned samples")
+			}
+		case <-stop:
 			return
 		}
+	}
+}
 
-		if reader == nil {
-			http.Error(w, "Cannot serve data to an invalid reader", http.StatusInternalServerError)
+// dropPartitions regularly drops the periods of partitioned series that
+// ended longer than retention ago.
+func dropPartitions(client *redis_ts.Client, retention time.Duration, fence redis_ts.Fence, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			until := time.Now().Add(-retention).UnixNano() / int64(time.Millisecond)
+			if _, err := client.DropPartitions(until, fence, stop); err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("Could not drop partitions")
+			}
+		case <-stop:
 			return
 		}
+	}
+}
 
-		var resp *prompb.ReadResponse
-		resp, err = reader.Read(&req)
-		if err != nil {
-			log.WithFields(log.Fields{"query": req, "storage": reader.Name(), "err": err}).Error("Error executing query")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+func buildGCConfig(cfg *config) redis_ts.GCConfig {
+	overrides, err := redis_ts.ParseMaxAgeOverrides(cfg.gcMaxAgeOverrides)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot parse garbage collection overrides")
+		os.Exit(1)
+	}
+	return redis_ts.GCConfig{
+		MaxAge:          cfg.gcMaxAge,
+		MaxAgeOverrides: overrides,
+		BatchSize:       cfg.gcBatchSize,
+		BatchInterval:   cfg.gcBatchInterval,
+		DryRun:          cfg.gcDryRun,
+	}
+}
+
+// collectGarbage regularly deletes the series that stopped receiving
+// samples, or only reports them in a dry run.
+func collectGarbage(client *redis_ts.Client, gcCfg redis_ts.GCConfig, interval time.Duration, fence redis_ts.Fence, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := client.CollectGarbage(gcCfg, time.Now(), fence, stop)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("Garbage collection failed")
+			}
+			fields := log.Fields{"scanned": report.Scanned, "deleted": report.Deleted}
+			for metric, stale := range report.Stale {
+				fields["stale_"+metric] = stale
+			}
+			if gcCfg.DryRun {
+				log.WithFields(fields).Info("Stale series found, dry run")
+			} else {
+				log.WithFields(fields).Info("Garbage collection done")
+			}
+		case <-stop:
 			return
 		}
+	}
+}
 
-		data, err := proto.Marshal(resp)
+func buildElector(cfg *config, client *redis_ts.Client) *leader.Elector {
+	if !cfg.leaderEnabled {
+		return nil
+	}
+	if client == nil {
+		log.Error("Invalid configuration: Leader election requires a Redis address")
+		os.Exit(1)
+	}
+	id := cfg.leaderID
+	if id == "" {
+		hostname, err := os.Hostname()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			hostname = "unknown"
 		}
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	elector, err := leader.New(client.Client, leader.Config{
+		ID:            id,
+		LeaseDuration: cfg.leaderLeaseDuration,
+		RenewInterval: cfg.leaderRenewInterval,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot set up leader election")
+		os.Exit(1)
+	}
+	return elector
+}
 
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		w.Header().Set("Content-Encoding", "snappy")
+// runSingleton runs a background task that must only run on one adapter: on
+// the leader when leader election is enabled, and right away otherwise.
+func runSingleton(elector *leader.Elector, name string, run func(stop <-chan struct{}, fence redis_ts.Fence), stop <-chan struct{}) {
+	if elector == nil {
+		go run(stop, redis_ts.NoFence)
+		return
+	}
+	elector.Register(name, func(leading <-chan struct{}, token int64) {
+		log.WithFields(log.Fields{"task": name, "token": token}).Info("Starting leader task")
+		run(leading, redis_ts.Fence(token))
+	})
+}
 
-		compressed = snappy.Encode(nil, data)
-		if _, err := w.Write(compressed); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+func buildValidator(cfg *config) *validation.Validator {
+	pattern, err := regexp.Compile(cfg.labelNamePattern)
+	if err != nil {
+		log.WithFields(log.Fields{"pattern": cfg.labelNamePattern, "err": err}).Error("Invalid configuration: Cannot compile label name pattern")
+		os.Exit(1)
+	}
+	return validation.NewValidator(validation.Config{
+		MaxLabelNames:       cfg.maxLabelNames,
+		MaxLabelNameLength:  cfg.maxLabelNameLength,
+		MaxLabelValueLength: cfg.maxLabelValueLength,
+		LabelNamePattern:    pattern,
+		Strict:              cfg.validationMode == "strict",
+	})
+}
+
+func buildWindow(cfg *config) *validation.Window {
+	policy, err := validation.ParseLatePolicy(cfg.latePolicy)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot parse late sample policy")
+		os.Exit(1)
+	}
+	overrides, err := validation.ParseLatePolicyOverrides(cfg.latePolicyOverrides)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot parse late sample policy overrides")
+		os.Exit(1)
+	}
+	return validation.NewWindow(validation.WindowConfig{
+		MaxFuture:           cfg.maxSampleFuture,
+		MaxAge:              cfg.maxSampleAge,
+		LatePolicy:          policy,
+		LatePolicyOverrides: overrides,
+	})
+}
+
+func buildHATracker(cfg *config, client *redis_ts.Client) *hatracker.Tracker {
+	if !cfg.haEnabled {
+		return nil
+	}
+	if client == nil {
+		log.Error("Invalid configuration: HA deduplication requires a Redis address")
+		os.Exit(1)
+	}
+	tracker, err := hatracker.New(client.Client, hatracker.Config{
+		ClusterLabel:    cfg.haClusterLabel,
+		ReplicaLabel:    cfg.haReplicaLabel,
+		UpdateTimeout:   cfg.haUpdateTimeout,
+		FailoverTimeout: cfg.haFailoverTimeout,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot set up HA deduplication")
+		os.Exit(1)
+	}
+	return tracker
+}
+
+func buildTee(cfg *config) *forward.Tee {
+	if cfg.forwardURLs == "" {
+		return nil
+	}
+	return forward.New(strings.Split(cfg.forwardURLs, ","), forward.Config{
+		QueueSize:  cfg.forwardQueueSize,
+		MaxRetries: cfg.forwardMaxRetries,
+		Timeout:    cfg.forwardTimeout,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	})
+}
+
+func buildAggregator(cfg *config, client storage, tee *forward.Tee) *aggregation.Aggregator {
+	if cfg.aggregationRulesFile == "" {
+		return nil
+	}
+	if client == nil {
+		log.Error("Invalid configuration: Streaming aggregation requires a Redis address")
+		os.Exit(1)
+	}
+	rules, err := aggregation.LoadFile(cfg.aggregationRulesFile)
+	if err != nil {
+		log.WithFields(log.Fields{"file": cfg.aggregationRulesFile, "err": err}).Error("Invalid configuration: Cannot load aggregation rules")
+		os.Exit(1)
+	}
+	aggregator := aggregation.New(rules, func(req *remotepb.WriteRequest) error {
+		_, err := client.Ingest(req)
+		if tee != nil {
+			tee.Forward(req)
 		}
+		return err
+	})
+	return aggregator
+}
+
+func buildEnricher(cfg *config, client *redis_ts.Client) *enrichment.Enricher {
+	if cfg.enrichmentKey == "" {
+		return nil
+	}
+	if client == nil {
+		log.Error("Invalid configuration: Label enrichment requires a Redis address")
+		os.Exit(1)
+	}
+	enricher := enrichment.New(client.Client, enrichment.Config{
+		Key:             cfg.enrichmentKey,
+		SourceLabels:    strings.Split(cfg.enrichmentSourceLabels, ","),
+		RefreshInterval: cfg.enrichmentRefresh,
 	})
+	if err := enricher.Refresh(); err != nil {
+		log.WithFields(log.Fields{"key": cfg.enrichmentKey, "err": err}).Warn("Could not load the enrichment table, will retry")
+	}
+	return enricher
+}
 
-	return http.ListenAndServe(addr, nil)
+// readLimits returns the default limits of a remote read request, checked
+// both while reading from Redis and on the response.
+func readLimits(cfg *config) readlimit.Limits {
+	return readlimit.Limits{
+		MaxSeries:  cfg.readMaxSeries,
+		MaxSamples: cfg.readMaxSamples,
+		MaxBytes:   cfg.readMaxBytes,
+	}
+}
+
+// readLimitsOverrides returns the read limits of the tenants with an
+// override.
+func readLimitsOverrides(cfg *config) map[string]readlimit.Limits {
+	overrides, err := readlimit.ParseOverrides(cfg.readLimitsOverrides)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Invalid configuration: Cannot parse read limits overrides")
+		os.Exit(1)
+	}
+	return overrides
+}
+
+func overrideLimits(cfg *config) []readlimit.Limits {
+	var limits []readlimit.Limits
+	for _, l := range readLimitsOverrides(cfg) {
+		limits = append(limits, l)
+	}
+	return limits
+}
+
+func serve(server *http.Server, ingester *ingester, reader reader, querier querier, elector *leader.Elector) error {
+	http.HandleFunc("/write", writeHandler(ingester))
+	http.HandleFunc("/api/v1/query_exemplars", queryExemplarsHandler(querier))
+	http.HandleFunc("/api/v1/metadata", metadataHandler(querier))
+	if elector != nil {
+		http.HandleFunc("/api/v1/status/leader", leaderStatusHandler(elector))
+	}
+
+	http.HandleFunc("/read", readHandler(reader, &readLimiter{
+		defaults:  readLimits(cfg),
+		overrides: readLimitsOverrides(cfg),
+		header:    cfg.readTenantHeader,
+	}))
+
+	http.Handle("/metrics", promhttp.Handler())
+
+	return server.ListenAndServe()
 }
 
 func main() {
@@ -218,16 +807,126 @@ func main() {
 	}
 
 	client := buildClient(cfg)
+	clients := []*redis_ts.Client{client}
+	// The client holding the adapter's own state, such as HA elections and
+	// the enrichment table: the new server during a migration.
+	primary := client
+	var store storage
+	if client != nil {
+		store = client
+	}
+	migration, newClient := buildMigration(cfg, client)
+	if migration != nil {
+		clients = append(clients, newClient)
+		primary = newClient
+		store = migration
+	}
+
+	tee := buildTee(cfg)
+	ingester := &ingester{
+		writer:     store,
+		validator:  buildValidator(cfg),
+		window:     buildWindow(cfg),
+		haTracker:  buildHATracker(cfg, primary),
+		aggregator: buildAggregator(cfg, store, tee),
+		enricher:   buildEnricher(cfg, primary),
+		tee:        tee,
+	}
+	if ingester.aggregator != nil {
+		for _, c := range clients {
+			c.SeriesRetention = ingester.aggregator.RawRetention
+		}
+		go ingester.aggregator.Run(cfg.aggregationFlushPeriod)
+	}
+	stopThinning := make(chan struct{})
+	if store != nil {
+		go flushThinned(store, cfg.thinningFlushPeriod, stopThinning)
+	}
+	elector := buildElector(cfg, primary)
+	stopPartitions := make(chan struct{})
+	if store != nil && cfg.partitionRetention > 0 {
+		for _, c := range clients {
+			c := c
+			runSingleton(elector, "partition-drops "+c.Options().Addr, func(stop <-chan struct{}, fence redis_ts.Fence) {
+				dropPartitions(c, cfg.partitionRetention, fence, stop)
+			}, stopPartitions)
+		}
+	}
+	stopGC := make(chan struct{})
+	if store != nil && (cfg.gcMaxAge > 0 || cfg.gcMaxAgeOverrides != "") {
+		gcCfg := buildGCConfig(cfg)
+		for _, c := range clients {
+			c := c
+			runSingleton(elector, "gc "+c.Options().Addr, func(stop <-chan struct{}, fence redis_ts.Fence) {
+				collectGarbage(c, gcCfg, cfg.gcInterval, fence, stop)
+			}, stopGC)
+		}
+	}
+	stopBackfill := make(chan struct{})
+	if migration != nil && cfg.migrationBackfill {
+		runSingleton(elector, "backfill", func(stop <-chan struct{}, fence redis_ts.Fence) {
+			backfill(migration, fence, stop)
+		}, stopBackfill)
+	}
+	if elector != nil {
+		go elector.Run()
+	}
+	stopReplicas := make(chan struct{})
+	if client != nil && cfg.readReplicasEnabled {
+		go client.WatchReplicas(stopReplicas)
+	}
+	stopEnrichment := make(chan struct{})
+	if ingester.enricher != nil {
+		go ingester.enricher.Run(stopEnrichment)
+	}
+
+	server := &http.Server{Addr: cfg.listenAddr}
+	// done is closed once the in-flight requests finished, or the shutdown
+	// timed out.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		<-stop
+		log.Info("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.remoteTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("Could not shut down gracefully")
+		}
+	}()
+
 	log.WithFields(log.Fields{"address": cfg.listenAddr}).Info("listening...")
-	if err := serve(cfg.listenAddr, client, client); err != nil {
+	if err := serve(server, ingester, buildReader(cfg, store), store, elector); err != nil && err != http.ErrServerClosed {
 		log.WithFields(log.Fields{"address": cfg.listenAddr, "err": err}).Error("Failed to listen")
 		os.Exit(1)
 	}
-}
+	// Serving returns as soon as the shutdown starts.
+	<-done
 
-func sendSamples(w writer, samples []*prompb.TimeSeries) {
-	err := w.Write(samples)
-	if err != nil {
-		log.WithFields(log.Fields{"storage": w.Name(), "err": err, "num_samples": len(samples)}).Warn("Could not send samples to remote storage")
+	// Write what was aggregated and thinned so far, now that no more
+	// requests come in.
+	if ingester.aggregator != nil {
+		ingester.aggregator.Stop()
+	}
+	// Hand leadership over first, so that another adapter resumes the
+	// singleton tasks while this one finishes.
+	if elector != nil {
+		elector.Stop()
+	}
+	close(stopBackfill)
+	close(stopPartitions)
+	close(stopGC)
+	close(stopEnrichment)
+	close(stopReplicas)
+	close(stopThinning)
+	if store != nil {
+		if err := store.FlushThinned(math.MaxInt64); err != nil {
+			log.WithFields(log.Fields{"storage": store.Name(), "err": err}).Warn("Could not write thinned samples")
+		}
+	}
+	if tee != nil {
+		tee.Stop(cfg.remoteTimeout)
 	}
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/chunkenc"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxChunkedFrameBytes bounds the chunks sent in one frame of a streamed
+// response, as Prometheus does.
+const maxChunkedFrameBytes = 1024 * 1024
+
+// negotiateResponseType returns the first response type the client accepts
+// that the adapter supports. Clients that do not say accept samples.
+func negotiateResponseType(accepted []remotepb.ReadRequest_ResponseType) (remotepb.ReadRequest_ResponseType, error) {
+	if len(accepted) == 0 {
+		return remotepb.ReadRequest_SAMPLES, nil
+	}
+	for _, t := range accepted {
+		switch t {
+		case remotepb.ReadRequest_SAMPLES, remotepb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("none of the accepted response types %v is supported", accepted)
+}
+
+// readErrorStatus returns the status of a failed query: a client error for
+// one that exceeded a limit, since it would fail again.
+func readErrorStatus(err error) int {
+	var limitErr *readlimit.LimitError
+	if errors.As(err, &limitErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// readLimiter picks the limits of a remote read request by its tenant, named
+// by header: the tenant's override, or the defaults.
+type readLimiter struct {
+	defaults  readlimit.Limits
+	overrides map[string]readlimit.Limits
+	header    string
+}
+
+func (l *readLimiter) limits(r *http.Request) readlimit.Limits {
+	if limits, ok := l.overrides[r.Header.Get(l.header)]; ok {
+		return limits
+	}
+	return l.defaults
+}
+
+func readHandler(reader reader, limiter *readLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Read error")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reqBuf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Decode error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req remotepb.ReadRequest
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Unmarshal error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if reader == nil {
+			http.Error(w, "Cannot serve data to an invalid reader", http.StatusInternalServerError)
+			return
+		}
+
+		responseType, err := negotiateResponseType(req.AcceptedResponseTypes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tracker := readlimit.NewTracker(limiter.limits(r))
+		var resp *remotepb.ReadResponse
+		if responseType == remotepb.ReadRequest_STREAMED_XOR_CHUNKS {
+			// Chunks only carry float samples: requests matching native
+			// histograms are answered with samples instead.
+			if s, ok := reader.(streamer); ok {
+				var histograms bool
+				histograms, err = matchHistograms(s, req.Queries)
+				if err == nil && !histograms {
+					streamChunks(w, s, req.Queries, tracker)
+					return
+				}
+			} else {
+				resp, err = reader.Query(&prompb.ReadRequest{Queries: req.Queries})
+				if err == nil && !hasHistograms(resp) {
+					writeChunks(w, reader, resp, tracker)
+					return
+				}
+			}
+		}
+
+		counted := false
+		if resp == nil && err == nil {
+			if t, ok := reader.(trackedReader); ok {
+				// The series are counted as they are read.
+				resp, err = t.QueryTracked(&prompb.ReadRequest{Queries: req.Queries}, tracker)
+				counted = true
+			} else {
+				resp, err = reader.Query(&prompb.ReadRequest{Queries: req.Queries})
+			}
+		}
+		if err == nil {
+			err = trackResponse(tracker, resp, counted)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"query": req, "storage": reader.Name(), "err": err}).Error("Error executing query")
+			http.Error(w, err.Error(), readErrorStatus(err))
+			return
+		}
+
+		data, err := proto.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+
+		compressed = snappy.Encode(nil, data)
+		if _, err := w.Write(compressed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// trackResponse counts the series of resp against the request's limits.
+// Only their bytes are counted when the series and samples were, as they
+// were read.
+func trackResponse(tracker *readlimit.Tracker, resp *remotepb.ReadResponse, counted bool) error {
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			if !counted {
+				if err := tracker.AddSeries(len(ts.Samples) + len(ts.Histograms)); err != nil {
+					return err
+				}
+			}
+			if err := tracker.AddBytes(proto.Size(ts)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matchHistograms tells whether native histograms match any of queries.
+func matchHistograms(s streamer, queries []*prompb.Query) (bool, error) {
+	for _, q := range queries {
+		if histograms, err := s.HasHistograms(q); err != nil || histograms {
+			return histograms, err
+		}
+	}
+	return false, nil
+}
+
+// hasHistograms tells whether a series of resp has native histograms.
+func hasHistograms(resp *remotepb.ReadResponse) bool {
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			if len(ts.Histograms) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chunkedResponse sends the series of a streamed response as XOR chunks,
+// counting them against the request's limits before sending them.
+type chunkedResponse struct {
+	w       http.ResponseWriter
+	writer  *chunkenc.ChunkedWriter
+	tracker *readlimit.Tracker
+	started bool
+	// writeErr is the last error writing to the client.
+	writeErr error
+}
+
+func newChunkedResponse(w http.ResponseWriter, tracker *readlimit.Tracker) *chunkedResponse {
+	flusher, _ := w.(http.Flusher)
+	return &chunkedResponse{w: w, writer: chunkenc.NewChunkedWriter(w, flusher), tracker: tracker}
+}
+
+// send sends ts as the answer of the query at queryIndex. Only the bytes of
+// its chunks are counted when its series and samples were, as it was read.
+func (c *chunkedResponse) send(queryIndex int, ts *remotepb.TimeSeries, counted bool) error {
+	chunks := chunkenc.EncodeSamples(ts.Samples)
+	if err := trackChunkedSeries(c.tracker, ts, chunks, counted); err != nil {
+		return err
+	}
+	c.start()
+	c.writeErr = writeChunkedSeries(c.writer, int64(queryIndex), ts.Labels, chunks)
+	return c.writeErr
+}
+
+func (c *chunkedResponse) start() {
+	if !c.started {
+		c.w.Header().Set("Content-Type", chunkenc.StreamedContentType)
+		c.started = true
+	}
+}
+
+// fail ends the response after err, with an error status unless frames were
+// sent, in which case the client only notices the truncated stream.
+func (c *chunkedResponse) fail(err error, fields log.Fields) {
+	if c.writeErr != nil {
+		log.WithFields(log.Fields{"err": c.writeErr}).Warn("Could not stream remote read response")
+		return
+	}
+	fields["err"] = err
+	log.WithFields(fields).Error("Aborted remote read stream")
+	if !c.started {
+		http.Error(c.w, err.Error(), readErrorStatus(err))
+	}
+}
+
+// streamChunks answers the queries one at a time, sending the float samples
+// of each series as XOR chunks as s reads them from Redis, a batch at a time.
+// The queries must not match native histograms.
+func streamChunks(w http.ResponseWriter, s streamer, queries []*prompb.Query, tracker *readlimit.Tracker) {
+	resp := newChunkedResponse(w, tracker)
+	for i, q := range queries {
+		// The series are counted as they are read.
+		err := s.Stream(q, tracker, func(ts *remotepb.TimeSeries) error { return resp.send(i, ts, true) })
+		if err != nil {
+			resp.fail(err, log.Fields{"query": q, "storage": s.Name()})
+			return
+		}
+	}
+	resp.start()
+}
+
+// writeChunks sends the series of an answered request as XOR chunks. The
+// series must not have native histograms.
+func writeChunks(w http.ResponseWriter, reader reader, answered *remotepb.ReadResponse, tracker *readlimit.Tracker) {
+	resp := newChunkedResponse(w, tracker)
+	for i, result := range answered.Results {
+		for _, ts := range result.Timeseries {
+			if err := resp.send(i, ts, false); err != nil {
+				resp.fail(err, log.Fields{"query": i, "storage": reader.Name()})
+				return
+			}
+		}
+	}
+	resp.start()
+}
+
+// trackChunkedSeries counts a series about to be streamed against the
+// request's limits, before any of its frames is sent.
+func trackChunkedSeries(tracker *readlimit.Tracker, ts *remotepb.TimeSeries, chunks []remotepb.Chunk, counted bool) error {
+	if !counted {
+		if err := tracker.AddSeries(len(ts.Samples)); err != nil {
+			return err
+		}
+	}
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk.Data)
+	}
+	return tracker.AddBytes(size)
+}
+
+// writeChunkedSeries sends the chunks of a series in as many frames as needed
+// to keep each under maxChunkedFrameBytes.
+func writeChunkedSeries(writer *chunkenc.ChunkedWriter, queryIndex int64, labels []*prompb.Label, chunks []remotepb.Chunk) error {
+	for len(chunks) > 0 {
+		n, size := 0, 0
+		for n < len(chunks) && (n == 0 || size+len(chunks[n].Data) <= maxChunkedFrameBytes) {
+			size += len(chunks[n].Data)
+			n++
+		}
+		frame := &remotepb.ChunkedReadResponse{
+			ChunkedSeries: []*remotepb.ChunkedSeries{{Labels: labels, Chunks: chunks[:n]}},
+			QueryIndex:    queryIndex,
+		}
+		data, err := proto.Marshal(frame)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		chunks = chunks[n:]
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/aggregation"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/enrichment"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/forward"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/hatracker"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/redis_ts"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb/writev2"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/validation"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	protoMessageV1 = "prometheus.WriteRequest"
+	protoMessageV2 = "io.prometheus.write.v2.Request"
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// remoteWriteMessage returns the protobuf message a remote-write request
+// carries, based on its Content-Type. Requests without a proto parameter
+// are remote-write 1.0, as sent by older Prometheus versions.
+func remoteWriteMessage(contentType string) (string, error) {
+	if contentType == "" {
+		return protoMessageV1, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %q", mediaType)
+	}
+	switch params["proto"] {
+	case "", protoMessageV1:
+		return protoMessageV1, nil
+	case protoMessageV2:
+		return protoMessageV2, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write message %q", params["proto"])
+	}
+}
+
+func decodeWriteRequest(message string, buf []byte) (*remotepb.WriteRequest, error) {
+	if message == protoMessageV2 {
+		var req writev2.Request
+		if err := proto.Unmarshal(buf, &req); err != nil {
+			return nil, err
+		}
+		return req.ToWriteRequest()
+	}
+
+	var req remotepb.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// ingester runs remote-write requests through the ingestion stages before
+// handing them to the writer.
+type ingester struct {
+	writer     writer
+	validator  *validation.Validator
+	window     *validation.Window
+	haTracker  *hatracker.Tracker
+	aggregator *aggregation.Aggregator
+	enricher   *enrichment.Enricher
+	tee        *forward.Tee
+}
+
+// haTrackerError is a request that was not stored, as the elected HA
+// replicas could not be checked.
+type haTrackerError struct {
+	err error
+}
+
+func (e *haTrackerError) Error() string {
+	return "could not check the elected HA replicas: " + e.err.Error()
+}
+
+func (e *haTrackerError) Unwrap() error {
+	return e.err
+}
+
+// ingest stores req and returns the series the stages rejected.
+func (i *ingester) ingest(req *remotepb.WriteRequest) (redis_ts.WriteStats, []validation.Rejection, error) {
+	if i.haTracker != nil {
+		if err := i.haTracker.Dedupe(req); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("Could not check the elected HA replicas")
+			return redis_ts.WriteStats{}, nil, &haTrackerError{err: err}
+		}
+	}
+	// Enriched labels go through validation like the sent ones.
+	if i.enricher != nil {
+		i.enricher.Enrich(req)
+	}
+	rejections := i.validator.Validate(req)
+	rejections = append(rejections, i.window.Apply(req)...)
+	if i.aggregator != nil {
+		i.aggregator.Aggregate(req)
+	}
+	for _, r := range rejections {
+		log.WithFields(log.Fields{"series": r.Series, "reason": r.Reason, "detail": r.Detail}).Debug("Rejected samples")
+	}
+
+	stats, err := sendSamples(i.writer, req)
+	// Only what Redis stored is forwarded: a failed request is retried by
+	// the sender, and would be forwarded twice. Each destination then gets
+	// every stored request, independently of the others.
+	if i.tee != nil && err == nil {
+		i.tee.Forward(req)
+	}
+	return stats, rejections, err
+}
+
+// maxReportedRejections bounds the rejections listed in a response body.
+const maxReportedRejections = 10
+
+func rejectionsMessage(rejections []validation.Rejection) string {
+	lines := make([]string, 0, maxReportedRejections+1)
+	for i, r := range rejections {
+		if i == maxReportedRejections {
+			lines = append(lines, fmt.Sprintf("and %d more", len(rejections)-i))
+			break
+		}
+		lines = append(lines, r.String())
+	}
+	return fmt.Sprintf("%d rejections:\n%s", len(rejections), strings.Join(lines, "\n"))
+}
+
+func writeHandler(ingester *ingester) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		message, err := remoteWriteMessage(r.Header.Get("Content-Type"))
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Content type error")
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Read error")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reqBuf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Decode error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req, err := decodeWriteRequest(message, reqBuf)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Error("Unmarshal error")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stats, rejections, err := ingester.ingest(req)
+		// Writes replicas did not acknowledge may be lost on failover, and
+		// requests the HA tracker could not check were not stored at all, so
+		// ask the sender to retry them, whatever the protocol version.
+		var replicationErr *redis_ts.ReplicationError
+		var trackerErr *haTrackerError
+		if errors.As(err, &replicationErr) || errors.As(err, &trackerErr) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if message == protoMessageV2 {
+			// Remote-write 2.0 senders compare these with what they sent to
+			// detect partial writes.
+			w.Header().Set(samplesWrittenHeader, strconv.Itoa(stats.Samples))
+			w.Header().Set(histogramsWrittenHeader, strconv.Itoa(stats.Histograms))
+			w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(stats.Exemplars))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The valid series are stored; rejected ones would fail again, so
+		// tell the sender not to retry.
+		if len(rejections) > 0 {
+			http.Error(w, rejectionsMessage(rejections), http.StatusBadRequest)
+			return
+		}
+		if message == protoMessageV2 {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func sendSamples(w writer, req *remotepb.WriteRequest) (redis_ts.WriteStats, error) {
+	stats, err := w.Ingest(req)
+	if err != nil {
+		log.WithFields(log.Fields{"storage": w.Name(), "err": err, "num_series": len(req.Timeseries)}).Warn("Could not send samples to remote storage")
+	}
+	return stats, err
+}
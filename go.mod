@@ -4,15 +4,16 @@ go 1.16
 
 require (
 	github.com/go-redis/redis v6.14.2+incompatible
-	github.com/gogo/protobuf v1.1.1 // indirect
-	github.com/golang/protobuf v1.2.0
+	github.com/gogo/protobuf v1.1.1
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/grpc-ecosystem/grpc-gateway v1.5.1 // indirect
 	github.com/onsi/gomega v1.4.2 // indirect
 	github.com/pkg/profile v1.2.1
+	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/common v0.0.0-20181126121408-4724e9255275
 	github.com/prometheus/prometheus v2.5.0+incompatible
 	github.com/sirupsen/logrus v1.2.0
 	github.com/stretchr/testify v1.2.2
-	golang.org/x/net v0.0.0-20181114220301-adae6a3d119a // indirect
 	google.golang.org/genproto v0.0.0-20181109154231-b5d43981345b // indirect
+	gopkg.in/yaml.v2 v2.2.1
 )
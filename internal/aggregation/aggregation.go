@@ -0,0 +1,388 @@
+// Package aggregation aggregates incoming samples across dropped labels over
+// fixed time windows, so that only the aggregated series are stored.
+package aggregation
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const nameLabel = "__name__"
+
+// Outputs a rule can produce.
+const (
+	OutputSum   = "sum"
+	OutputCount = "count"
+	OutputMin   = "min"
+	OutputMax   = "max"
+	OutputLast  = "last"
+)
+
+var (
+	aggregatedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_aggregation_input_samples_total",
+		Help: "Samples aggregated by streaming aggregation rules, by output metric prefix.",
+	}, []string{"rule"})
+	lateSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_aggregation_late_samples_total",
+		Help: "Samples dropped because their aggregation window was already flushed, by output metric prefix.",
+	}, []string{"rule"})
+	flushFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_aggregation_flush_failures_total",
+		Help: "Aggregated windows that could not be written.",
+	})
+)
+
+// Rule aggregates the samples of one metric.
+type Rule struct {
+	// Match is the metric name the rule applies to.
+	Match string `yaml:"match"`
+	// Without lists the labels aggregated away. By lists the labels kept
+	// instead; only one of them may be set.
+	Without []string `yaml:"without,omitempty"`
+	By      []string `yaml:"by,omitempty"`
+	// Interval is the length of the aggregation windows.
+	Interval model.Duration `yaml:"interval"`
+	// Delay is how long after its end a window still accepts late samples.
+	Delay model.Duration `yaml:"delay,omitempty"`
+	// Outputs are the aggregations written, each as its own series.
+	Outputs []string `yaml:"outputs"`
+	// KeepRaw keeps the raw series, created with this retention. Zero drops
+	// them.
+	KeepRaw model.Duration `yaml:"keep_raw,omitempty"`
+}
+
+// Name returns the prefix of the rule's output metrics, following the
+// "metric:interval_without_labels" convention.
+func (r *Rule) Name() string {
+	if len(r.By) > 0 {
+		return fmt.Sprintf("%s:%s_by_%s", r.Match, r.Interval, strings.Join(r.By, "_"))
+	}
+	return fmt.Sprintf("%s:%s_without_%s", r.Match, r.Interval, strings.Join(r.Without, "_"))
+}
+
+func (r *Rule) validate() error {
+	if r.Match == "" {
+		return fmt.Errorf("match is required")
+	}
+	if (len(r.Without) == 0) == (len(r.By) == 0) {
+		return fmt.Errorf("exactly one of without and by is required")
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if len(r.Outputs) == 0 {
+		return fmt.Errorf("outputs are required")
+	}
+	for _, output := range r.Outputs {
+		switch output {
+		case OutputSum, OutputCount, OutputMin, OutputMax, OutputLast:
+		default:
+			return fmt.Errorf("unknown output %q", output)
+		}
+	}
+	return nil
+}
+
+type rulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadFile reads and validates the rules in a YAML file.
+func LoadFile(path string) ([]Rule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+	for i := range file.Rules {
+		if err := file.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// aggregate holds one output series of one window.
+type aggregate struct {
+	labels []*prompb.Label
+	// inputs holds the newest sample of each input series. Sums and counts
+	// are taken over them, so a series scraped twice in a window counts
+	// once.
+	inputs   map[string]prompb.Sample
+	samples  int
+	min, max float64
+	last     prompb.Sample
+}
+
+func (a *aggregate) add(input string, s prompb.Sample) {
+	if previous, ok := a.inputs[input]; !ok || s.Timestamp >= previous.Timestamp {
+		a.inputs[input] = s
+	}
+	if a.samples == 0 {
+		a.min, a.max = s.Value, s.Value
+	}
+	a.samples++
+	a.min = math.Min(a.min, s.Value)
+	a.max = math.Max(a.max, s.Value)
+	if s.Timestamp >= a.last.Timestamp {
+		a.last = s
+	}
+}
+
+func (a *aggregate) value(output string) float64 {
+	switch output {
+	case OutputCount:
+		return float64(len(a.inputs))
+	case OutputMin:
+		return a.min
+	case OutputMax:
+		return a.max
+	case OutputLast:
+		return a.last.Value
+	default:
+		sum := 0.0
+		for _, s := range a.inputs {
+			sum += s.Value
+		}
+		return sum
+	}
+}
+
+// ruleState holds the open windows of a rule.
+type ruleState struct {
+	Rule
+	name   string
+	labels map[string]bool
+
+	mu sync.Mutex
+	// windows maps window starts to the output series of the window.
+	windows map[int64]map[string]*aggregate
+	// flushedUntil is the end of the newest flushed window. Older samples
+	// are late.
+	flushedUntil int64
+}
+
+func (r *ruleState) interval() int64 {
+	return int64(time.Duration(r.Interval) / time.Millisecond)
+}
+
+// outputLabels returns the labels r keeps, without the metric name.
+func (r *ruleState) outputLabels(labels []*prompb.Label) []*prompb.Label {
+	kept := make([]*prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == nameLabel {
+			continue
+		}
+		// r.labels holds the By labels to keep, or the Without ones to drop.
+		if r.labels[l.Name] == (len(r.By) > 0) {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+func (r *ruleState) add(labels []*prompb.Label, samples []prompb.Sample) {
+	input := promseries.LabelsKey(labels)
+	output := r.outputLabels(labels)
+	outputKey := promseries.LabelsKey(output)
+	interval := r.interval()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		if s.Timestamp < r.flushedUntil {
+			lateSamples.WithLabelValues(r.name).Inc()
+			continue
+		}
+		start := s.Timestamp - promseries.Mod(s.Timestamp, interval)
+		window, ok := r.windows[start]
+		if !ok {
+			window = make(map[string]*aggregate)
+			r.windows[start] = window
+		}
+		a, ok := window[outputKey]
+		if !ok {
+			a = &aggregate{labels: output, inputs: make(map[string]prompb.Sample)}
+			window[outputKey] = a
+		}
+		a.add(input, s)
+		aggregatedSamples.WithLabelValues(r.name).Inc()
+	}
+}
+
+// flush removes the windows closed at now and returns their output series,
+// with their labels sorted. Each output sample is stamped with the end of its
+// window.
+func (r *ruleState) flush(now int64) []*remotepb.TimeSeries {
+	interval, delay := r.interval(), int64(time.Duration(r.Delay)/time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var series []*remotepb.TimeSeries
+	for start, window := range r.windows {
+		end := start + interval
+		if end+delay > now {
+			continue
+		}
+		for _, a := range window {
+			for _, output := range r.Outputs {
+				labels := append([]*prompb.Label{{Name: nameLabel, Value: r.name + "_" + output}}, a.labels...)
+				series = append(series, &remotepb.TimeSeries{
+					Labels:  promseries.NormalizeLabels(labels),
+					Samples: []prompb.Sample{{Value: a.value(output), Timestamp: end}},
+				})
+			}
+		}
+		delete(r.windows, start)
+		if end > r.flushedUntil {
+			r.flushedUntil = end
+		}
+	}
+	return series
+}
+
+// Aggregator applies rules to write requests and periodically writes the
+// windows that closed.
+type Aggregator struct {
+	rules        map[string][]*ruleState
+	rawRetention map[string]time.Duration
+	write        func(*remotepb.WriteRequest) error
+	now          func() time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates an Aggregator writing its output with write.
+func New(rules []Rule, write func(*remotepb.WriteRequest) error) *Aggregator {
+	a := &Aggregator{
+		rules:        make(map[string][]*ruleState),
+		rawRetention: make(map[string]time.Duration),
+		write:        write,
+		now:          time.Now,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, rule := range rules {
+		labels := rule.Without
+		if len(rule.By) > 0 {
+			labels = rule.By
+		}
+		state := &ruleState{
+			Rule:    rule,
+			name:    rule.Name(),
+			labels:  make(map[string]bool, len(labels)),
+			windows: make(map[int64]map[string]*aggregate),
+		}
+		for _, l := range labels {
+			state.labels[l] = true
+		}
+		a.rules[rule.Match] = append(a.rules[rule.Match], state)
+
+		// The raw series are kept if any rule keeps them, for the longest
+		// retention asked for.
+		if keep := time.Duration(rule.KeepRaw); keep > a.rawRetention[rule.Match] {
+			a.rawRetention[rule.Match] = keep
+		}
+	}
+	return a
+}
+
+// RawRetention returns the retention the raw series of metric are kept
+// for, or zero if no rule keeps them.
+func (a *Aggregator) RawRetention(metric string) time.Duration {
+	return a.rawRetention[metric]
+}
+
+// Aggregate feeds the float samples of the series matching a rule to it, and
+// removes them from req unless a rule keeps the raw series. Native
+// histograms are not aggregated and are written as they are.
+func (a *Aggregator) Aggregate(req *remotepb.WriteRequest) {
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		rules := a.rules[metricName(ts.Labels)]
+		if len(rules) == 0 {
+			kept = append(kept, ts)
+			continue
+		}
+		for _, r := range rules {
+			r.add(ts.Labels, ts.Samples)
+		}
+		if a.rawRetention[metricName(ts.Labels)] == 0 {
+			ts.Samples, ts.Exemplars = nil, nil
+			if len(ts.Histograms) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, ts)
+	}
+	req.Timeseries = kept
+}
+
+// Run flushes the closed windows every interval until Stop is called.
+func (a *Aggregator) Run(interval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush(a.now().UnixNano() / int64(time.Millisecond))
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run and flushes every window, closed or not, so that nothing
+// aggregated is lost on shutdown.
+func (a *Aggregator) Stop() {
+	close(a.stop)
+	<-a.done
+	a.flush(math.MaxInt64)
+}
+
+func (a *Aggregator) flush(now int64) {
+	var series []*remotepb.TimeSeries
+	for _, rules := range a.rules {
+		for _, r := range rules {
+			series = append(series, r.flush(now)...)
+		}
+	}
+	if len(series) == 0 {
+		return
+	}
+	if err := a.write(&remotepb.WriteRequest{Timeseries: series}); err != nil {
+		flushFailures.Inc()
+		log.WithFields(log.Fields{"err": err, "num_series": len(series)}).Warn("Could not write aggregated series")
+	}
+}
+
+func metricName(labels []*prompb.Label) string {
+	for _, l := range labels {
+		if l.Name == nameLabel {
+			return l.Value
+		}
+	}
+	return ""
+}
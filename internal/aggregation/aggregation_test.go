@@ -0,0 +1,153 @@
+package aggregation
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func series(pod string, samples ...prompb.Sample) *remotepb.TimeSeries {
+	return &remotepb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "requests"},
+			{Name: "job", Value: "api"},
+			{Name: "pod", Value: pod},
+		},
+		Samples: samples,
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	var written []*remotepb.TimeSeries
+	aggregator := New([]Rule{{
+		Match:    "requests",
+		Without:  []string{"pod"},
+		Interval: model.Duration(time.Minute),
+		Outputs:  []string{OutputSum, OutputCount, OutputMin, OutputMax, OutputLast},
+	}}, func(req *remotepb.WriteRequest) error {
+		written = append(written, req.Timeseries...)
+		return nil
+	})
+
+	other := &remotepb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}}
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		series("a", prompb.Sample{Value: 1, Timestamp: 1000}, prompb.Sample{Value: 3, Timestamp: 2000}),
+		series("b", prompb.Sample{Value: 5, Timestamp: 1500}, prompb.Sample{Value: 7, Timestamp: 60000}),
+		other,
+	}}
+	aggregator.Aggregate(req)
+	assert.Equal(t, []*remotepb.TimeSeries{other}, req.Timeseries, "raw series are dropped")
+
+	aggregator.flush(60000)
+	values := make(map[string]prompb.Sample)
+	for _, ts := range written {
+		assert.Equal(t, []*prompb.Label{{Name: "job", Value: "api"}}, ts.Labels[1:])
+		values[ts.Labels[0].Value] = ts.Samples[0]
+	}
+	assert.Equal(t, map[string]prompb.Sample{
+		"requests:1m_without_pod_sum":   {Value: 8, Timestamp: 60000},
+		"requests:1m_without_pod_count": {Value: 2, Timestamp: 60000},
+		"requests:1m_without_pod_min":   {Value: 1, Timestamp: 60000},
+		"requests:1m_without_pod_max":   {Value: 5, Timestamp: 60000},
+		"requests:1m_without_pod_last":  {Value: 3, Timestamp: 60000},
+	}, values)
+
+	// The first window is flushed, so its late samples are dropped, while
+	// the second one is still open.
+	written = nil
+	aggregator.Aggregate(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		series("c", prompb.Sample{Value: 100, Timestamp: 59000}, prompb.Sample{Value: 9, Timestamp: 61000}),
+	}})
+	aggregator.flush(math.MaxInt64)
+	sums := make([]float64, 0)
+	for _, ts := range written {
+		if ts.Labels[0].Value == "requests:1m_without_pod_sum" {
+			sums = append(sums, ts.Samples[0].Value)
+			assert.Equal(t, int64(120000), ts.Samples[0].Timestamp)
+		}
+	}
+	assert.Equal(t, []float64{16}, sums)
+}
+
+func TestAggregateKeepRaw(t *testing.T) {
+	aggregator := New([]Rule{
+		{Match: "requests", By: []string{"job"}, Interval: model.Duration(time.Minute), Outputs: []string{OutputSum}},
+		{Match: "requests", Without: []string{"pod"}, Interval: model.Duration(time.Minute), Outputs: []string{OutputSum}, KeepRaw: model.Duration(time.Hour)},
+	}, func(*remotepb.WriteRequest) error { return nil })
+
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{series("a", prompb.Sample{Value: 1, Timestamp: 1000})}}
+	aggregator.Aggregate(req)
+	assert.Len(t, req.Timeseries, 1)
+	assert.Equal(t, time.Hour, aggregator.RawRetention("requests"))
+	assert.Equal(t, time.Duration(0), aggregator.RawRetention("up"))
+
+	var names []string
+	for _, ts := range aggregator.rules["requests"][0].flush(math.MaxInt64) {
+		names = append(names, ts.Labels[0].Value)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"requests:1m_by_job_sum"}, names)
+}
+
+func TestFlushSortsLabels(t *testing.T) {
+	aggregator := New([]Rule{
+		{Match: "requests", Without: []string{"pod"}, Interval: model.Duration(time.Minute), Outputs: []string{OutputSum}},
+	}, func(*remotepb.WriteRequest) error { return nil })
+
+	ts := series("a", prompb.Sample{Value: 1, Timestamp: 1000})
+	ts.Labels = append(ts.Labels, &prompb.Label{Name: "Zone", Value: "eu"}, &prompb.Label{Name: "az", Value: "1"})
+	aggregator.Aggregate(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{ts}})
+	flushed := aggregator.rules["requests"][0].flush(math.MaxInt64)
+	if assert.Len(t, flushed, 1) {
+		assert.Equal(t, []*prompb.Label{
+			{Name: "Zone", Value: "eu"},
+			{Name: "__name__", Value: "requests:1m_without_pod_sum"},
+			{Name: "az", Value: "1"},
+			{Name: "job", Value: "api"},
+		}, flushed[0].Labels)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "rules")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`
+rules:
+  - match: requests
+    without: [pod]
+    interval: 1m
+    delay: 30s
+    outputs: [sum, max]
+    keep_raw: 2h
+`)
+	assert.NoError(t, err)
+	rules, err := LoadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{{
+		Match:    "requests",
+		Without:  []string{"pod"},
+		Interval: model.Duration(time.Minute),
+		Delay:    model.Duration(30 * time.Second),
+		Outputs:  []string{OutputSum, OutputMax},
+		KeepRaw:  model.Duration(2 * time.Hour),
+	}}, rules)
+
+	for _, rule := range []Rule{
+		{Without: []string{"pod"}, Interval: 1, Outputs: []string{OutputSum}},
+		{Match: "requests", Interval: 1, Outputs: []string{OutputSum}},
+		{Match: "requests", Without: []string{"pod"}, Outputs: []string{OutputSum}},
+		{Match: "requests", Without: []string{"pod"}, Interval: 1, Outputs: []string{"avg"}},
+	} {
+		assert.Error(t, rule.validate())
+	}
+}
@@ -0,0 +1,75 @@
+package chunkenc
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// StreamedContentType is the content type of a streamed remote read
+// response.
+const StreamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkedWriter writes the frames of a streamed remote read response. Each
+// frame is the size of a message as a uvarint, its CRC32 Castagnoli checksum
+// as a big endian uint32, and the message.
+type ChunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// NewChunkedWriter returns a writer flushing each frame through flusher, if
+// not nil.
+func NewChunkedWriter(w io.Writer, flusher http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{w: w, flusher: flusher}
+}
+
+// Write writes message b as one frame.
+func (w *ChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(b)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(b, castagnoli))
+	if _, err := w.w.Write(header[:n+4]); err != nil {
+		return 0, err
+	}
+	written, err := w.w.Write(b)
+	if err != nil {
+		return written, err
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return written, nil
+}
+
+// EncodeSamples encodes samples, in time order, in XOR chunks of at most
+// MaxSamplesPerChunk samples.
+func EncodeSamples(samples []prompb.Sample) []remotepb.Chunk {
+	var chunks []remotepb.Chunk
+	for start := 0; start < len(samples); start += MaxSamplesPerChunk {
+		end := start + MaxSamplesPerChunk
+		if end > len(samples) {
+			end = len(samples)
+		}
+		c := NewXORChunk()
+		for _, s := range samples[start:end] {
+			c.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, remotepb.Chunk{
+			MinTimeMs: samples[start].Timestamp,
+			MaxTimeMs: samples[end-1].Timestamp,
+			Type:      remotepb.Chunk_XOR,
+			Data:      c.Bytes(),
+		})
+	}
+	return chunks
+}
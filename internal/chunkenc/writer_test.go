@@ -0,0 +1,48 @@
+package chunkenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nil)
+	message := bytes.Repeat([]byte{7}, 200)
+	n, err := w.Write(message)
+	assert.NoError(t, err)
+	assert.Equal(t, len(message), n)
+
+	size, err := binary.ReadUvarint(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(message)), size)
+	checksum := make([]byte, 4)
+	_, _ = buf.Read(checksum)
+	assert.Equal(t, crc32.Checksum(message, crc32.MakeTable(crc32.Castagnoli)), binary.BigEndian.Uint32(checksum))
+	assert.Equal(t, message, buf.Bytes())
+}
+
+func TestEncodeSamples(t *testing.T) {
+	samples := make([]prompb.Sample, 0, 2*MaxSamplesPerChunk+1)
+	for i := 0; i < cap(samples); i++ {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i) * 1000, Value: float64(i)})
+	}
+	chunks := EncodeSamples(samples)
+	assert.Len(t, chunks, 3)
+	assert.Equal(t, int64(0), chunks[0].MinTimeMs)
+	assert.Equal(t, int64(MaxSamplesPerChunk-1)*1000, chunks[0].MaxTimeMs)
+	assert.Equal(t, remotepb.Chunk_XOR, chunks[2].Type)
+	assert.Equal(t, int64(2*MaxSamplesPerChunk)*1000, chunks[2].MinTimeMs)
+
+	timestamps, values := decode(t, chunks[1].Data)
+	assert.Len(t, timestamps, MaxSamplesPerChunk)
+	assert.Equal(t, int64(MaxSamplesPerChunk)*1000, timestamps[0])
+	assert.Equal(t, float64(2*MaxSamplesPerChunk-1), values[MaxSamplesPerChunk-1])
+	assert.Empty(t, EncodeSamples(nil))
+}
@@ -0,0 +1,120 @@
+// Package chunkenc encodes samples in the XOR chunks of the Prometheus TSDB,
+// and frames the chunked remote read responses carrying them.
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// MaxSamplesPerChunk is how many samples Prometheus puts in a chunk.
+const MaxSamplesPerChunk = 120
+
+// XORChunk is a Gorilla style chunk: timestamps are delta-of-delta encoded,
+// and values are XORed with the previous one. Samples must be appended in
+// time order.
+type XORChunk struct {
+	b bstream
+
+	num      uint16
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+}
+
+// NewXORChunk returns an empty chunk.
+func NewXORChunk() *XORChunk {
+	// The chunk starts with its number of samples, as a big endian uint16.
+	return &XORChunk{b: bstream{stream: []byte{0, 0}}, leading: 0xff}
+}
+
+// NumSamples returns the number of samples in the chunk.
+func (c *XORChunk) NumSamples() int {
+	return int(c.num)
+}
+
+// Bytes returns the encoded chunk.
+func (c *XORChunk) Bytes() []byte {
+	return c.b.stream
+}
+
+// Append adds a sample to the chunk.
+func (c *XORChunk) Append(t int64, v float64) {
+	var tDelta uint64
+	switch c.num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta = uint64(t - c.t)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeValue(v)
+	default:
+		tDelta = uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0x02, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0x06, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0x0e, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0x0f, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeValue(v)
+	}
+
+	c.t, c.v, c.tDelta = t, v, tDelta
+	c.num++
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+}
+
+// bitRange tells whether x fits in nbits, in the ranges Prometheus uses.
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (c *XORChunk) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	// The number of leading zeros is written in 5 bits.
+	if leading >= 32 {
+		leading = 31
+	}
+	// Reuse the previous window of meaningful bits when the value fits.
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.b.writeBit(false)
+		c.b.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	// 64 meaningful bits overflow to 0, which readers take for 64.
+	significant := 64 - leading - trailing
+	c.b.writeBits(uint64(significant), 6)
+	c.b.writeBits(delta>>trailing, int(significant))
+}
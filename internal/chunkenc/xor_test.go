@@ -0,0 +1,143 @@
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bitReader reads a bstream back.
+type bitReader struct {
+	b   []byte
+	pos uint
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	var u uint64
+	for i := uint(0); i < n; i++ {
+		bit := (r.b[r.pos/8] >> (7 - r.pos%8)) & 1
+		u = u<<1 | uint64(bit)
+		r.pos++
+	}
+	return u
+}
+
+func (r *bitReader) ReadByte() (byte, error) {
+	return byte(r.readBits(8)), nil
+}
+
+// decode reads an XOR chunk the way Prometheus does.
+func decode(t *testing.T, b []byte) (timestamps []int64, values []float64) {
+	num := int(binary.BigEndian.Uint16(b))
+	r := &bitReader{b: b[2:]}
+	var ts int64
+	var tDelta uint64
+	var v uint64
+	var leading, trailing uint
+	readValue := func() {
+		if r.readBits(1) == 0 {
+			return
+		}
+		if r.readBits(1) == 1 {
+			leading = uint(r.readBits(5))
+			significant := uint(r.readBits(6))
+			if significant == 0 {
+				significant = 64
+			}
+			trailing = 64 - leading - significant
+		}
+		v ^= r.readBits(64-leading-trailing) << trailing
+	}
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			first, err := binary.ReadVarint(r)
+			assert.NoError(t, err)
+			ts = first
+			v = r.readBits(64)
+		case 1:
+			delta, err := binary.ReadUvarint(r)
+			assert.NoError(t, err)
+			tDelta = delta
+			ts += int64(tDelta)
+			readValue()
+		default:
+			size := uint(0)
+			switch {
+			case r.readBits(1) == 0:
+			case r.readBits(1) == 0:
+				size = 14
+			case r.readBits(1) == 0:
+				size = 17
+			case r.readBits(1) == 0:
+				size = 20
+			default:
+				size = 64
+			}
+			var dod int64
+			if size > 0 {
+				bits := r.readBits(size)
+				if size < 64 && bits > 1<<(size-1) {
+					bits -= 1 << size
+				}
+				dod = int64(bits)
+			}
+			tDelta = uint64(int64(tDelta) + dod)
+			ts += int64(tDelta)
+			readValue()
+		}
+		timestamps = append(timestamps, ts)
+		values = append(values, math.Float64frombits(v))
+	}
+	return timestamps, values
+}
+
+func TestXORChunkBytes(t *testing.T) {
+	c := NewXORChunk()
+	c.Append(1000, 1)
+	// The sample count, the timestamp as a varint, and the value's bits,
+	// followed by the empty byte the next bits go to, as in Prometheus.
+	assert.Equal(t, []byte{0x00, 0x01, 0xd0, 0x0f, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0}, c.Bytes())
+}
+
+func TestXORChunkRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var timestamps []int64
+	var values []float64
+	ts, v := int64(-5000), 1.0
+	for i := 0; i < MaxSamplesPerChunk; i++ {
+		switch i % 6 {
+		case 0:
+			ts += 15000
+		case 1:
+			ts += 15000 + random.Int63n(3000)
+		case 2:
+			ts += random.Int63n(1 << 19)
+		default:
+			ts += random.Int63n(1 << 40)
+		}
+		switch i % 4 {
+		case 0:
+		case 1:
+			v += float64(random.Intn(100))
+		case 2:
+			v = random.NormFloat64() * 1e6
+		default:
+			v = math.Inf(1)
+		}
+		timestamps = append(timestamps, ts)
+		values = append(values, v)
+	}
+
+	c := NewXORChunk()
+	for i := range timestamps {
+		c.Append(timestamps[i], values[i])
+	}
+	assert.Equal(t, MaxSamplesPerChunk, c.NumSamples())
+	gotTimestamps, gotValues := decode(t, c.Bytes())
+	assert.Equal(t, timestamps, gotTimestamps)
+	assert.Equal(t, values, gotValues)
+}
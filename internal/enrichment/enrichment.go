@@ -0,0 +1,181 @@
+// Package enrichment adds labels to incoming series from a lookup table kept
+// in a Redis hash, such as the team or cost center owning a namespace.
+//
+// Each field of the hash is a source label and value, as "namespace=payments",
+// and holds a JSON object of the labels to add, as {"team": "checkout"}.
+package enrichment
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_enrichment_lookups_total",
+		Help: "Lookups of series carrying a source label in the enrichment table, by result: hit or miss.",
+	}, []string{"result"})
+	tableEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_enrichment_table_entries",
+		Help: "Entries in the cached enrichment table.",
+	})
+	refreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_enrichment_refresh_failures_total",
+		Help: "Failed reloads of the enrichment table.",
+	})
+)
+
+// Config configures an Enricher.
+type Config struct {
+	// Key is the Redis hash holding the table.
+	Key string
+	// SourceLabels are the labels looked up, in order. The first one found
+	// in the table is used.
+	SourceLabels []string
+	// RefreshInterval is how often the table is reloaded.
+	RefreshInterval time.Duration
+}
+
+// Enricher adds the labels of a cached lookup table to series.
+type Enricher struct {
+	client redis.Cmdable
+	cfg    Config
+
+	mu    sync.RWMutex
+	table map[string][]*prompb.Label
+}
+
+// New creates an Enricher. Its table is empty until the first Refresh.
+func New(client redis.Cmdable, cfg Config) *Enricher {
+	return &Enricher{client: client, cfg: cfg, table: make(map[string][]*prompb.Label)}
+}
+
+// Refresh reloads the table. The previous table is kept if it fails.
+func (e *Enricher) Refresh() error {
+	fields, err := e.client.HGetAll(e.cfg.Key).Result()
+	if err != nil {
+		refreshFailures.Inc()
+		return err
+	}
+
+	table := make(map[string][]*prompb.Label, len(fields))
+	for field, value := range fields {
+		labels, err := decodeLabels(value)
+		if err != nil {
+			log.WithFields(log.Fields{"key": e.cfg.Key, "field": field, "err": err}).Warn("Skipping invalid enrichment entry")
+			continue
+		}
+		table[field] = labels
+	}
+
+	e.mu.Lock()
+	e.table = table
+	e.mu.Unlock()
+	tableEntries.Set(float64(len(table)))
+	return nil
+}
+
+// Run refreshes the table every refresh interval until stop is closed.
+func (e *Enricher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Refresh(); err != nil {
+				log.WithFields(log.Fields{"key": e.cfg.Key, "err": err}).Warn("Could not refresh the enrichment table")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Enrich adds the table's labels to the series of req. Labels a series
+// already has are kept as they are.
+func (e *Enricher) Enrich(req *remotepb.WriteRequest) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, ts := range req.Timeseries {
+		labels, found, ok := e.lookup(ts.Labels)
+		if !found {
+			continue
+		}
+		if !ok {
+			lookups.WithLabelValues("miss").Inc()
+			continue
+		}
+		lookups.WithLabelValues("hit").Inc()
+		ts.Labels = merge(ts.Labels, labels)
+	}
+}
+
+// lookup returns the table entry of the first source label of labels that
+// has one. found tells whether labels carry any source label at all.
+func (e *Enricher) lookup(labels []*prompb.Label) (entry []*prompb.Label, found bool, ok bool) {
+	for _, name := range e.cfg.SourceLabels {
+		for _, l := range labels {
+			if l.Name != name {
+				continue
+			}
+			found = true
+			if entry, ok := e.table[l.Name+"="+l.Value]; ok {
+				return entry, true, true
+			}
+		}
+	}
+	return nil, found, false
+}
+
+// merge inserts the labels missing from labels at their sorted position, so
+// sorted label sets stay sorted.
+func merge(labels []*prompb.Label, extra []*prompb.Label) []*prompb.Label {
+	merged := labels
+	for _, l := range extra {
+		if exists(merged, l.Name) {
+			continue
+		}
+		i := sort.Search(len(merged), func(i int) bool { return merged[i].Name >= l.Name })
+		next := make([]*prompb.Label, 0, len(merged)+1)
+		next = append(next, merged[:i]...)
+		next = append(next, l)
+		merged = append(next, merged[i:]...)
+	}
+	return merged
+}
+
+func exists(labels []*prompb.Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeLabels(value string) ([]*prompb.Label, error) {
+	var m map[string]string
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, err
+	}
+	labels := make([]*prompb.Label, 0, len(m))
+	for name, value := range m {
+		if name == "" || strings.HasPrefix(name, "__") || value == "" {
+			return nil, fmt.Errorf("invalid label %q=%q", name, value)
+		}
+		labels = append(labels, &prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, nil
+}
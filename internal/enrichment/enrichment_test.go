@@ -0,0 +1,63 @@
+package enrichment
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func labels(pairs ...string) []*prompb.Label {
+	result := make([]*prompb.Label, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		result = append(result, &prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return result
+}
+
+func TestEnrich(t *testing.T) {
+	enricher := New(nil, Config{SourceLabels: []string{"namespace", "service"}})
+	enricher.table = map[string][]*prompb.Label{
+		"namespace=payments": labels("cost_center", "cc-1", "team", "checkout"),
+		"service=search":     labels("team", "discovery", "tier", "1"),
+	}
+
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		{Labels: labels("__name__", "up", "namespace", "payments", "team", "sre")},
+		{Labels: labels("__name__", "up", "namespace", "unknown", "service", "search")},
+		{Labels: labels("__name__", "up", "namespace", "unknown")},
+		{Labels: labels("__name__", "up")},
+	}}
+	enricher.Enrich(req)
+
+	assert.Equal(t, labels("__name__", "up", "cost_center", "cc-1", "namespace", "payments", "team", "sre"), req.Timeseries[0].Labels)
+	assert.Equal(t, labels("__name__", "up", "namespace", "unknown", "service", "search", "team", "discovery", "tier", "1"), req.Timeseries[1].Labels)
+	assert.Equal(t, labels("__name__", "up", "namespace", "unknown"), req.Timeseries[2].Labels)
+	assert.Equal(t, labels("__name__", "up"), req.Timeseries[3].Labels)
+}
+
+func TestDecodeLabels(t *testing.T) {
+	decoded, err := decodeLabels(`{"team": "checkout", "cost_center": "cc-1"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, labels("cost_center", "cc-1", "team", "checkout"), decoded)
+
+	for _, value := range []string{`team=checkout`, `{"__name__": "x"}`, `{"team": ""}`} {
+		_, err := decodeLabels(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	client.Del("test_enrichment")
+	client.HMSet("test_enrichment", map[string]interface{}{
+		"namespace=payments": `{"team": "checkout"}`,
+		"namespace=broken":   `not json`,
+	})
+
+	enricher := New(client, Config{Key: "test_enrichment", SourceLabels: []string{"namespace"}})
+	assert.NoError(t, enricher.Refresh())
+	assert.Equal(t, map[string][]*prompb.Label{"namespace=payments": labels("team", "checkout")}, enricher.table)
+}
@@ -0,0 +1,209 @@
+// Package fallback completes remote reads from another Prometheus-compatible
+// store: the parts of queries older than the Redis retention, and those Redis
+// has no data for, are read from its remote read endpoint, and its series
+// merged with those of Redis, so that Prometheus sees a single store.
+package fallback
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons parts of queries are read from upstream for.
+const (
+	ReasonRetention = "retention"
+	ReasonNoData    = "no_data"
+)
+
+var (
+	upstreamQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_fallback_queries_total",
+		Help: "Parts of queries read from the upstream remote read endpoint, by reason.",
+	}, []string{"reason"})
+	upstreamFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_fallback_failures_total",
+		Help: "Failed reads from the upstream remote read endpoint.",
+	})
+)
+
+// Reader is the store read first.
+type Reader interface {
+	Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error)
+	Name() string
+}
+
+// Config configures a Fallback.
+type Config struct {
+	// URL is the upstream remote read endpoint.
+	URL     string
+	Timeout time.Duration
+	// Retention is how far back Redis has data. The parts of queries older
+	// than that are only read from upstream. Zero reads every query from
+	// Redis first.
+	Retention time.Duration
+}
+
+// Fallback reads queries from a store, and what it lacks from upstream.
+type Fallback struct {
+	reader Reader
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// New creates a Fallback in front of reader.
+func New(reader Reader, cfg Config) *Fallback {
+	return &Fallback{reader: reader, cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}, now: time.Now}
+}
+
+// Name returns the name of the store read first.
+func (f *Fallback) Name() string {
+	return f.reader.Name()
+}
+
+// upstreamPart is part of a query read from upstream.
+type upstreamPart struct {
+	query  int
+	reason string
+}
+
+// Query reads the queries from the store, from the retention boundary on,
+// then what is older or found empty from upstream, in one request, and
+// merges both. Failing to read older data fails the request; data found
+// empty is only looked for upstream as best effort.
+func (f *Fallback) Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error) {
+	boundary := int64(math.MinInt64)
+	if f.cfg.Retention > 0 {
+		boundary = f.now().Add(-f.cfg.Retention).UnixNano() / int64(time.Millisecond)
+	}
+
+	local := &prompb.ReadRequest{}
+	localIndexes := make([]int, 0, len(req.Queries))
+	upstream := &remotepb.ReadRequest{AcceptedResponseTypes: []remotepb.ReadRequest_ResponseType{remotepb.ReadRequest_SAMPLES}}
+	var parts []upstreamPart
+	for i, q := range req.Queries {
+		if q.StartTimestampMs < boundary {
+			older := *q
+			if older.EndTimestampMs >= boundary {
+				older.EndTimestampMs = boundary - 1
+			}
+			upstream.Queries = append(upstream.Queries, &older)
+			parts = append(parts, upstreamPart{query: i, reason: ReasonRetention})
+		}
+		if q.EndTimestampMs >= boundary {
+			recent := *q
+			if recent.StartTimestampMs < boundary {
+				recent.StartTimestampMs = boundary
+			}
+			local.Queries = append(local.Queries, &recent)
+			localIndexes = append(localIndexes, i)
+		}
+	}
+
+	results := make([][][]*remotepb.TimeSeries, len(req.Queries))
+	if len(local.Queries) > 0 {
+		resp, err := f.reader.Query(local)
+		if err != nil {
+			return nil, err
+		}
+		for j, result := range resp.Results {
+			i := localIndexes[j]
+			results[i] = append(results[i], result.Timeseries)
+			if !hasData(result.Timeseries) {
+				upstream.Queries = append(upstream.Queries, local.Queries[j])
+				parts = append(parts, upstreamPart{query: i, reason: ReasonNoData})
+			}
+		}
+	}
+
+	if len(upstream.Queries) > 0 {
+		resp, err := f.readUpstream(upstream)
+		if err != nil {
+			upstreamFailures.Inc()
+			for _, part := range parts {
+				if part.reason == ReasonRetention {
+					return nil, fmt.Errorf("reading from upstream: %w", err)
+				}
+			}
+			log.WithFields(log.Fields{"url": f.cfg.URL, "err": err}).Warn("Could not read missing data from upstream")
+		} else {
+			for j, part := range parts {
+				upstreamQueries.WithLabelValues(part.reason).Inc()
+				// Upstream has the older samples: they go first.
+				results[part.query] = append([][]*remotepb.TimeSeries{resp.Results[j].Timeseries}, results[part.query]...)
+			}
+		}
+	}
+
+	merged := &remotepb.ReadResponse{Results: make([]*remotepb.QueryResult, 0, len(results))}
+	for _, parts := range results {
+		merged.Results = append(merged.Results, &remotepb.QueryResult{Timeseries: promseries.Merge(parts...)})
+	}
+	return merged, nil
+}
+
+// readUpstream sends req to the upstream remote read endpoint, and returns
+// its samples response.
+func (f *Fallback) readUpstream(req *remotepb.ReadRequest) (*remotepb.ReadResponse, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, f.cfg.URL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "redis-ts-adapter")
+	httpReq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	httpResp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return nil, fmt.Errorf("server returned HTTP status %s: %s", httpResp.Status, bytes.TrimSpace(message))
+	}
+	compressed, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	data, err = snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var resp remotepb.ReadResponse
+	if err := proto.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Results) != len(req.Queries) {
+		return nil, fmt.Errorf("upstream answered %d queries, %d sent", len(resp.Results), len(req.Queries))
+	}
+	return &resp, nil
+}
+
+func hasData(series []*remotepb.TimeSeries) bool {
+	for _, ts := range series {
+		if len(ts.Samples) > 0 || len(ts.Histograms) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package fallback
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readtest"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+// upstreamServer serves the remote read endpoint of s, and records the
+// queries it receives.
+func upstreamServer(t *testing.T, s *readtest.Store) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Read-Version"))
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.NoError(t, err)
+		var req remotepb.ReadRequest
+		assert.NoError(t, proto.Unmarshal(data, &req))
+		resp, _ := s.Query(&prompb.ReadRequest{Queries: req.Queries})
+		data, _ = proto.Marshal(resp)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(snappy.Encode(nil, data))
+	}))
+}
+
+func TestFallback(t *testing.T) {
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	// Redis keeps the last hour, upstream everything up to now.
+	local := &readtest.Store{Series: []*remotepb.TimeSeries{readtest.Series("up", "api", 40*readtest.Minute, 100*readtest.Minute)}}
+	remote := &readtest.Store{Series: []*remotepb.TimeSeries{
+		readtest.Series("up", "api", 0, 100*readtest.Minute),
+		readtest.Series("up", "db", 0, 30*readtest.Minute),
+		readtest.Series("build_info", "api", 0, 100*readtest.Minute),
+	}}
+	server := upstreamServer(t, remote)
+	defer server.Close()
+
+	f := New(local, Config{URL: server.URL, Timeout: time.Second, Retention: time.Hour})
+	f.now = func() time.Time { return now }
+	resp, err := f.Query(&prompb.ReadRequest{Queries: []*prompb.Query{
+		readtest.Query("up", 10*readtest.Minute, 100*readtest.Minute),
+		readtest.Query("up", 50*readtest.Minute, 100*readtest.Minute),
+		readtest.Query("build_info", 50*readtest.Minute, 100*readtest.Minute),
+	}})
+	assert.NoError(t, err)
+
+	// The first query is split at the retention boundary, the second only
+	// reads Redis, and the third falls back for lack of data.
+	assert.Equal(t, [][2]int64{{40 * readtest.Minute, 100 * readtest.Minute}, {50 * readtest.Minute, 100 * readtest.Minute}, {50 * readtest.Minute, 100 * readtest.Minute}}, local.Queries)
+	assert.Equal(t, [][2]int64{{10 * readtest.Minute, 40*readtest.Minute - 1}, {50 * readtest.Minute, 100 * readtest.Minute}}, remote.Queries)
+
+	assert.Len(t, resp.Results, 3)
+	assert.Equal(t, []*remotepb.TimeSeries{readtest.Series("up", "api", 10*readtest.Minute, 100*readtest.Minute), readtest.Series("up", "db", 10*readtest.Minute, 30*readtest.Minute)}, resp.Results[0].Timeseries)
+	assert.Equal(t, []*remotepb.TimeSeries{readtest.Series("up", "api", 50*readtest.Minute, 100*readtest.Minute)}, resp.Results[1].Timeseries)
+	assert.Equal(t, []*remotepb.TimeSeries{readtest.Series("build_info", "api", 50*readtest.Minute, 100*readtest.Minute)}, resp.Results[2].Timeseries)
+}
+
+func TestFallbackOlderThanRetention(t *testing.T) {
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	local := &readtest.Store{}
+	remote := &readtest.Store{Series: []*remotepb.TimeSeries{readtest.Series("up", "api", 0, 100*readtest.Minute)}}
+	server := upstreamServer(t, remote)
+	defer server.Close()
+
+	f := New(local, Config{URL: server.URL, Timeout: time.Second, Retention: time.Hour})
+	f.now = func() time.Time { return now }
+	resp, err := f.Query(&prompb.ReadRequest{Queries: []*prompb.Query{readtest.Query("up", 0, 20*readtest.Minute)}})
+	assert.NoError(t, err)
+	assert.Empty(t, local.Queries)
+	assert.Equal(t, []*remotepb.TimeSeries{readtest.Series("up", "api", 0, 21*readtest.Minute)}, resp.Results[0].Timeseries)
+}
+
+func TestFallbackNormalizesUpstream(t *testing.T) {
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	// Another store may return series unsorted, and a labelset twice.
+	remote := &readtest.Store{Series: []*remotepb.TimeSeries{
+		readtest.Series("up", "db", 0, 10*readtest.Minute),
+		readtest.Series("up", "api", 5*readtest.Minute, 10*readtest.Minute),
+		readtest.Series("up", "api", 0, 6*readtest.Minute),
+	}}
+	server := upstreamServer(t, remote)
+	defer server.Close()
+
+	f := New(&readtest.Store{}, Config{URL: server.URL, Timeout: time.Second, Retention: time.Hour})
+	f.now = func() time.Time { return now }
+	resp, err := f.Query(readtest.Request(readtest.Query("up", 0, 20*readtest.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, []*remotepb.TimeSeries{
+		readtest.Series("up", "api", 0, 10*readtest.Minute),
+		readtest.Series("up", "db", 0, 10*readtest.Minute),
+	}, resp.Results[0].Timeseries)
+}
+
+func TestFallbackUpstreamFailure(t *testing.T) {
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	local := &readtest.Store{Series: []*remotepb.TimeSeries{readtest.Series("up", "api", 40*readtest.Minute, 100*readtest.Minute)}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	f := New(local, Config{URL: server.URL, Timeout: time.Second, Retention: time.Hour})
+	f.now = func() time.Time { return now }
+
+	// Data older than the retention is only upstream.
+	_, err := f.Query(&prompb.ReadRequest{Queries: []*prompb.Query{readtest.Query("up", 10*readtest.Minute, 100*readtest.Minute)}})
+	assert.EqualError(t, err, "reading from upstream: server returned HTTP status 503 Service Unavailable: unavailable")
+
+	// Looking for missing data upstream is best effort.
+	resp, err := f.Query(&prompb.ReadRequest{Queries: []*prompb.Query{readtest.Query("up", 50*readtest.Minute, 100*readtest.Minute), readtest.Query("build_info", 50*readtest.Minute, 100*readtest.Minute)}})
+	assert.NoError(t, err)
+	assert.Equal(t, []*remotepb.TimeSeries{readtest.Series("up", "api", 50*readtest.Minute, 100*readtest.Minute)}, resp.Results[0].Timeseries)
+	assert.Empty(t, resp.Results[1].Timeseries)
+}
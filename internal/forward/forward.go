@@ -0,0 +1,230 @@
+// Package forward tees accepted write requests to other remote-write
+// endpoints. Each destination has its own queue and sender, so a slow or
+// failing destination only drops its own requests and never holds up Redis
+// ingestion.
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons requests are dropped for.
+const (
+	ReasonQueueFull        = "queue_full"
+	ReasonRejected         = "rejected"
+	ReasonRetriesExhausted = "retries_exhausted"
+	ReasonShutdown         = "shutdown"
+)
+
+var (
+	sentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_forward_sent_requests_total",
+		Help: "Write requests forwarded, by destination.",
+	}, []string{"destination"})
+	droppedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_forward_dropped_requests_total",
+		Help: "Write requests that could not be forwarded, by destination and reason.",
+	}, []string{"destination", "reason"})
+	failedAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_forward_failed_attempts_total",
+		Help: "Failed attempts to forward a write request, by destination.",
+	}, []string{"destination"})
+	lag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_forward_lag_seconds",
+		Help: "Time the last request forwarded spent between being accepted and being sent, by destination.",
+	}, []string{"destination"})
+	queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_forward_queue_length",
+		Help: "Write requests waiting to be forwarded, by destination.",
+	}, []string{"destination"})
+)
+
+// Config configures the destinations.
+type Config struct {
+	QueueSize  int
+	MaxRetries int
+	Timeout    time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type queuedRequest struct {
+	body     []byte
+	accepted time.Time
+}
+
+// destination sends the requests queued for one URL, in order.
+type destination struct {
+	url    string
+	cfg    Config
+	client *http.Client
+	queue  chan queuedRequest
+	stop   chan struct{}
+}
+
+func (d *destination) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for r := range d.queue {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		queueLength.WithLabelValues(d.url).Set(float64(len(d.queue)))
+		d.send(r)
+	}
+}
+
+// send posts r, retrying server errors and network failures with an
+// exponential backoff.
+func (d *destination) send(r queuedRequest) {
+	backoff := d.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(r.body)
+		if err == nil {
+			sentRequests.WithLabelValues(d.url).Inc()
+			lag.WithLabelValues(d.url).Set(time.Since(r.accepted).Seconds())
+			return
+		}
+		failedAttempts.WithLabelValues(d.url).Inc()
+		if !retry {
+			droppedRequests.WithLabelValues(d.url, ReasonRejected).Inc()
+			log.WithFields(log.Fields{"destination": d.url, "err": err}).Warn("Write request rejected by forward destination, dropping it")
+			return
+		}
+		if attempt >= d.cfg.MaxRetries {
+			droppedRequests.WithLabelValues(d.url, ReasonRetriesExhausted).Inc()
+			log.WithFields(log.Fields{"destination": d.url, "err": err}).Warn("Could not forward write request, dropping it")
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-d.stop:
+			droppedRequests.WithLabelValues(d.url, ReasonShutdown).Inc()
+			return
+		}
+		if backoff *= 2; backoff > d.cfg.MaxBackoff {
+			backoff = d.cfg.MaxBackoff
+		}
+	}
+}
+
+// post sends one request, and tells whether a failure is worth retrying.
+func (d *destination) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "redis-ts-adapter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Tee forwards write requests to its destinations.
+type Tee struct {
+	destinations []*destination
+	wg           sync.WaitGroup
+
+	// mu guards the queues against being closed while requests are sent.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// New creates a Tee sending to urls, and starts its senders.
+func New(urls []string, cfg Config) *Tee {
+	t := &Tee{}
+	for _, url := range urls {
+		d := &destination{
+			url:    url,
+			cfg:    cfg,
+			client: &http.Client{Timeout: cfg.Timeout},
+			queue:  make(chan queuedRequest, cfg.QueueSize),
+			stop:   make(chan struct{}),
+		}
+		t.destinations = append(t.destinations, d)
+		t.wg.Add(1)
+		go d.run(&t.wg)
+	}
+	return t
+}
+
+// Forward queues req to every destination, as a remote-write 1.0 request.
+// It never blocks: destinations with a full queue drop it, and so does a
+// stopped Tee.
+func (t *Tee) Forward(req *remotepb.WriteRequest) {
+	if len(req.Timeseries) == 0 && len(req.Metadata) == 0 {
+		return
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Could not encode write request to forward")
+		return
+	}
+	r := queuedRequest{body: snappy.Encode(nil, data), accepted: time.Now()}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, d := range t.destinations {
+		if t.stopped {
+			droppedRequests.WithLabelValues(d.url, ReasonShutdown).Inc()
+			continue
+		}
+		select {
+		case d.queue <- r:
+			queueLength.WithLabelValues(d.url).Set(float64(len(d.queue)))
+		default:
+			droppedRequests.WithLabelValues(d.url, ReasonQueueFull).Inc()
+		}
+	}
+}
+
+// Stop sends what is queued, giving up on what is left after timeout.
+// Requests forwarded after Stop was called are dropped.
+func (t *Tee) Stop(timeout time.Duration) {
+	t.mu.Lock()
+	t.stopped = true
+	for _, d := range t.destinations {
+		close(d.queue)
+	}
+	t.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		for _, d := range t.destinations {
+			close(d.stop)
+			droppedRequests.WithLabelValues(d.url, ReasonShutdown).Add(float64(len(d.queue)))
+		}
+	}
+}
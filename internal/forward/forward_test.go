@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{
+	QueueSize:  10,
+	MaxRetries: 3,
+	Timeout:    time.Second,
+	MinBackoff: time.Millisecond,
+	MaxBackoff: 10 * time.Millisecond,
+}
+
+func testRequest() *remotepb.WriteRequest {
+	return &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+}
+
+func TestForward(t *testing.T) {
+	var attempts int32
+	received := make(chan *remotepb.WriteRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails, and is retried.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.NoError(t, err)
+		var req remotepb.WriteRequest
+		assert.NoError(t, proto.Unmarshal(data, &req))
+		received <- &req
+	}))
+	defer server.Close()
+
+	// A rejecting destination does not hold up the other one.
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	tee := New([]string{rejecting.URL, server.URL}, testConfig)
+	tee.Forward(testRequest())
+	tee.Forward(&remotepb.WriteRequest{})
+
+	select {
+	case req := <-received:
+		assert.Equal(t, testRequest(), req)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not forwarded")
+	}
+	tee.Stop(time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestForwardDropsWhenQueueIsFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	cfg := testConfig
+	cfg.QueueSize = 1
+	tee := New([]string{server.URL}, cfg)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			tee.Forward(testRequest())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Forward blocked on a slow destination")
+	}
+	close(release)
+	tee.Stop(time.Second)
+}
+
+func TestForwardAfterStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tee := New([]string{server.URL}, testConfig)
+	tee.Stop(time.Second)
+	assert.NotPanics(t, func() { tee.Forward(testRequest()) })
+}
@@ -0,0 +1,175 @@
+// Package hatracker deduplicates the samples of Prometheus HA pairs. Series
+// carrying both the cluster and the replica label are only accepted from the
+// replica elected for their cluster. The election lives in Redis, so every
+// adapter instance in front of the same database agrees on the leader.
+package hatracker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const electionKeyPrefix = "__ha_replica__:"
+
+var (
+	dedupedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_ha_deduped_samples_total",
+		Help: "Samples and histograms dropped because they came from a replica that is not elected, by cluster.",
+	}, []string{"cluster"})
+	electedReplicaChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_ha_elected_replica_changes_total",
+		Help: "Changes of the elected replica seen by this adapter, by cluster.",
+	}, []string{"cluster"})
+)
+
+// electScript keeps the replica in KEYS[1] if it was seen within the
+// failover timeout, and otherwise elects the calling replica. It returns the
+// elected replica.
+//
+// ARGV: replica, now in ms, failover timeout in ms.
+var electScript = redis.NewScript(`
+local current = redis.call('HMGET', KEYS[1], 'replica', 'seen')
+local replica, seen = current[1], tonumber(current[2])
+if replica == ARGV[1] or not replica or tonumber(ARGV[2]) - seen > tonumber(ARGV[3]) then
+	redis.call('HMSET', KEYS[1], 'replica', ARGV[1], 'seen', ARGV[2])
+	return ARGV[1]
+end
+return replica
+`)
+
+// Config configures a Tracker.
+type Config struct {
+	ClusterLabel string
+	ReplicaLabel string
+
+	// UpdateTimeout is how long an election result is trusted before asking
+	// Redis again, and so how often the leader refreshes its last seen time.
+	UpdateTimeout time.Duration
+	// FailoverTimeout is how long the leader may stay silent before another
+	// replica takes over. It must be greater than UpdateTimeout.
+	FailoverTimeout time.Duration
+}
+
+type election struct {
+	replica string
+	synced  time.Time
+	// refreshed is when the elected replica last refreshed its last seen
+	// time through this adapter.
+	refreshed time.Time
+}
+
+// Tracker filters write requests down to the elected replicas.
+type Tracker struct {
+	cfg   Config
+	elect func(cluster, replica string, now time.Time) (string, error)
+	now   func() time.Time
+
+	mu      sync.Mutex
+	elected map[string]election
+}
+
+// New creates a Tracker keeping its elections in client.
+func New(client redis.Cmdable, cfg Config) (*Tracker, error) {
+	if cfg.ClusterLabel == "" || cfg.ReplicaLabel == "" {
+		return nil, fmt.Errorf("cluster and replica labels are required")
+	}
+	if cfg.FailoverTimeout <= cfg.UpdateTimeout {
+		return nil, fmt.Errorf("failover timeout %s must be greater than update timeout %s", cfg.FailoverTimeout, cfg.UpdateTimeout)
+	}
+	t := &Tracker{cfg: cfg, now: time.Now, elected: make(map[string]election)}
+	t.elect = func(cluster, replica string, now time.Time) (string, error) {
+		return electScript.Run(client, []string{electionKeyPrefix + cluster},
+			replica, milliseconds(now), int64(cfg.FailoverTimeout/time.Millisecond)).String()
+	}
+	return t, nil
+}
+
+// Dedupe removes the series of non-elected replicas from req, and the
+// replica label from the rest, so that both replicas write the same keys.
+func (t *Tracker) Dedupe(req *remotepb.WriteRequest) error {
+	now := t.now()
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		cluster, replica, replicaIndex := t.findLabels(ts.Labels)
+		if cluster == "" || replicaIndex < 0 {
+			kept = append(kept, ts)
+			continue
+		}
+
+		accepted, err := t.accept(cluster, replica, now)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			dedupedSamples.WithLabelValues(cluster).Add(float64(len(ts.Samples) + len(ts.Histograms)))
+			continue
+		}
+		ts.Labels = append(ts.Labels[:replicaIndex:replicaIndex], ts.Labels[replicaIndex+1:]...)
+		kept = append(kept, ts)
+	}
+	req.Timeseries = kept
+	return nil
+}
+
+func (t *Tracker) findLabels(labels []*prompb.Label) (cluster string, replica string, replicaIndex int) {
+	replicaIndex = -1
+	for i, l := range labels {
+		switch l.Name {
+		case t.cfg.ClusterLabel:
+			cluster = l.Value
+		case t.cfg.ReplicaLabel:
+			replica, replicaIndex = l.Value, i
+		}
+	}
+	return cluster, replica, replicaIndex
+}
+
+// accept tells whether replica is the elected one of cluster, only asking
+// Redis once the cached election is older than the update timeout. The
+// elected replica asks again once its own last refresh is that old, even if
+// the other replica refreshed the cached election meanwhile, so that its last
+// seen time stays current.
+func (t *Tracker) accept(cluster, replica string, now time.Time) (bool, error) {
+	t.mu.Lock()
+	e, ok := t.elected[cluster]
+	t.mu.Unlock()
+	if ok && now.Sub(e.synced) < t.cfg.UpdateTimeout {
+		if e.replica != replica {
+			return false, nil
+		}
+		if now.Sub(e.refreshed) < t.cfg.UpdateTimeout {
+			return true, nil
+		}
+	}
+
+	elected, err := t.elect(cluster, replica, now)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	previous, ok := t.elected[cluster]
+	if ok && previous.replica != elected {
+		electedReplicaChanges.WithLabelValues(cluster).Inc()
+	}
+	e = election{replica: elected, synced: now}
+	if elected == replica {
+		e.refreshed = now
+	} else if ok && previous.replica == elected {
+		e.refreshed = previous.refreshed
+	}
+	t.elected[cluster] = e
+	t.mu.Unlock()
+	return elected == replica, nil
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
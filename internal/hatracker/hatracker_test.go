@@ -0,0 +1,122 @@
+package hatracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{
+	ClusterLabel:    "cluster",
+	ReplicaLabel:    "__replica__",
+	UpdateTimeout:   15 * time.Second,
+	FailoverTimeout: 30 * time.Second,
+}
+
+func series(labels ...string) *remotepb.TimeSeries {
+	ts := &remotepb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func request(replica string) *remotepb.WriteRequest {
+	return &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		series("__name__", "up", "__replica__", replica, "cluster", "prod"),
+		series("__name__", "up", "cluster", "prod"),
+		series("__name__", "up", "__replica__", replica),
+	}}
+}
+
+func TestDedupe(t *testing.T) {
+	now := time.Unix(1000, 0)
+	leader, elections := "a", 0
+	tracker := &Tracker{cfg: testConfig, now: func() time.Time { return now }, elected: make(map[string]election)}
+	tracker.elect = func(cluster, replica string, _ time.Time) (string, error) {
+		elections++
+		return leader, nil
+	}
+
+	req := request("a")
+	assert.NoError(t, tracker.Dedupe(req))
+	assert.Len(t, req.Timeseries, 3)
+	assert.Equal(t, []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: "prod"}}, req.Timeseries[0].Labels)
+
+	req = request("b")
+	assert.NoError(t, tracker.Dedupe(req))
+	assert.Len(t, req.Timeseries, 2, "only series without both labels are kept")
+	assert.Equal(t, 1, elections, "the cached election is reused")
+
+	now = now.Add(testConfig.UpdateTimeout)
+	leader = "b"
+	req = request("b")
+	assert.NoError(t, tracker.Dedupe(req))
+	assert.Len(t, req.Timeseries, 3)
+	assert.Equal(t, 2, elections)
+}
+
+func TestLeaderStaysElected(t *testing.T) {
+	now := time.Unix(1000, 0)
+	// elect mirrors electScript.
+	var elected string
+	var seen time.Time
+	tracker := &Tracker{cfg: testConfig, now: func() time.Time { return now }, elected: make(map[string]election)}
+	tracker.elect = func(cluster, replica string, now time.Time) (string, error) {
+		if replica == elected || elected == "" || now.Sub(seen) > testConfig.FailoverTimeout {
+			elected, seen = replica, now
+		}
+		return elected, nil
+	}
+
+	req := request("a")
+	assert.NoError(t, tracker.Dedupe(req))
+	assert.Len(t, req.Timeseries, 3)
+
+	// The standby's requests come first, and refresh the cached election
+	// every time.
+	for i := 0; i < 10; i++ {
+		now = now.Add(testConfig.UpdateTimeout)
+		req = request("b")
+		assert.NoError(t, tracker.Dedupe(req))
+		assert.Len(t, req.Timeseries, 2, "the standby stays deduplicated")
+
+		now = now.Add(time.Second)
+		req = request("a")
+		assert.NoError(t, tracker.Dedupe(req))
+		assert.Len(t, req.Timeseries, 3, "the leader stays elected")
+	}
+	assert.Equal(t, "a", elected)
+}
+
+func TestNewValidatesTimeouts(t *testing.T) {
+	cfg := testConfig
+	cfg.FailoverTimeout = cfg.UpdateTimeout
+	_, err := New(nil, cfg)
+	assert.Error(t, err)
+}
+
+func TestElectionInRedis(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	client.Del(electionKeyPrefix + "test_cluster")
+
+	now := time.Unix(1000, 0)
+	tracker, err := New(client, testConfig)
+	assert.NoError(t, err)
+
+	elected, err := tracker.elect("test_cluster", "a", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", elected)
+
+	elected, err = tracker.elect("test_cluster", "b", now.Add(testConfig.FailoverTimeout))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", elected, "the leader is kept within the failover timeout")
+
+	elected, err = tracker.elect("test_cluster", "b", now.Add(testConfig.FailoverTimeout+time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", elected)
+}
@@ -0,0 +1,263 @@
+// Package leader elects one adapter, among those in front of the same Redis,
+// to run the background tasks that must only run once, such as garbage
+// collection. The leader holds a lease, a key set with SET NX PX, and renews
+// it while it lives. Each new lease gets a fencing token greater than every
+// previous one, so that what a deposed leader still does can be told apart.
+package leader
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	leaseKey = "__leader__"
+	// TokenKey holds the fencing token of the newest lease. Tasks check it
+	// against their own token before their destructive writes.
+	TokenKey = "__leader__:token"
+)
+
+var (
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_leader",
+		Help: "Whether this adapter is the leader running the singleton background tasks.",
+	})
+	leaderChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_leader_changes_total",
+		Help: "Times this adapter became or stopped being the leader.",
+	})
+	campaignFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_leader_campaign_failures_total",
+		Help: "Failed attempts to acquire or renew the leader lease.",
+	})
+)
+
+// campaignScript acquires the lease in KEYS[1] for ARGV[1], for ARGV[2] ms,
+// drawing a new fencing token from KEYS[2], or renews it if ARGV[1] holds it
+// already. It returns the holder of the lease and its token.
+var campaignScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return {ARGV[1], redis.call('INCR', KEYS[2])}
+end
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return {holder, tonumber(redis.call('GET', KEYS[2]) or '0')}
+`)
+
+// releaseScript removes the lease in KEYS[1] if ARGV[1] holds it.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Config configures an Elector.
+type Config struct {
+	// ID identifies this adapter. It must be unique among the adapters.
+	ID string
+	// LeaseDuration is how long the leader may stay silent before another
+	// adapter takes over.
+	LeaseDuration time.Duration
+	// RenewInterval is how often the lease is renewed, or asked for. It must
+	// be less than LeaseDuration.
+	RenewInterval time.Duration
+}
+
+// Status is what an Elector knows of the election.
+type Status struct {
+	ID string
+	// Leader is the adapter holding the lease when it was last checked.
+	Leader string
+	// Token is the fencing token of the leader's lease.
+	Token    int64
+	IsLeader bool
+	Tasks    []string
+}
+
+type task struct {
+	name string
+	run  func(stop <-chan struct{}, token int64)
+}
+
+// Elector takes part in the election, and runs the registered tasks while
+// this adapter leads.
+type Elector struct {
+	cfg      Config
+	campaign func(id string, lease time.Duration) (holder string, token int64, err error)
+	release  func(id string) error
+	now      func() time.Time
+
+	tasks []task
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu      sync.Mutex
+	leader  string
+	token   int64
+	renewed time.Time
+	// running is closed to stop the tasks, and nil while not leading.
+	running chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New creates an Elector keeping the lease in client.
+func New(client redis.Cmdable, cfg Config) (*Elector, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("an ID is required")
+	}
+	if cfg.RenewInterval <= 0 || cfg.LeaseDuration <= cfg.RenewInterval {
+		return nil, fmt.Errorf("lease duration %s must be greater than renew interval %s", cfg.LeaseDuration, cfg.RenewInterval)
+	}
+	e := &Elector{cfg: cfg, now: time.Now, stop: make(chan struct{}), done: make(chan struct{})}
+	e.campaign = func(id string, lease time.Duration) (string, int64, error) {
+		result, err := campaignScript.Run(client, []string{leaseKey, TokenKey}, id, int64(lease/time.Millisecond)).Result()
+		if err != nil {
+			return "", 0, err
+		}
+		reply, ok := result.([]interface{})
+		if !ok || len(reply) != 2 {
+			return "", 0, fmt.Errorf("unexpected campaign reply %v", result)
+		}
+		holder, _ := reply[0].(string)
+		token, _ := reply[1].(int64)
+		return holder, token, nil
+	}
+	e.release = func(id string) error {
+		return releaseScript.Run(client, []string{leaseKey}, id).Err()
+	}
+	return e, nil
+}
+
+// Register adds a task run while this adapter leads. run must return once
+// stop is closed; token is the fencing token of the lease it runs under.
+// Tasks must be registered before Run is called.
+func (e *Elector) Register(name string, run func(stop <-chan struct{}, token int64)) {
+	e.tasks = append(e.tasks, task{name: name, run: run})
+}
+
+// Run campaigns every renew interval until Stop is called.
+func (e *Elector) Run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.RenewInterval)
+	defer ticker.Stop()
+	for {
+		e.tick(e.now())
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			e.resign()
+			return
+		}
+	}
+}
+
+// Stop stops the tasks and hands leadership over, by releasing the lease, so
+// that another adapter takes over at its next campaign.
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *Elector) tick(now time.Time) {
+	holder, token, err := e.campaign(e.cfg.ID, e.cfg.LeaseDuration)
+	if err != nil {
+		campaignFailures.Inc()
+		log.WithFields(log.Fields{"err": err}).Warn("Could not campaign for leadership")
+		// Stop leading before the lease may lapse, and another adapter take
+		// over, by the next renewal.
+		if e.leading() && now.Sub(e.renewed)+e.cfg.RenewInterval >= e.cfg.LeaseDuration {
+			e.stepDown()
+		}
+		return
+	}
+
+	e.mu.Lock()
+	previousToken := e.token
+	e.leader, e.token = holder, token
+	e.mu.Unlock()
+	if holder != e.cfg.ID {
+		e.stepDown()
+		return
+	}
+	e.renewed = now
+	// A new token means the lease lapsed in between, and another adapter
+	// may have led meanwhile.
+	if e.leading() && token != previousToken {
+		e.stepDown()
+	}
+	if !e.leading() {
+		e.stepUp(token)
+	}
+}
+
+func (e *Elector) leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.running != nil
+}
+
+func (e *Elector) stepUp(token int64) {
+	running := make(chan struct{})
+	e.mu.Lock()
+	e.running = running
+	e.mu.Unlock()
+	for _, t := range e.tasks {
+		e.wg.Add(1)
+		go func(t task) {
+			defer e.wg.Done()
+			t.run(running, token)
+		}(t)
+	}
+	isLeader.Set(1)
+	leaderChanges.Inc()
+	log.WithFields(log.Fields{"id": e.cfg.ID, "token": token}).Info("Became the leader")
+}
+
+// stepDown stops the tasks, and waits for them to return.
+func (e *Elector) stepDown() {
+	e.mu.Lock()
+	running := e.running
+	e.running = nil
+	e.mu.Unlock()
+	if running == nil {
+		return
+	}
+	close(running)
+	e.wg.Wait()
+	isLeader.Set(0)
+	leaderChanges.Inc()
+	log.WithFields(log.Fields{"id": e.cfg.ID}).Info("Stopped being the leader")
+}
+
+func (e *Elector) resign() {
+	e.stepDown()
+	if err := e.release(e.cfg.ID); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Could not release the leader lease")
+		return
+	}
+	e.mu.Lock()
+	if e.leader == e.cfg.ID {
+		e.leader = ""
+	}
+	e.mu.Unlock()
+}
+
+// Status returns the election as last seen.
+func (e *Elector) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := Status{ID: e.cfg.ID, Leader: e.leader, Token: e.token, IsLeader: e.running != nil}
+	for _, t := range e.tasks {
+		status.Tasks = append(status.Tasks, t.name)
+	}
+	return status
+}
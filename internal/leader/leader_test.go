@@ -0,0 +1,121 @@
+package leader
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{ID: "a", LeaseDuration: 15 * time.Second, RenewInterval: 5 * time.Second}
+
+// recorder is a task recording the tokens it ran under, and whether it runs.
+type recorder struct {
+	mu      sync.Mutex
+	tokens  []int64
+	running bool
+}
+
+func (r *recorder) run(stop <-chan struct{}, token int64) {
+	r.mu.Lock()
+	r.tokens, r.running = append(r.tokens, token), true
+	r.mu.Unlock()
+	<-stop
+	r.mu.Lock()
+	r.running = false
+	r.mu.Unlock()
+}
+
+func (r *recorder) state() ([]int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.tokens...), r.running
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
+
+func TestElector(t *testing.T) {
+	holder, token := "b", int64(1)
+	var err error
+	released := false
+	e := &Elector{cfg: testConfig, stop: make(chan struct{}), done: make(chan struct{})}
+	e.campaign = func(string, time.Duration) (string, int64, error) { return holder, token, err }
+	e.release = func(string) error { released = true; return nil }
+	task := &recorder{}
+	e.Register("task", task.run)
+
+	now := time.Unix(1000, 0)
+	e.tick(now)
+	assert.False(t, e.Status().IsLeader)
+	assert.Equal(t, "b", e.Status().Leader)
+
+	holder, token = "a", 2
+	e.tick(now)
+	waitFor(t, func() bool { _, running := task.state(); return running })
+	assert.Equal(t, Status{ID: "a", Leader: "a", Token: 2, IsLeader: true, Tasks: []string{"task"}}, e.Status())
+
+	// Failed renewals keep the lead while the lease surely holds.
+	err = errors.New("connection refused")
+	e.tick(now.Add(testConfig.RenewInterval))
+	assert.True(t, e.Status().IsLeader)
+	e.tick(now.Add(2 * testConfig.RenewInterval))
+	assert.False(t, e.Status().IsLeader)
+	_, running := task.state()
+	assert.False(t, running, "tasks are stopped before the lease may lapse")
+
+	// The lease lapsed and was acquired again, with a new token.
+	err, token = nil, 4
+	e.tick(now.Add(3 * testConfig.RenewInterval))
+	assert.True(t, e.Status().IsLeader)
+	waitFor(t, func() bool { tokens, _ := task.state(); return len(tokens) == 2 })
+	tokens, _ := task.state()
+	assert.Equal(t, []int64{2, 4}, tokens)
+
+	e.resign()
+	assert.True(t, released)
+	assert.False(t, e.Status().IsLeader)
+	assert.Equal(t, "", e.Status().Leader)
+	_, running = task.state()
+	assert.False(t, running)
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	_, err := New(nil, Config{ID: "a", LeaseDuration: time.Second, RenewInterval: time.Second})
+	assert.Error(t, err)
+	_, err = New(nil, Config{LeaseDuration: 15 * time.Second, RenewInterval: 5 * time.Second})
+	assert.Error(t, err)
+}
+
+func TestElectionInRedis(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	client.Del(leaseKey)
+
+	a, err := New(client, Config{ID: "a", LeaseDuration: 15 * time.Second, RenewInterval: 5 * time.Second})
+	assert.NoError(t, err)
+	b, err := New(client, Config{ID: "b", LeaseDuration: 15 * time.Second, RenewInterval: 5 * time.Second})
+	assert.NoError(t, err)
+
+	a.tick(time.Now())
+	b.tick(time.Now())
+	assert.True(t, a.Status().IsLeader)
+	assert.False(t, b.Status().IsLeader)
+	assert.Equal(t, "a", b.Status().Leader)
+	token := a.Status().Token
+
+	// Resigning hands over to the next adapter to campaign, under a greater
+	// token.
+	a.resign()
+	b.tick(time.Now())
+	assert.True(t, b.Status().IsLeader)
+	assert.True(t, b.Status().Token > token)
+	b.resign()
+}
@@ -0,0 +1,150 @@
+// Package promseries holds the helpers on Prometheus series shared by the
+// store, the readers in front of it and the aggregator: identifying and
+// ordering labelsets, and merging the series read in several parts.
+package promseries
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Merge puts the series of parts together as Prometheus expects of remote
+// storage: labels sorted by name, unique and without empty values, each
+// labelset once, with its samples and histograms in time order and a single
+// one per timestamp, and series sorted by labels. Of those sharing a
+// timestamp, the one of the latest series, in the latest part, is kept. The
+// series of parts are left unchanged, so they may be cached.
+func Merge(parts ...[]*remotepb.TimeSeries) []*remotepb.TimeSeries {
+	var merged []*remotepb.TimeSeries
+	byLabels := make(map[string]*remotepb.TimeSeries)
+	// owned tells the merged series whose slices were copied, that may be
+	// appended to.
+	owned := make(map[*remotepb.TimeSeries]bool)
+	for _, part := range parts {
+		for _, ts := range part {
+			labels := NormalizeLabels(ts.Labels)
+			key := LabelsKey(labels)
+			previous, ok := byLabels[key]
+			if !ok {
+				previous = &remotepb.TimeSeries{Labels: labels, Samples: ts.Samples, Histograms: ts.Histograms}
+				byLabels[key] = previous
+				merged = append(merged, previous)
+				continue
+			}
+			if !owned[previous] {
+				previous.Samples = append([]prompb.Sample(nil), previous.Samples...)
+				previous.Histograms = append([]remotepb.Histogram(nil), previous.Histograms...)
+				owned[previous] = true
+			}
+			previous.Samples = append(previous.Samples, ts.Samples...)
+			previous.Histograms = append(previous.Histograms, ts.Histograms...)
+		}
+	}
+
+	for _, ts := range merged {
+		ts.Samples = dedupeSamples(ts.Samples, owned[ts])
+		ts.Histograms = dedupeHistograms(ts.Histograms, owned[ts])
+	}
+	sort.Slice(merged, func(i, j int) bool { return CompareLabels(merged[i].Labels, merged[j].Labels) < 0 })
+	return merged
+}
+
+// NormalizeLabels returns labels sorted by name, without empty values, and
+// with the first value of repeated names. labels is left unchanged.
+func NormalizeLabels(labels []*prompb.Label) []*prompb.Label {
+	normalized := make([]*prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Value != "" {
+			normalized = append(normalized, l)
+		}
+	}
+	sort.SliceStable(normalized, func(i, j int) bool { return normalized[i].Name < normalized[j].Name })
+	unique := normalized[:0]
+	for i, l := range normalized {
+		if i == 0 || l.Name != normalized[i-1].Name {
+			unique = append(unique, l)
+		}
+	}
+	return unique
+}
+
+// LabelsKey identifies a labelset, whatever the order of its labels.
+func LabelsKey(labels []*prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+"\xff"+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// CompareLabels orders sorted labelsets as Prometheus does: label by label,
+// by name then value, and a labelset before those it is a prefix of.
+func CompareLabels(a, b []*prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return strings.Compare(a[i].Name, b[i].Name)
+		}
+		if a[i].Value != b[i].Value {
+			return strings.Compare(a[i].Value, b[i].Value)
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Mod is the floor modulo, so that negative timestamps fall in the interval
+// before zero.
+func Mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// dedupeSamples sorts samples by timestamp, keeping the last of those with
+// the same timestamp. Samples it does not own are copied before they are
+// changed.
+func dedupeSamples(samples []prompb.Sample, owned bool) []prompb.Sample {
+	ordered := true
+	for i := 1; i < len(samples) && ordered; i++ {
+		ordered = samples[i-1].Timestamp < samples[i].Timestamp
+	}
+	if ordered {
+		return samples
+	}
+	if !owned {
+		samples = append([]prompb.Sample(nil), samples...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	deduped := samples[:0]
+	for i, s := range samples {
+		if i+1 < len(samples) && samples[i+1].Timestamp == s.Timestamp {
+			continue
+		}
+		deduped = append(deduped, s)
+	}
+	return deduped
+}
+
+// dedupeHistograms is dedupeSamples for histograms.
+func dedupeHistograms(histograms []remotepb.Histogram, owned bool) []remotepb.Histogram {
+	ordered := true
+	for i := 1; i < len(histograms) && ordered; i++ {
+		ordered = histograms[i-1].Timestamp < histograms[i].Timestamp
+	}
+	if ordered {
+		return histograms
+	}
+	if !owned {
+		histograms = append([]remotepb.Histogram(nil), histograms...)
+	}
+	sort.SliceStable(histograms, func(i, j int) bool { return histograms[i].Timestamp < histograms[j].Timestamp })
+	deduped := histograms[:0]
+	for i, h := range histograms {
+		if i+1 < len(histograms) && histograms[i+1].Timestamp == h.Timestamp {
+			continue
+		}
+		deduped = append(deduped, h)
+	}
+	return deduped
+}
@@ -0,0 +1,71 @@
+package promseries
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	name := &prompb.Label{Name: "__name__", Value: "up"}
+	job := &prompb.Label{Name: "job", Value: "api"}
+	series := []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{job, name, {Name: "env", Value: ""}}, Samples: []prompb.Sample{{Value: 3, Timestamp: 3}, {Value: 1, Timestamp: 1}}},
+		{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 5, Timestamp: 5}}},
+		// The same labelset, written to another key.
+		{Labels: []*prompb.Label{name, job, job}, Samples: []prompb.Sample{{Value: 2, Timestamp: 2}, {Value: 4, Timestamp: 3}}},
+		{Labels: []*prompb.Label{job, name}, Histograms: []remotepb.Histogram{{Timestamp: 2, Sum: 1}, {Timestamp: 1}, {Timestamp: 2, Sum: 2}}},
+	}
+
+	assert.Equal(t, []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 5, Timestamp: 5}}},
+		{
+			Labels:     []*prompb.Label{name, job},
+			Samples:    []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}, {Value: 4, Timestamp: 3}},
+			Histograms: []remotepb.Histogram{{Timestamp: 1}, {Timestamp: 2, Sum: 2}},
+		},
+	}, Merge(series))
+}
+
+func TestMergeParts(t *testing.T) {
+	name := &prompb.Label{Name: "__name__", Value: "up"}
+	older := []*remotepb.TimeSeries{{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}}}}
+	newer := []*remotepb.TimeSeries{{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 3, Timestamp: 2}, {Value: 4, Timestamp: 3}}}}
+
+	assert.Equal(t, []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 3, Timestamp: 2}, {Value: 4, Timestamp: 3}}},
+	}, Merge(older, newer))
+	// The parts may be cached, and are left as they were.
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}}, older[0].Samples)
+	assert.Equal(t, []prompb.Sample{{Value: 3, Timestamp: 2}, {Value: 4, Timestamp: 3}}, newer[0].Samples)
+
+	unsorted := []*remotepb.TimeSeries{{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 2, Timestamp: 2}, {Value: 1, Timestamp: 1}}}}
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}}, Merge(unsorted)[0].Samples)
+	assert.Equal(t, []prompb.Sample{{Value: 2, Timestamp: 2}, {Value: 1, Timestamp: 1}}, unsorted[0].Samples)
+}
+
+func TestLabelsKey(t *testing.T) {
+	a := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	b := []*prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}}
+	c := []*prompb.Label{{Name: "__name__", Value: "up,job=api"}}
+	assert.Equal(t, LabelsKey(a), LabelsKey(b))
+	assert.NotEqual(t, LabelsKey(a), LabelsKey(c))
+}
+
+func TestCompareLabels(t *testing.T) {
+	a := []*prompb.Label{{Name: "__name__", Value: "up"}}
+	b := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	c := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+	assert.True(t, CompareLabels(a, b) < 0)
+	assert.True(t, CompareLabels(b, c) < 0)
+	assert.True(t, CompareLabels(c, a) > 0)
+	assert.Equal(t, 0, CompareLabels(b, b))
+}
+
+func TestMod(t *testing.T) {
+	assert.Equal(t, int64(3), Mod(13, 10))
+	assert.Equal(t, int64(7), Mod(-3, 10))
+	assert.Equal(t, int64(0), Mod(-10, 10))
+}
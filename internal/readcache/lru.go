@@ -0,0 +1,76 @@
+package readcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+)
+
+// lru holds the cached buckets, evicting the least recently used ones beyond
+// maxBytes, and dropping those older than ttl.
+type lru struct {
+	maxBytes int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	bytes int
+	// order has the most recently used entries first.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	series  []*remotepb.TimeSeries
+	size    int
+	expires time.Time
+}
+
+func newLRU(maxBytes int, ttl time.Duration) *lru {
+	return &lru{maxBytes: maxBytes, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string, now time.Time) ([]*remotepb.TimeSeries, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if now.After(e.expires) {
+		l.remove(element)
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return e.series, true
+}
+
+// add caches series under key. Entries larger than the whole cache are not
+// kept.
+func (l *lru) add(key string, series []*remotepb.TimeSeries, size int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+	if size > l.maxBytes {
+		return
+	}
+	for l.bytes+size > l.maxBytes {
+		l.remove(l.order.Back())
+		evictions.Inc()
+	}
+	l.entries[key] = l.order.PushFront(&entry{key: key, series: series, size: size, expires: now.Add(l.ttl)})
+	l.bytes += size
+	cachedBytes.Set(float64(l.bytes))
+}
+
+func (l *lru) remove(element *list.Element) {
+	e := l.order.Remove(element).(*entry)
+	delete(l.entries, e.key)
+	l.bytes -= e.size
+	cachedBytes.Set(float64(l.bytes))
+}
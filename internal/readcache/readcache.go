@@ -0,0 +1,219 @@
+// Package readcache caches remote read results for the dashboards that read
+// the same recent window over and over. Results are cached by aligned time
+// bucket: buckets that ended long enough ago no longer change, and are served
+// from memory, so only the recent edge of a query is read from the store.
+package readcache
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_read_cache_lookups_total",
+		Help: "Time buckets of remote read queries looked up in the result cache, by result (hit or miss).",
+	}, []string{"result"})
+	evictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_read_cache_evictions_total",
+		Help: "Cached buckets evicted to stay within the memory limit.",
+	})
+	cachedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_read_cache_bytes",
+		Help: "Estimated size of the cached buckets.",
+	})
+)
+
+// Reader is the store the cache reads through to.
+type Reader interface {
+	Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error)
+	Name() string
+}
+
+// Config configures a Cache.
+type Config struct {
+	// BucketSize is the length of the time buckets results are cached by.
+	// Buckets are aligned on the Unix epoch.
+	BucketSize time.Duration
+	// MaxFreshness is how far back data may still change, from late
+	// samples. Only the buckets that ended before are cached.
+	MaxFreshness time.Duration
+	// TTL bounds how long a bucket stays cached, so that deleted series
+	// eventually disappear from results.
+	TTL time.Duration
+	// MaxBytes bounds the estimated size of the cached buckets.
+	MaxBytes int
+}
+
+// Cache answers read requests from cached buckets where it can, and from the
+// store otherwise.
+type Cache struct {
+	reader  Reader
+	cfg     Config
+	now     func() time.Time
+	entries *lru
+}
+
+// New creates a Cache in front of reader.
+func New(reader Reader, cfg Config) *Cache {
+	return &Cache{reader: reader, cfg: cfg, now: time.Now, entries: newLRU(cfg.MaxBytes, cfg.TTL)}
+}
+
+// Name returns the name of the store.
+func (c *Cache) Name() string {
+	return c.reader.Name()
+}
+
+// piece is part of the result of a query: a cached bucket, or a query sent
+// to the store, covering the buckets to cache and possibly the recent edge.
+type piece struct {
+	series []*remotepb.TimeSeries
+	// fetch is the index of the query sent to the store, or -1.
+	fetch   int
+	buckets []int64
+}
+
+type plan struct {
+	query  *prompb.Query
+	key    string
+	pieces []*piece
+}
+
+// Query answers the queries from the cached buckets, and reads the missing
+// buckets and the recent edge of every query from the store, in a single
+// request.
+func (c *Cache) Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error) {
+	now := c.now()
+	fetch := &prompb.ReadRequest{}
+	plans := make([]*plan, 0, len(req.Queries))
+	for _, q := range req.Queries {
+		plans = append(plans, c.plan(q, now, fetch))
+	}
+
+	var fetched *remotepb.ReadResponse
+	if len(fetch.Queries) > 0 {
+		var err error
+		fetched, err = c.reader.Query(fetch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	results := make([]*remotepb.QueryResult, 0, len(plans))
+	for _, p := range plans {
+		results = append(results, &remotepb.QueryResult{Timeseries: c.assemble(p, fetched, now)})
+	}
+	return &remotepb.ReadResponse{Results: results}, nil
+}
+
+// plan finds the cached buckets of q, and adds the queries reading the rest
+// to fetch: one per run of missing buckets, and one for the recent edge.
+func (c *Cache) plan(q *prompb.Query, now time.Time, fetch *prompb.ReadRequest) *plan {
+	p := &plan{query: q, key: matchersKey(q.Matchers)}
+	bucket := int64(c.cfg.BucketSize / time.Millisecond)
+	cutoff := milliseconds(now.Add(-c.cfg.MaxFreshness))
+	if bucket <= 0 || q.StartTimestampMs > q.EndTimestampMs {
+		p.pieces = append(p.pieces, c.fetch(fetch, q, q.StartTimestampMs, q.EndTimestampMs))
+		return p
+	}
+
+	start := q.StartTimestampMs - promseries.Mod(q.StartTimestampMs, bucket)
+	var run *piece
+	for ; start <= q.EndTimestampMs && start+bucket <= cutoff; start += bucket {
+		if series, ok := c.entries.get(bucketKey(p.key, start), now); ok {
+			lookups.WithLabelValues("hit").Inc()
+			p.pieces = append(p.pieces, &piece{series: series, fetch: -1})
+			run = nil
+			continue
+		}
+		lookups.WithLabelValues("miss").Inc()
+		if run == nil {
+			run = c.fetch(fetch, q, start, start+bucket-1)
+			p.pieces = append(p.pieces, run)
+		} else {
+			fetch.Queries[run.fetch].EndTimestampMs = start + bucket - 1
+		}
+		run.buckets = append(run.buckets, start)
+	}
+	// The rest is too recent to cache.
+	if start <= q.EndTimestampMs {
+		if start < q.StartTimestampMs {
+			start = q.StartTimestampMs
+		}
+		p.pieces = append(p.pieces, c.fetch(fetch, q, start, q.EndTimestampMs))
+	}
+	return p
+}
+
+func (c *Cache) fetch(fetch *prompb.ReadRequest, q *prompb.Query, start, end int64) *piece {
+	fetch.Queries = append(fetch.Queries, &prompb.Query{StartTimestampMs: start, EndTimestampMs: end, Matchers: q.Matchers, Hints: q.Hints})
+	return &piece{fetch: len(fetch.Queries) - 1}
+}
+
+// assemble caches the buckets read for p, and puts its pieces together.
+func (c *Cache) assemble(p *plan, fetched *remotepb.ReadResponse, now time.Time) []*remotepb.TimeSeries {
+	bucket := int64(c.cfg.BucketSize / time.Millisecond)
+	parts := make([][]*remotepb.TimeSeries, 0, len(p.pieces))
+	for _, piece := range p.pieces {
+		series := piece.series
+		if piece.fetch >= 0 {
+			series = fetched.Results[piece.fetch].Timeseries
+			for _, start := range piece.buckets {
+				cached := between(series, start, start+bucket-1)
+				size := 0
+				for _, ts := range cached {
+					size += proto.Size(ts)
+				}
+				c.entries.add(bucketKey(p.key, start), cached, size, now)
+			}
+		}
+		parts = append(parts, between(series, p.query.StartTimestampMs, p.query.EndTimestampMs))
+	}
+	return promseries.Merge(parts...)
+}
+
+// between returns series with only their samples and histograms between
+// start and end. Series are kept even when empty, as the store returns them.
+// The series returned share the slices of those passed in.
+func between(series []*remotepb.TimeSeries, start, end int64) []*remotepb.TimeSeries {
+	result := make([]*remotepb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		from := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= start })
+		to := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp > end })
+		hFrom := sort.Search(len(ts.Histograms), func(i int) bool { return ts.Histograms[i].Timestamp >= start })
+		hTo := sort.Search(len(ts.Histograms), func(i int) bool { return ts.Histograms[i].Timestamp > end })
+		result = append(result, &remotepb.TimeSeries{
+			Labels:     ts.Labels,
+			Samples:    ts.Samples[from:to:to],
+			Histograms: ts.Histograms[hFrom:hTo:hTo],
+		})
+	}
+	return result
+}
+
+// matchersKey identifies the series selected by matchers, whatever their
+// order.
+func matchersKey(matchers []*prompb.LabelMatcher) string {
+	keys := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		keys = append(keys, m.Name+"\xff"+m.Type.String()+"\xff"+m.Value)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\xfe")
+}
+
+func bucketKey(matchersKey string, start int64) string {
+	return matchersKey + "\xfd" + strconv.FormatInt(start, 10)
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,95 @@
+package readcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readtest"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStore() *readtest.Store {
+	s := &readtest.Store{Series: []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}},
+	}}
+	for t := int64(0); t < 120*readtest.Minute; t += readtest.Minute / 2 {
+		s.Series[0].Samples = append(s.Series[0].Samples, prompb.Sample{Value: float64(t), Timestamp: t})
+	}
+	s.Series[1].Histograms = []remotepb.Histogram{{Timestamp: 5 * readtest.Minute}, {Timestamp: 95 * readtest.Minute}}
+	return s
+}
+
+func TestCache(t *testing.T) {
+	s := newStore()
+	cache := New(s, Config{BucketSize: 10 * time.Minute, MaxFreshness: 5 * time.Minute, TTL: time.Hour, MaxBytes: 1 << 20})
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	expected, _ := s.Query(readtest.Request(readtest.Query("up", 3*readtest.Minute, 100*readtest.Minute)))
+	s.Queries = nil
+	resp, err := cache.Query(readtest.Request(readtest.Query("up", 3*readtest.Minute, 100*readtest.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, resp)
+	// The buckets that ended 5 minutes ago are read whole, to be cached.
+	assert.Equal(t, [][2]int64{{0, 90*readtest.Minute - 1}, {90 * readtest.Minute, 100 * readtest.Minute}}, s.Queries)
+
+	// A dashboard refresh only reads the recent edge.
+	now = now.Add(30 * time.Second)
+	s.Queries = nil
+	expected, _ = s.Query(readtest.Request(readtest.Query("up", 3*readtest.Minute+readtest.Minute/2, 100*readtest.Minute+readtest.Minute/2)))
+	s.Queries = nil
+	resp, err = cache.Query(readtest.Request(readtest.Query("up", 3*readtest.Minute+readtest.Minute/2, 100*readtest.Minute+readtest.Minute/2)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, resp)
+	assert.Equal(t, [][2]int64{{90 * readtest.Minute, 100*readtest.Minute + readtest.Minute/2}}, s.Queries)
+
+	// The same matchers in another order hit the same buckets.
+	s.Queries = nil
+	req := readtest.Request(readtest.Query("up", 10*readtest.Minute, 30*readtest.Minute-1))
+	req.Queries[0].Matchers = append([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "web"}}, req.Queries[0].Matchers...)
+	_, err = cache.Query(req)
+	assert.NoError(t, err)
+	req.Queries[0].Matchers[0], req.Queries[0].Matchers[1] = req.Queries[0].Matchers[1], req.Queries[0].Matchers[0]
+	_, err = cache.Query(req)
+	assert.NoError(t, err)
+	assert.Len(t, s.Queries, 1)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	s := newStore()
+	cache := New(s, Config{BucketSize: 10 * time.Minute, MaxFreshness: 5 * time.Minute, TTL: time.Minute, MaxBytes: 1 << 20})
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.Query(readtest.Request(readtest.Query("up", 0, 20*readtest.Minute-1)))
+	assert.NoError(t, err)
+	_, err = cache.Query(readtest.Request(readtest.Query("up", 0, 20*readtest.Minute-1)))
+	assert.NoError(t, err)
+	assert.Len(t, s.Queries, 1)
+
+	now = now.Add(2 * time.Minute)
+	_, err = cache.Query(readtest.Request(readtest.Query("up", 0, 20*readtest.Minute-1)))
+	assert.NoError(t, err)
+	assert.Len(t, s.Queries, 2)
+}
+
+func TestCacheMemoryLimit(t *testing.T) {
+	s := newStore()
+	cache := New(s, Config{BucketSize: 10 * time.Minute, MaxFreshness: 5 * time.Minute, TTL: time.Hour, MaxBytes: 1000})
+	now := time.Unix(0, 0).Add(100 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.Query(readtest.Request(readtest.Query("up", 0, 90*readtest.Minute-1)))
+	assert.NoError(t, err)
+	assert.True(t, cache.entries.bytes <= 1000)
+	assert.True(t, len(cache.entries.entries) < 9, "some buckets are evicted")
+
+	// The most recently cached buckets are kept.
+	s.Queries = nil
+	_, err = cache.Query(readtest.Request(readtest.Query("up", 80*readtest.Minute, 90*readtest.Minute-1)))
+	assert.NoError(t, err)
+	assert.Empty(t, s.Queries)
+}
@@ -0,0 +1,152 @@
+// Package readlimit bounds what a single remote read request may return, so
+// that a query matching too much fails on its own instead of exhausting the
+// adapter and Redis.
+package readlimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The limits a request may exceed.
+const (
+	LimitSeries  = "series"
+	LimitSamples = "samples"
+	LimitBytes   = "bytes"
+)
+
+var exceededLimits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redis_ts_adapter_read_limit_exceeded_total",
+	Help: "Remote read requests aborted for exceeding a limit, by limit.",
+}, []string{"limit"})
+
+// Limits holds the read limits. Zero limits are not enforced.
+type Limits struct {
+	MaxSeries  int
+	MaxSamples int
+	MaxBytes   int
+}
+
+// ParseOverrides parses per tenant limits, given as
+// "tenant=series:samples:bytes,tenant=series:samples:bytes".
+func ParseOverrides(s string) (map[string]Limits, error) {
+	overrides := make(map[string]Limits)
+	if s == "" {
+		return overrides, nil
+	}
+	for _, override := range strings.Split(s, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid read limits override %q, must be tenant=series:samples:bytes", override)
+		}
+		values := strings.Split(parts[1], ":")
+		if len(values) != 3 {
+			return nil, fmt.Errorf("invalid read limits override %q, must be tenant=series:samples:bytes", override)
+		}
+		limits := make([]int, len(values))
+		for i, value := range values {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("invalid read limit in %q", override)
+			}
+			limits[i] = limit
+		}
+		overrides[parts[0]] = Limits{MaxSeries: limits[0], MaxSamples: limits[1], MaxBytes: limits[2]}
+	}
+	return overrides, nil
+}
+
+// Ceiling returns the largest of each limit, no limit being the largest.
+func Ceiling(limits ...Limits) Limits {
+	var ceiling Limits
+	for i, l := range limits {
+		if i == 0 {
+			ceiling = l
+			continue
+		}
+		ceiling.MaxSeries = larger(ceiling.MaxSeries, l.MaxSeries)
+		ceiling.MaxSamples = larger(ceiling.MaxSamples, l.MaxSamples)
+		ceiling.MaxBytes = larger(ceiling.MaxBytes, l.MaxBytes)
+	}
+	return ceiling
+}
+
+func larger(a, b int) int {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// LimitError reports a request that exceeded one of its limits.
+type LimitError struct {
+	Limit string
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("remote read exceeded the %s limit of %d, narrow the matchers or the time range", e.Limit, e.Max)
+}
+
+// Tracker counts what a request read so far, against its limits. It is safe
+// for concurrent use by the queries of the request.
+type Tracker struct {
+	limits Limits
+
+	mu      sync.Mutex
+	series  int
+	samples int
+	bytes   int
+}
+
+// NewTracker creates a Tracker for one request.
+func NewTracker(limits Limits) *Tracker {
+	return &Tracker{limits: limits}
+}
+
+// AddSeries counts a series read, with its samples and histograms, and
+// returns a LimitError once the request read too many of them.
+func (t *Tracker) AddSeries(samples int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.series++
+	if err := t.check(LimitSeries, t.series, t.limits.MaxSeries); err != nil {
+		return err
+	}
+	t.samples += samples
+	return t.check(LimitSamples, t.samples, t.limits.MaxSamples)
+}
+
+// AddSamples counts more samples and histograms of a series already counted,
+// read page by page, and returns a LimitError once the request read too many.
+func (t *Tracker) AddSamples(n int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples += n
+	return t.check(LimitSamples, t.samples, t.limits.MaxSamples)
+}
+
+// AddBytes counts bytes of the response, and returns a LimitError once it
+// grew too large.
+func (t *Tracker) AddBytes(n int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += n
+	return t.check(LimitBytes, t.bytes, t.limits.MaxBytes)
+}
+
+func (t *Tracker) check(limit string, value, max int) error {
+	if max <= 0 || value <= max {
+		return nil
+	}
+	exceededLimits.WithLabelValues(limit).Inc()
+	return &LimitError{Limit: limit, Max: max}
+}
@@ -0,0 +1,59 @@
+package readlimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(Limits{MaxSeries: 2, MaxSamples: 10, MaxBytes: 100})
+	assert.NoError(t, tracker.AddSeries(4))
+	assert.NoError(t, tracker.AddSeries(6))
+	assert.Equal(t, &LimitError{Limit: LimitSeries, Max: 2}, tracker.AddSeries(0))
+
+	tracker = NewTracker(Limits{MaxSeries: 2, MaxSamples: 10, MaxBytes: 100})
+	assert.NoError(t, tracker.AddSeries(10))
+	err := tracker.AddSeries(1)
+	assert.Equal(t, &LimitError{Limit: LimitSamples, Max: 10}, err)
+	assert.Contains(t, err.Error(), "samples limit of 10")
+
+	tracker = NewTracker(Limits{MaxSamples: 10})
+	assert.NoError(t, tracker.AddSeries(4))
+	assert.NoError(t, tracker.AddSamples(6))
+	assert.Equal(t, &LimitError{Limit: LimitSamples, Max: 10}, tracker.AddSamples(1))
+
+	tracker = NewTracker(Limits{MaxBytes: 100})
+	assert.NoError(t, tracker.AddBytes(100))
+	assert.Equal(t, &LimitError{Limit: LimitBytes, Max: 100}, tracker.AddBytes(1))
+}
+
+func TestTrackerWithoutLimits(t *testing.T) {
+	tracker := NewTracker(Limits{})
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, tracker.AddSeries(1000))
+		assert.NoError(t, tracker.AddBytes(1<<20))
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := ParseOverrides("team-a=100:10000:0,team-b=0:0:1048576")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Limits{
+		"team-a": {MaxSeries: 100, MaxSamples: 10000},
+		"team-b": {MaxBytes: 1048576},
+	}, overrides)
+
+	for _, s := range []string{"team-a", "=1:2:3", "team-a=1:2", "team-a=1:x:3", "team-a=1:-2:3"} {
+		_, err := ParseOverrides(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCeiling(t *testing.T) {
+	assert.Equal(t, Limits{MaxSeries: 200, MaxBytes: 100}, Ceiling(
+		Limits{MaxSeries: 100, MaxSamples: 10, MaxBytes: 100},
+		Limits{MaxSeries: 200, MaxBytes: 50},
+	))
+	assert.Equal(t, Limits{MaxSeries: 100}, Ceiling(Limits{MaxSeries: 100}))
+}
@@ -0,0 +1,103 @@
+// Package readtest holds the fake store the tests of the readers in front of
+// it share.
+package readtest
+
+import (
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Minute is a minute in ms.
+const Minute = int64(time.Minute / time.Millisecond)
+
+// Store answers queries from series held in memory, and records their
+// ranges.
+type Store struct {
+	Series  []*remotepb.TimeSeries
+	Queries [][2]int64
+}
+
+// Query returns, for each query, the series matching its equality and
+// inequality matchers, with their samples and histograms in its range.
+// Series without any are returned too, as Redis does.
+func (s *Store) Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error) {
+	resp := &remotepb.ReadResponse{}
+	for _, q := range req.Queries {
+		s.Queries = append(s.Queries, [2]int64{q.StartTimestampMs, q.EndTimestampMs})
+		var series []*remotepb.TimeSeries
+		for _, ts := range s.Series {
+			if matches(ts.Labels, q.Matchers) {
+				series = append(series, between(ts, q.StartTimestampMs, q.EndTimestampMs))
+			}
+		}
+		resp.Results = append(resp.Results, &remotepb.QueryResult{Timeseries: series})
+	}
+	return resp, nil
+}
+
+func (s *Store) Name() string {
+	return "store"
+}
+
+func matches(labels []*prompb.Label, matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range labels {
+			if l.Name == m.Name {
+				value = l.Value
+			}
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if value != m.Value {
+				return false
+			}
+		case prompb.LabelMatcher_NEQ:
+			if value == m.Value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func between(ts *remotepb.TimeSeries, start, end int64) *remotepb.TimeSeries {
+	selected := &remotepb.TimeSeries{Labels: ts.Labels}
+	for _, s := range ts.Samples {
+		if s.Timestamp >= start && s.Timestamp <= end {
+			selected.Samples = append(selected.Samples, s)
+		}
+	}
+	for _, h := range ts.Histograms {
+		if h.Timestamp >= start && h.Timestamp <= end {
+			selected.Histograms = append(selected.Histograms, h)
+		}
+	}
+	return selected
+}
+
+// Series returns the series name{job=job}, with a sample a minute from from
+// until to, each valued its timestamp.
+func Series(name, job string, from, to int64) *remotepb.TimeSeries {
+	ts := &remotepb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: name}, {Name: "job", Value: job}}}
+	for t := from; t < to; t += Minute {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(t), Timestamp: t})
+	}
+	return ts
+}
+
+// Query returns a query of the series named name between start and end.
+func Query(name string, start, end int64) *prompb.Query {
+	return &prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   end,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name}},
+	}
+}
+
+// Request returns a read request of queries.
+func Request(queries ...*prompb.Query) *prompb.ReadRequest {
+	return &prompb.ReadRequest{Queries: queries}
+}
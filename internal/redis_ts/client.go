@@ -2,21 +2,101 @@ package redis_ts
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
 	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/prompb"
 	log "github.com/sirupsen/logrus"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Client redis.Client
+// DefaultReadConcurrency is how many queries of a read request are read at
+// once by default.
+const DefaultReadConcurrency = 4
+
+// Client stores and queries Prometheus series in RedisTimeSeries.
+type Client struct {
+	*redis.Client
+
+	// MaxExemplarsPerSeries bounds the exemplars kept for each series. Zero
+	// disables exemplar storage.
+	MaxExemplarsPerSeries int
+
+	// SeriesRetention, when set, gives the retention new series of a metric
+	// are created with. Zero keeps the database default. Existing series
+	// keep their retention.
+	SeriesRetention func(metric string) time.Duration
+
+	// WaitReplicas, when positive, makes writes wait for that many replicas
+	// to acknowledge them, for at most WaitTimeout, and fail with a
+	// ReplicationError otherwise.
+	WaitReplicas int
+	WaitTimeout  time.Duration
+
+	// PartitionPeriod, when positive, splits each series into a key per
+	// period, so that DropPartitions can remove whole periods at once.
+	PartitionPeriod time.Duration
+
+	// ReadWindow, when positive, splits the time range of each query into
+	// windows of this length, read one after the other. ReadPageSize, when
+	// positive, bounds the samples read per series in one command. Longer
+	// series are read page by page. ReadBatchSize, when positive, bounds the
+	// series read at once. When any of them is set, the keys of the series
+	// are listed first, and read in batches of ReadBatchSize, or
+	// DefaultReadBatchSize.
+	ReadWindow    time.Duration
+	ReadPageSize  int
+	ReadBatchSize int
+
+	// ReadConcurrency bounds the queries of a read request read at once.
+	// Zero means DefaultReadConcurrency.
+	ReadConcurrency int
+
+	// ReadLimits bounds the series and samples a read request reads from
+	// Redis. They are checked as each reply or page is parsed, so that a
+	// request going over them stops reading with a readlimit.LimitError.
+	ReadLimits readlimit.Limits
+
+	retentions retentionCache
+	thinner    *thinner
+	head       *head
+	replicas   *replicas
+}
+
 type StatusCmd redis.StatusCmd
 
 const nameLabel = "__name__"
 
+var failedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redis_ts_adapter_failed_samples_total",
+	Help: "Samples RedisTimeSeries refused to add, by reason.",
+}, []string{"reason"})
+
+// sampleFailureReason classifies the TS.ADD errors late samples run into.
+func sampleFailureReason(err error) string {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "older than retention"):
+		return "older_than_retention"
+	case strings.Contains(msg, "duplicate_policy"):
+		return "duplicate"
+	case strings.Contains(msg, "maximum existing timestamp"), strings.Contains(msg, "older than the latest"):
+		return "out_of_order"
+	default:
+		return "other"
+	}
+}
+
 // NewClient creates a new Client.
 func NewClient(address string, auth string) *Client {
 	client := redis.NewClient(&redis.Options{
@@ -24,19 +104,24 @@ func NewClient(address string, auth string) *Client {
 		Password: auth,
 		DB:       0, // use default DB
 	})
-	return (*Client)(client)
+	return &Client{Client: client}
 }
 
 func NewFailoverClient(failoverOpt *redis.FailoverOptions) *Client {
 	client := redis.NewFailoverClient(failoverOpt)
-	return (*Client)(client)
+	return &Client{Client: client}
 }
 
-func add(key *string, labels []*prompb.Label, metric *string, timestamp *int64, value *float64) redis.Cmder {
+func (c *Client) add(key *string, labels []*prompb.Label, metric *string, timestamp *int64, value *float64) redis.Cmder {
 	args := make([]interface{}, 0, len(labels)+3)
 	args = append(args, "TS.ADD", *key)
 	args = append(args, strconv.FormatInt(*timestamp, 10))
 	args = append(args, strconv.FormatFloat(*value, 'f', 6, 64))
+	if c.SeriesRetention != nil {
+		if retention := c.SeriesRetention(*metric); retention > 0 {
+			args = append(args, "RETENTION", int64(retention/time.Millisecond))
+		}
+	}
 	args = append(args, "LABELS")
 	hasNameLabel := false
 	for i := range labels {
@@ -52,9 +137,23 @@ func add(key *string, labels []*prompb.Label, metric *string, timestamp *int64,
 	return cmd
 }
 
+// WriteStats counts what a write actually stored in RedisTS.
+type WriteStats struct {
+	Samples    int
+	Histograms int
+	Exemplars  int
+}
+
 // Write sends a batch of samples to RedisTS via its HTTP API.
-func (c *Client) Write(timeseries []*prompb.TimeSeries) (returnErr error) {
-	pipe := (*redis.Client)(c).Pipeline()
+func (c *Client) Write(timeseries []*prompb.TimeSeries) error {
+	_, err := c.Ingest(&remotepb.WriteRequest{Timeseries: remotepb.FromPrompb(timeseries)})
+	return err
+}
+
+// Ingest stores a decoded remote-write request and reports how much of it
+// was written.
+func (c *Client) Ingest(req *remotepb.WriteRequest) (stats WriteStats, returnErr error) {
+	pipe := c.Pipeline()
 	defer func() {
 		err := pipe.Close()
 		if err != nil {
@@ -62,31 +161,115 @@ func (c *Client) Write(timeseries []*prompb.TimeSeries) (returnErr error) {
 		}
 	}()
 
+	var sampleCmds []redis.Cmder
+	var exemplars exemplarWrites
+	var histograms []histogramAdd
+	var heads *headWrites
+	if c.head != nil {
+		heads = &headWrites{}
+	}
+	lookups := make(retentionLookups)
+	index := make(partitionIndex)
+	timeseries := req.Timeseries
 	for i := range timeseries {
 		samples := timeseries[i].Samples
 		labels, metric := metricToLabels(timeseries[i].Labels)
-		key := metricToKeyName(metric, labels)
-		if *metric == "" {
+		if metric == nil || *metric == "" {
 			log.WithFields(log.Fields{"Metric": timeseries[i].Labels}).Info("Cannot send unnamed sample to RedisTS, skipping")
 			continue
 		}
-		for j := range samples {
-			sample := &samples[j]
-			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
-				log.WithFields(log.Fields{"sample": sample, "value": sample.Value}).Debug("Cannot send to RedisTS, skipping")
-				continue
-			}
-
-			cmd := add(&key, timeseries[i].Labels, metric, &sample.Timestamp, &sample.Value)
-			err := pipe.Process(cmd)
+		key := metricToKeyName(metric, labels)
+		if c.thinner != nil {
+			samples = c.thinner.thin(key, timeseries[i].Labels, *metric, samples)
+		}
+		for _, part := range c.partition(key, timeseries[i], samples) {
+			cmds, err := c.ingestPart(pipe, &exemplars, &histograms, heads, lookups, metric, part)
+			sampleCmds = append(sampleCmds, cmds...)
 			if err != nil {
-				return err
+				return stats, err
 			}
+			index.add(pipe, part)
 		}
 	}
 
-	_, err := pipe.Exec()
-	return err
+	if err := addMetadata(pipe, req.Metadata); err != nil {
+		return stats, err
+	}
+
+	wait, err := c.queueWait(pipe)
+	if err != nil {
+		return stats, err
+	}
+
+	// A failed pipeline still runs every command, so count what succeeded to
+	// let callers report partial writes.
+	_, err = pipe.Exec()
+	for _, cmd := range sampleCmds {
+		if err := cmd.Err(); err == nil {
+			stats.Samples++
+		} else {
+			failedSamples.WithLabelValues(sampleFailureReason(err)).Inc()
+		}
+	}
+	stats.Histograms = histogramsWritten(histograms)
+	stats.Exemplars = exemplarsWritten(&exemplars)
+	c.applyRetentions(lookups)
+	if heads != nil {
+		c.head.record(heads)
+	}
+	// Unacknowledged writes are reported first: they are worth retrying,
+	// even when some commands failed for good.
+	if waitErr := c.checkWait(wait); waitErr != nil {
+		return stats, waitErr
+	}
+	return stats, err
+}
+
+// ingestPart queues the writes of part, and returns the sample writes.
+func (c *Client) ingestPart(pipe redis.Pipeliner, exemplars *exemplarWrites, histograms *[]histogramAdd, heads *headWrites, lookups retentionLookups, metric *string, part *seriesPart) ([]redis.Cmder, error) {
+	var sampleCmds []redis.Cmder
+	for j := range part.samples {
+		sample := &part.samples[j]
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			log.WithFields(log.Fields{"sample": sample, "value": sample.Value}).Debug("Cannot send to RedisTS, skipping")
+			continue
+		}
+
+		cmd := c.add(&part.key, part.labels, metric, &sample.Timestamp, &sample.Value)
+		err := pipe.Process(cmd)
+		if err != nil {
+			return sampleCmds, err
+		}
+		sampleCmds = append(sampleCmds, cmd)
+		if heads != nil {
+			heads.samples = append(heads.samples, headSample{labels: part.labels, sample: *sample, cmd: cmd})
+		}
+	}
+
+	if len(part.histograms) > 0 {
+		added := len(*histograms)
+		err := c.addHistograms(pipe, histograms, lookups, part.key, part.labels, metric, part.histograms)
+		if err != nil {
+			return sampleCmds, err
+		}
+		if heads != nil && len(*histograms) > added {
+			heads.histograms = append(heads.histograms, headHistograms{labels: part.labels, histograms: part.histograms, cmd: (*histograms)[added].cmd})
+		}
+	}
+
+	if len(part.exemplars) > 0 && c.MaxExemplarsPerSeries > 0 {
+		// A histogram series has no series at its key: its exemplars follow
+		// the retention of its count.
+		retentionKey := part.key
+		if len(part.samples) == 0 && len(part.histograms) > 0 {
+			retentionKey += histogramCountSuffix
+		}
+		err := c.addExemplars(pipe, exemplars, lookups, part.key, retentionKey, part.exemplars)
+		if err != nil {
+			return sampleCmds, err
+		}
+	}
+	return sampleCmds, nil
 }
 
 // Returns labels in string format (key=value), but as slice of interfaces.
@@ -120,79 +303,300 @@ func metricToKeyName(metric *string, labels *[]string) (keyName string) {
 	return buf.String()
 }
 
-func (c *Client) Read(req *prompb.ReadRequest) (returnVal *prompb.ReadResponse, returnErr error) {
-	var timeSeries []*prompb.TimeSeries
-	results := make([]*prompb.QueryResult, 0, len(req.Queries))
-	pipe := (*redis.Client)(c).Pipeline()
-	defer func() {
-		err := pipe.Close()
-		if err != nil {
-			returnErr = err
+// Read returns the float samples matching the queries.
+func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	resp, err := c.Query(req)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*prompb.QueryResult, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		timeSeries := make([]*prompb.TimeSeries, 0, len(result.Timeseries))
+		for _, ts := range result.Timeseries {
+			if len(ts.Histograms) == 0 {
+				timeSeries = append(timeSeries, ts.Prompb())
+			}
 		}
-	}()
+		results = append(results, &prompb.QueryResult{Timeseries: timeSeries})
+	}
+	return &prompb.ReadResponse{Results: results}, nil
+}
 
-	commands := make([]*redis.SliceCmd, 0, len(req.Queries))
-	for _, q := range req.Queries {
-		labelMatchers, err := labelMatchers(q)
+// Query returns the float samples and native histograms matching the
+// queries. Each query is read on its own, at most ReadConcurrency at once,
+// and gets its own result. The first query to fail, in request order, fails
+// the request.
+func (c *Client) Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error) {
+	return c.QueryTracked(req, readlimit.NewTracker(c.ReadLimits))
+}
+
+// QueryTracked is Query, counting what it reads against tracker instead of
+// ReadLimits, as for the limits of the tenant of the request.
+func (c *Client) QueryTracked(req *prompb.ReadRequest, tracker *readlimit.Tracker) (*remotepb.ReadResponse, error) {
+	concurrency := c.ReadConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultReadConcurrency
+	}
+	results := make([]*remotepb.QueryResult, len(req.Queries))
+	errs := make([]error, len(req.Queries))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, q := range req.Queries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, q *prompb.Query) {
+			defer wg.Done()
+			results[i], errs[i] = c.query(q, tracker)
+			<-slots
+		}(i, q)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("query %d: %w", i, err)
 		}
-		cmd := c.rangeByLabels(labelMatchers, q.StartTimestampMs, q.EndTimestampMs)
-		err = pipe.Process(cmd)
-		if err != nil {
+	}
+	return &remotepb.ReadResponse{Results: results}, nil
+}
+
+// query reads the series matching q: from the head what it holds, and the
+// rest from Redis, counting both against tracker.
+func (c *Client) query(q *prompb.Query, tracker *readlimit.Tracker) (*remotepb.QueryResult, error) {
+	labelMatchers, err := labelMatchers(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	headSeries, older := c.splitHead(q)
+	if older == nil {
+		if err := newReadCount(tracker).addSeries(headSeries); err != nil {
 			return nil, err
 		}
-		commands = append(commands, cmd)
+		return &remotepb.QueryResult{Timeseries: promseries.Merge(headSeries)}, nil
+	}
+	var timeSeries []*remotepb.TimeSeries
+	err = c.readRedis(func(server *redis.Client, count *readCount) error {
+		if err := count.addSeries(headSeries); err != nil {
+			return err
+		}
+		timeSeries, err = c.queryServer(server, older, labelMatchers, count)
+		return err
+	}, tracker, nil)
+	if err != nil {
+		return nil, err
 	}
+	return &remotepb.QueryResult{Timeseries: promseries.Merge(append(timeSeries, headSeries...))}, nil
+}
+
+// splitHead reads what the head holds of q, and returns it with the query of
+// the rest, to read from Redis, or nil when the head holds it all.
+func (c *Client) splitHead(q *prompb.Query) ([]*remotepb.TimeSeries, *prompb.Query) {
+	if c.head == nil {
+		return nil, q
+	}
+	headSeries, lower := c.head.read(q.Matchers, q.StartTimestampMs, q.EndTimestampMs)
+	if q.StartTimestampMs >= lower {
+		headReads.WithLabelValues("memory").Inc()
+		return headSeries, nil
+	}
+	older := *q
+	if older.EndTimestampMs >= lower {
+		headReads.WithLabelValues("both").Inc()
+		older.EndTimestampMs = lower - 1
+	} else {
+		headReads.WithLabelValues("redis").Inc()
+	}
+	return headSeries, &older
+}
 
-	_, err := pipe.Exec()
+// readRedis runs read on a replica if one can serve it, or on the master,
+// with a count of what it reads against tracker. A read that failed on a
+// replica runs again on the master, unless it went over the read limits or
+// retry, when set, tells it cannot.
+func (c *Client) readRedis(read func(server *redis.Client, count *readCount) error, tracker *readlimit.Tracker, retry func() bool) error {
+	if c.replicas != nil {
+		if replica := c.replicas.pick(); replica != nil {
+			err := read(replica, newReadCount(tracker))
+			var limitErr *readlimit.LimitError
+			if err == nil || errors.As(err, &limitErr) || (retry != nil && !retry()) {
+				replicaReads.WithLabelValues("replica").Inc()
+				return err
+			}
+			log.WithFields(log.Fields{"replica": replica.Options().Addr, "err": err}).Warn("Could not read from replica, reading from the master")
+		}
+		replicaReads.WithLabelValues("master").Inc()
+	}
+	return read(c.Client, newReadCount(tracker))
+}
+
+// readCount counts the series and samples a query reads against the limits
+// of its request, each series once whatever the partitions and pages it is
+// read in.
+type readCount struct {
+	tracker *readlimit.Tracker
+	seen    map[string]bool
+}
+
+func newReadCount(tracker *readlimit.Tracker) *readCount {
+	return &readCount{tracker: tracker, seen: make(map[string]bool)}
+}
+
+// add counts samples, samples or histograms, read of the series labelled
+// labels.
+func (r *readCount) add(labels []*prompb.Label, samples int) error {
+	labels, _ = withoutPartition(labels)
+	key := promseries.LabelsKey(labels)
+	if r.seen[key] {
+		return r.tracker.AddSamples(samples)
+	}
+	r.seen[key] = true
+	return r.tracker.AddSeries(samples)
+}
+
+// addSeries counts the series read whole, as those of the head.
+func (r *readCount) addSeries(series []*remotepb.TimeSeries) error {
+	for _, ts := range series {
+		if err := r.add(ts.Labels, len(ts.Samples)+len(ts.Histograms)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryServer reads the series matching q from server, in a pipeline of its
+// own, counting them with count as they are parsed.
+func (c *Client) queryServer(server *redis.Client, q *prompb.Query, labelMatchers []interface{}, count *readCount) ([]*remotepb.TimeSeries, error) {
+	pipe := server.Pipeline()
+	defer pipe.Close()
+
+	floatMatchers := append(labelMatchers[:len(labelMatchers):len(labelMatchers)], histogramLabel+"=")
+	// Paginated queries are read on their own below.
+	var cmd *redis.SliceCmd
+	if !c.paginated() {
+		cmd = c.rangeByLabels(floatMatchers, q.StartTimestampMs, q.EndTimestampMs, 0)
+		if err := pipe.Process(cmd); err != nil {
+			return nil, err
+		}
+	}
+	histogramCmd, err := findHistograms(pipe, labelMatchers)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
 
-	for i := range commands {
-		err := commands[i].Err()
+	// Fetch the histograms of the histogram series found above.
+	histogramSeries := rangeHistograms(pipe, histogramCmd, q.StartTimestampMs, q.EndTimestampMs)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	var timeSeries []*remotepb.TimeSeries
+	if cmd == nil {
+		err = c.rangePaginated(server, floatMatchers, q.StartTimestampMs, q.EndTimestampMs, count, func(batch []*remotepb.TimeSeries) error {
+			timeSeries = append(timeSeries, batch...)
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		timeSeries, err = parseRange(cmd, count)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		for _, ts := range commands[i].Val() {
-			tsSlice := ts.([]interface{})
-			labels := tsSlice[1].([]interface{})
-			tsLabels := make([]*prompb.Label, 0, len(labels))
-			for _, label := range labels {
-				parsedLabel := label.([]interface{})
-				tsLabels = append(tsLabels, &prompb.Label{Name: parsedLabel[0].(string), Value: parsedLabel[1].(string)})
-			}
-
-			samples := tsSlice[2].([]interface{})
-			tsSamples := make([]prompb.Sample, 0, len(samples))
-			for i := range samples {
-				parsedSample := samples[i].([]interface{})
-				value, err := strconv.ParseFloat(parsedSample[1].(string), 64)
-				if err != nil {
-					return nil, err
-				}
-				tsSamples = append(tsSamples, prompb.Sample{Timestamp: parsedSample[0].(int64), Value: value})
-			}
-			thisSeries := &prompb.TimeSeries{
-				Labels:  tsLabels,
-				Samples: tsSamples,
+	for j := range histogramSeries {
+		thisSeries, err := histogramSeries[j].toTimeSeries()
+		if err != nil {
+			return nil, err
+		}
+		if thisSeries != nil {
+			if err := count.add(thisSeries.Labels, len(thisSeries.Histograms)); err != nil {
+				return nil, err
 			}
 			timeSeries = append(timeSeries, thisSeries)
 		}
-		results = append(results, &prompb.QueryResult{Timeseries: timeSeries})
 	}
+	return stitchPartitions(timeSeries), nil
+}
+
+// parseRange parses the series of a TS.MRANGE reply, counting them with
+// count.
+func parseRange(cmd *redis.SliceCmd, count *readCount) ([]*remotepb.TimeSeries, error) {
+	var timeSeries []*remotepb.TimeSeries
+	for _, ts := range cmd.Val() {
+		_, thisSeries, err := parseRangeSeries(ts)
+		if err != nil {
+			return nil, err
+		}
+		if err := count.add(thisSeries.Labels, len(thisSeries.Samples)); err != nil {
+			return nil, err
+		}
+		timeSeries = append(timeSeries, thisSeries)
+	}
+	return timeSeries, nil
+}
 
-	resp := prompb.ReadResponse{Results: results}
-	return &resp, nil
+// parseRangeSeries parses a series of a TS.MRANGE reply, and returns its
+// key.
+func parseRangeSeries(reply interface{}) (string, *remotepb.TimeSeries, error) {
+	tsSlice := reply.([]interface{})
+	samples, err := parseSamples(tsSlice[2].([]interface{}))
+	if err != nil {
+		return "", nil, err
+	}
+	return tsSlice[0].(string), &remotepb.TimeSeries{
+		Labels:  parseLabels(tsSlice[1].([]interface{})),
+		Samples: samples,
+	}, nil
 }
 
-func (c *Client) rangeByLabels(labelMatchers []interface{}, start int64, end int64) *redis.SliceCmd {
-	args := make([]interface{}, 0, len(labelMatchers)+3)
+func parseSamples(samples []interface{}) ([]prompb.Sample, error) {
+	tsSamples := make([]prompb.Sample, 0, len(samples))
+	for i := range samples {
+		parsedSample := samples[i].([]interface{})
+		value, err := strconv.ParseFloat(parsedSample[1].(string), 64)
+		if err != nil {
+			return nil, err
+		}
+		tsSamples = append(tsSamples, prompb.Sample{Timestamp: parsedSample[0].(int64), Value: value})
+	}
+	return tsSamples, nil
+}
+
+// parseLabels converts the label list of a WITHLABELS reply.
+func parseLabels(labels []interface{}) []*prompb.Label {
+	tsLabels := make([]*prompb.Label, 0, len(labels))
+	for _, label := range labels {
+		parsedLabel := label.([]interface{})
+		tsLabels = append(tsLabels, &prompb.Label{Name: parsedLabel[0].(string), Value: parsedLabel[1].(string)})
+	}
+	return tsLabels
+}
+
+// sortedLabels converts a label map to labels sorted by name.
+func sortedLabels(labels map[string]string) []*prompb.Label {
+	result := make([]*prompb.Label, 0, len(labels))
+	for name, value := range labels {
+		result = append(result, &prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// rangeByLabels reads the series matching labelMatchers. A positive count
+// bounds the samples read per series.
+func (c *Client) rangeByLabels(labelMatchers []interface{}, start int64, end int64, count int) *redis.SliceCmd {
+	args := make([]interface{}, 0, len(labelMatchers)+7)
 	args = append(args, "TS.MRANGE")
 	args = append(args, start)
 	args = append(args, end)
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
 	args = append(args, "WITHLABELS")
 	args = append(args, "FILTER")
 	args = append(args, labelMatchers...)
@@ -201,9 +605,9 @@ func (c *Client) rangeByLabels(labelMatchers []interface{}, start int64, end int
 	return cmd
 }
 
-func labelMatchers(q *prompb.Query) (labels []interface{}, err error) {
-	labels = make([]interface{}, 0, len(q.Matchers))
-	for _, m := range q.Matchers {
+func labelMatchers(matchers []*prompb.LabelMatcher) (labels []interface{}, err error) {
+	labels = make([]interface{}, 0, len(matchers))
+	for _, m := range matchers {
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
 			labels = append(labels, fmt.Sprintf("%s=%s", m.Name, m.Value))
@@ -221,6 +625,6 @@ func labelMatchers(q *prompb.Query) (labels []interface{}, err error) {
 }
 
 // Name identifies the client as an RedisTS client.
-func (c Client) Name() string {
+func (c *Client) Name() string {
 	return "RedisTS"
 }
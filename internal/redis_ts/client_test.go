@@ -29,6 +29,10 @@ func TestWriteSingleSample(t *testing.T) {
 	insertedSamples := []*prompb.TimeSeries{
 		{
 			Labels: []*prompb.Label{
+				{
+					Name:  "__name__",
+					Value: "test_series",
+				},
 				{
 					Name:  "label_1",
 					Value: "value_1",
@@ -37,10 +41,6 @@ func TestWriteSingleSample(t *testing.T) {
 					Name:  "label_2",
 					Value: "value_2",
 				},
-				{
-					Name:  "__name__",
-					Value: "test_series",
-				},
 			},
 			Samples: []prompb.Sample{
 				{
@@ -93,6 +93,52 @@ func TestWriteSingleSample(t *testing.T) {
 	assert.Equal(t, insertedSamples, result.Results[0].Timeseries)
 }
 
+// Prometheus sends a query per selector of subqueries and `or` expressions in
+// one request; each must only get its own series.
+func TestReadMultipleQueries(t *testing.T) {
+	redisClient.Del("test_multi_a{}", "test_multi_b{}")
+	client := NewClient(redisAddress, redisAuth)
+	client.ReadConcurrency = 2
+	series := []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_multi_a"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_multi_b"}}, Samples: []prompb.Sample{{Value: 2, Timestamp: 2000}}},
+	}
+	err := client.Write(series)
+	assert.Nil(t, err)
+
+	query := func(metric string, start int64) *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: start,
+			EndTimestampMs:   3000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: metric}},
+		}
+	}
+	result, err := client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{
+		query("test_multi_a", 0),
+		query("test_multi_b", 0),
+		query("test_multi_none", 0),
+		query("test_multi_a", 1500),
+		query("test_multi_b", 0),
+	}})
+	assert.Nil(t, err)
+	assert.Len(t, result.Results, 5)
+	assert.Equal(t, series[:1], result.Results[0].Timeseries)
+	assert.Equal(t, series[1:], result.Results[1].Timeseries)
+	assert.Empty(t, result.Results[2].Timeseries)
+	assert.Len(t, result.Results[3].Timeseries, 1)
+	assert.Equal(t, series[0].Labels, result.Results[3].Timeseries[0].Labels)
+	assert.Empty(t, result.Results[3].Timeseries[0].Samples)
+	assert.Equal(t, series[1:], result.Results[4].Timeseries)
+
+	// A failing query fails the request, and is named.
+	_, err = client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{
+		query("test_multi_a", 0),
+		{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "test_multi_.*"}}},
+	}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "query 1: regex-equal matcher")
+}
+
 func TestNewFailoverClient(t *testing.T) {
 	var redisFailoverClient = NewFailoverClient(&redis.FailoverOptions{
 		MasterName:    sentinelMasterName,
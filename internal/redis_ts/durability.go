@@ -0,0 +1,57 @@
+package redis_ts
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var unreplicatedWrites = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "redis_ts_adapter_unreplicated_writes_total",
+	Help: "Writes not acknowledged by enough replicas in time.",
+})
+
+// ReplicationError reports a write the primary applied, but not enough
+// replicas acknowledged. It may be lost on failover, so it is worth
+// retrying; RedisTimeSeries overwrites or rejects the samples written twice
+// according to the series' duplicate policy.
+type ReplicationError struct {
+	Acknowledged int64
+	Wanted       int
+	Err          error
+}
+
+func (e *ReplicationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("waiting for replicas: %v", e.Err)
+	}
+	return fmt.Sprintf("write acknowledged by %d replicas, %d wanted", e.Acknowledged, e.Wanted)
+}
+
+// queueWait ends pipe with a WAIT for the replicas the client wants to
+// acknowledge its writes. WAIT covers the writes of its connection, which a
+// pipeline uses for all its commands.
+func (c *Client) queueWait(pipe redis.Pipeliner) (*redis.IntCmd, error) {
+	if c.WaitReplicas <= 0 {
+		return nil, nil
+	}
+	cmd := redis.NewIntCmd("WAIT", c.WaitReplicas, int64(c.WaitTimeout/time.Millisecond))
+	return cmd, pipe.Process(cmd)
+}
+
+// checkWait returns a ReplicationError if the WAIT queued by queueWait was
+// not satisfied.
+func (c *Client) checkWait(cmd *redis.IntCmd) error {
+	if cmd == nil {
+		return nil
+	}
+	acknowledged, err := cmd.Result()
+	if err == nil && acknowledged >= int64(c.WaitReplicas) {
+		return nil
+	}
+	unreplicatedWrites.Inc()
+	return &ReplicationError{Acknowledged: acknowledged, Wanted: c.WaitReplicas, Err: err}
+}
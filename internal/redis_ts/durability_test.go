@@ -0,0 +1,31 @@
+package redis_ts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteWaitsForReplicas(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	// The test server has no replicas, so none can acknowledge the write.
+	client.WaitReplicas = 1
+	client.WaitTimeout = 10 * time.Millisecond
+
+	redisClient.Del("test_durable{}")
+	err := client.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "test_durable"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}},
+	}})
+
+	var replicationErr *ReplicationError
+	assert.True(t, errors.As(err, &replicationErr), "got %v", err)
+	if replicationErr != nil {
+		assert.Equal(t, int64(0), replicationErr.Acknowledged)
+		assert.Equal(t, 1, replicationErr.Wanted)
+	}
+	assert.Equal(t, int64(1), redisClient.Exists("test_durable{}").Val(), "the primary still applied the write")
+}
@@ -0,0 +1,202 @@
+package redis_ts
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Exemplars of a series are kept in a sorted set next to the series, scored
+// by timestamp. Each write trims the set to the newest MaxExemplarsPerSeries
+// entries and to the series' retention, see trimToRetention.
+const exemplarsKeySuffix = ":exemplars"
+
+func exemplarsKey(seriesKey string) string {
+	return seriesKey + exemplarsKeySuffix
+}
+
+// storedExemplar is the sorted set member format. The value is a string so
+// that NaN and infinities survive JSON.
+type storedExemplar struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+func encodeExemplar(e *remotepb.Exemplar) (string, error) {
+	stored := storedExemplar{
+		Labels:    make(map[string]string, len(e.Labels)),
+		Value:     strconv.FormatFloat(e.Value, 'g', -1, 64),
+		Timestamp: e.Timestamp,
+	}
+	for _, l := range e.Labels {
+		stored.Labels[l.Name] = l.Value
+	}
+	member, err := json.Marshal(&stored)
+	return string(member), err
+}
+
+func decodeExemplar(member string) (remotepb.Exemplar, error) {
+	var stored storedExemplar
+	if err := json.Unmarshal([]byte(member), &stored); err != nil {
+		return remotepb.Exemplar{}, err
+	}
+	value, err := strconv.ParseFloat(stored.Value, 64)
+	if err != nil {
+		return remotepb.Exemplar{}, err
+	}
+	return remotepb.Exemplar{
+		Labels:    sortedLabels(stored.Labels),
+		Value:     value,
+		Timestamp: stored.Timestamp,
+	}, nil
+}
+
+// exemplarWrites tracks the exemplar commands queued on a write pipeline.
+type exemplarWrites struct {
+	adds []exemplarAdd
+}
+
+type exemplarAdd struct {
+	cmd   *redis.IntCmd
+	count int
+}
+
+// addExemplars queues the writes of the exemplars of the series at key,
+// trimmed to the retention of the series at retentionKey.
+func (c *Client) addExemplars(pipe redis.Pipeliner, w *exemplarWrites, lookups retentionLookups, key string, retentionKey string, exemplars []remotepb.Exemplar) error {
+	setKey := exemplarsKey(key)
+	members := make([]redis.Z, 0, len(exemplars))
+	newest := int64(math.MinInt64)
+	for i := range exemplars {
+		member, err := encodeExemplar(&exemplars[i])
+		if err != nil {
+			return err
+		}
+		members = append(members, redis.Z{Score: float64(exemplars[i].Timestamp), Member: member})
+		if exemplars[i].Timestamp > newest {
+			newest = exemplars[i].Timestamp
+		}
+	}
+
+	w.adds = append(w.adds, exemplarAdd{cmd: pipe.ZAdd(setKey, members...), count: len(members)})
+	pipe.ZRemRangeByRank(setKey, 0, int64(-c.MaxExemplarsPerSeries-1))
+	return c.trimToRetention(pipe, lookups, retentionKey, setKey, newest)
+}
+
+// exemplarsWritten counts the exemplars stored by an executed pipeline.
+func exemplarsWritten(w *exemplarWrites) (written int) {
+	for _, add := range w.adds {
+		if add.cmd.Err() == nil {
+			written += add.count
+		}
+	}
+	return written
+}
+
+// exemplarSeries returns the key and labels of the series whose exemplars
+// are kept next to the series found at key: the histogram series of its
+// count, or that series itself. ok is false for the sums of histograms, as
+// their counts stand for them.
+func exemplarSeries(key string, labels []*prompb.Label) (string, []*prompb.Label, bool) {
+	for _, l := range labels {
+		if l.Name == histogramLabel {
+			if l.Value != "count" {
+				return "", nil, false
+			}
+			return strings.TrimSuffix(key, histogramCountSuffix), withoutHistogramLabel(labels), true
+		}
+	}
+	return key, labels, true
+}
+
+// SeriesExemplars are the exemplars stored for one series.
+type SeriesExemplars struct {
+	SeriesLabels []*prompb.Label
+	Exemplars    []remotepb.Exemplar
+}
+
+// QueryExemplars returns the exemplars between start and end, in
+// milliseconds, of the series matching any of the selectors.
+func (c *Client) QueryExemplars(selectors [][]*prompb.LabelMatcher, start int64, end int64) ([]SeriesExemplars, error) {
+	pipe := c.Pipeline()
+	defer pipe.Close()
+
+	seriesCmds := make([]*redis.SliceCmd, 0, len(selectors))
+	for _, matchers := range selectors {
+		filter, err := labelMatchers(matchers)
+		if err != nil {
+			return nil, err
+		}
+		args := append([]interface{}{"TS.MGET", "WITHLABELS", "FILTER"}, filter...)
+		cmd := redis.NewSliceCmd(args...)
+		if err := pipe.Process(cmd); err != nil {
+			return nil, err
+		}
+		seriesCmds = append(seriesCmds, cmd)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	// The keys of a partitioned series' periods all go to the same series.
+	var series []SeriesExemplars
+	var rangeCmds []*redis.StringSliceCmd
+	var rangeSeries []int
+	seen := make(map[string]bool)
+	byLabels := make(map[string]int)
+	for _, cmd := range seriesCmds {
+		for _, ts := range cmd.Val() {
+			tsSlice := ts.([]interface{})
+			key, labels, ok := exemplarSeries(tsSlice[0].(string), parseLabels(tsSlice[1].([]interface{})))
+			if !ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+			labels, _ = withoutPartition(labels)
+			i, ok := byLabels[promseries.LabelsKey(labels)]
+			if !ok {
+				i = len(series)
+				byLabels[promseries.LabelsKey(labels)] = i
+				series = append(series, SeriesExemplars{SeriesLabels: labels})
+			}
+			rangeSeries = append(rangeSeries, i)
+			rangeCmds = append(rangeCmds, pipe.ZRangeByScore(exemplarsKey(key), redis.ZRangeBy{
+				Min: formatScore(start),
+				Max: formatScore(end),
+			}))
+		}
+	}
+	if len(rangeCmds) == 0 {
+		return nil, nil
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, cmd := range rangeCmds {
+		s := &series[rangeSeries[i]]
+		for _, member := range cmd.Val() {
+			exemplar, err := decodeExemplar(member)
+			if err != nil {
+				return nil, err
+			}
+			s.Exemplars = append(s.Exemplars, exemplar)
+		}
+	}
+	result := make([]SeriesExemplars, 0, len(series))
+	for _, s := range series {
+		if len(s.Exemplars) > 0 {
+			sort.SliceStable(s.Exemplars, func(i, j int) bool { return s.Exemplars[i].Timestamp < s.Exemplars[j].Timestamp })
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
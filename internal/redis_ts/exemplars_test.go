@@ -0,0 +1,145 @@
+package redis_ts
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExemplarEncoding(t *testing.T) {
+	exemplar := remotepb.Exemplar{
+		Labels:    []*prompb.Label{{Name: "trace_id", Value: "abc"}, {Name: "span_id", Value: "def"}},
+		Value:     math.Inf(1),
+		Timestamp: 1234,
+	}
+	member, err := encodeExemplar(&exemplar)
+	assert.Nil(t, err)
+
+	decoded, err := decodeExemplar(member)
+	assert.Nil(t, err)
+	assert.Equal(t, []*prompb.Label{{Name: "span_id", Value: "def"}, {Name: "trace_id", Value: "abc"}}, decoded.Labels)
+	assert.True(t, math.IsInf(decoded.Value, 1))
+	assert.Equal(t, int64(1234), decoded.Timestamp)
+}
+
+func TestWriteAndQueryExemplars(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key := "test_exemplars{job=api}"
+	redisClient.Del(key, exemplarsKey(key))
+
+	client := NewClient(redisAddress, redisAuth)
+	client.MaxExemplarsPerSeries = 2
+	labels := []*prompb.Label{{Name: "__name__", Value: "test_exemplars"}, {Name: "job", Value: "api"}}
+	exemplars := make([]remotepb.Exemplar, 0, 3)
+	for i := int64(0); i < 3; i++ {
+		exemplars = append(exemplars, remotepb.Exemplar{
+			Labels:    []*prompb.Label{{Name: "trace_id", Value: string(rune('a' + i))}},
+			Value:     float64(i),
+			Timestamp: now + i,
+		})
+	}
+
+	stats, err := client.Ingest(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:    labels,
+		Samples:   []prompb.Sample{{Value: 1, Timestamp: now}},
+		Exemplars: exemplars,
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStats{Samples: 1, Exemplars: 3}, stats)
+
+	result, err := client.QueryExemplars([][]*prompb.LabelMatcher{
+		{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}, {Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_exemplars"}},
+	}, now, now+10)
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.ElementsMatch(t, labels, result[0].SeriesLabels)
+	assert.Equal(t, exemplars[1:], result[0].Exemplars)
+}
+
+func TestExemplarsExpireFromFirstWrite(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key := "test_exemplars_retention{job=api}"
+	redisClient.Del(key, exemplarsKey(key))
+
+	client := NewClient(redisAddress, redisAuth)
+	client.MaxExemplarsPerSeries = 2
+	client.SeriesRetention = func(string) time.Duration { return time.Hour }
+	_, err := client.Ingest(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "test_exemplars_retention"}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		Exemplars: []remotepb.Exemplar{
+			{Value: 1, Timestamp: now - 2*int64(time.Hour/time.Millisecond)},
+			{Value: 2, Timestamp: now},
+		},
+	}}})
+	assert.Nil(t, err)
+
+	// The series is written once: its exemplars are trimmed and expire
+	// all the same.
+	ttl, err := redisClient.PTTL(exemplarsKey(key)).Result()
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Hour)
+	assert.Equal(t, int64(1), redisClient.ZCard(exemplarsKey(key)).Val())
+}
+
+func TestExemplarSeries(t *testing.T) {
+	labels := func(histogram string) []*prompb.Label {
+		labels := []*prompb.Label{{Name: "__name__", Value: "rpc"}}
+		if histogram != "" {
+			labels = append(labels, &prompb.Label{Name: histogramLabel, Value: histogram})
+		}
+		return labels
+	}
+	key, seriesLabels, ok := exemplarSeries("rpc{}", labels(""))
+	assert.True(t, ok)
+	assert.Equal(t, "rpc{}", key)
+	assert.Equal(t, labels(""), seriesLabels)
+
+	key, seriesLabels, ok = exemplarSeries("rpc{}"+histogramCountSuffix, labels("count"))
+	assert.True(t, ok)
+	assert.Equal(t, "rpc{}", key)
+	assert.Equal(t, labels(""), seriesLabels)
+
+	_, _, ok = exemplarSeries("rpc{}"+histogramSumSuffix, labels("sum"))
+	assert.False(t, ok)
+}
+
+func TestHistogramExemplars(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key := "test_histogram_exemplars{job=api}"
+	redisClient.Del(key+histogramCountSuffix, key+histogramSumSuffix, key+histogramsKeySuffix, exemplarsKey(key))
+
+	client := NewClient(redisAddress, redisAuth)
+	client.MaxExemplarsPerSeries = 2
+	client.SeriesRetention = func(string) time.Duration { return time.Hour }
+	labels := []*prompb.Label{{Name: "__name__", Value: "test_histogram_exemplars"}, {Name: "job", Value: "api"}}
+	exemplars := []remotepb.Exemplar{
+		{Labels: []*prompb.Label{{Name: "trace_id", Value: "a"}}, Value: 1, Timestamp: now - 2*int64(time.Hour/time.Millisecond)},
+		{Labels: []*prompb.Label{{Name: "trace_id", Value: "b"}}, Value: 2, Timestamp: now},
+	}
+	stats, err := client.Ingest(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:     labels,
+		Histograms: []remotepb.Histogram{testHistogram(now)},
+		Exemplars:  exemplars,
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStats{Histograms: 1, Exemplars: 2}, stats)
+
+	// The exemplars follow the retention of the histogram count.
+	ttl, err := redisClient.PTTL(exemplarsKey(key)).Result()
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Hour)
+	assert.Equal(t, int64(1), redisClient.ZCard(exemplarsKey(key)).Val())
+
+	result, err := client.QueryExemplars([][]*prompb.LabelMatcher{
+		{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_histogram_exemplars"}},
+	}, now-10, now+10)
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.ElementsMatch(t, labels, result[0].SeriesLabels)
+	assert.Equal(t, exemplars[1:], result[0].Exemplars)
+}
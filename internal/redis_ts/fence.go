@@ -0,0 +1,78 @@
+package redis_ts
+
+import (
+	"errors"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/leader"
+	"github.com/go-redis/redis"
+)
+
+// Fence is the fencing token of the leader lease a background task runs
+// under. Its destructive writes only go through while no newer token is in
+// leader.TokenKey, so that those of a deposed leader are rejected.
+type Fence int64
+
+// NoFence lets every write through, for tasks run without an election.
+const NoFence Fence = 0
+
+// ErrFenced is returned by the writes of a task whose lease was superseded.
+var ErrFenced = errors.New("a newer leader holds the lease")
+
+// raiseFenceScript raises the token in KEYS[1] to ARGV[1], and returns the
+// token it held before.
+var raiseFenceScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return current
+`)
+
+// raiseFence records fence in this Redis, so that the tasks of older leases
+// writing to it are rejected, even when the election lives in another one.
+func (c *Client) raiseFence(fence Fence) error {
+	if fence == NoFence {
+		return nil
+	}
+	current, err := raiseFenceScript.Run(c, []string{leader.TokenKey}, int64(fence)).Int64()
+	if err != nil {
+		return err
+	}
+	if current > int64(fence) {
+		return ErrFenced
+	}
+	return nil
+}
+
+// fenced runs fn in a transaction watching keys and leader.TokenKey, once
+// fence was checked to be the newest token. It runs again when a watched key
+// changed before the transaction ran.
+func (c *Client) fenced(fence Fence, fn func(tx *redis.Tx) error, keys ...string) error {
+	for {
+		err := c.Watch(func(tx *redis.Tx) error {
+			if fence != NoFence {
+				current, err := tx.Get(leader.TokenKey).Int64()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				if current > int64(fence) {
+					return ErrFenced
+				}
+			}
+			return fn(tx)
+		}, append(keys, leader.TokenKey)...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+// stopped tells whether stop is closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
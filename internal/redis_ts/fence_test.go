@@ -0,0 +1,34 @@
+package redis_ts
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/leader"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFence(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	current, _ := redisClient.Get(leader.TokenKey).Int64()
+	deposed, fence := Fence(current+1), Fence(current+2)
+	redisClient.Del("test_fence")
+
+	assert.NoError(t, client.raiseFence(deposed))
+	assert.NoError(t, client.raiseFence(fence))
+	assert.Equal(t, ErrFenced, client.raiseFence(deposed))
+
+	write := func(fence Fence) error {
+		return client.fenced(fence, func(tx *redis.Tx) error {
+			_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Incr("test_fence")
+				return nil
+			})
+			return err
+		})
+	}
+	assert.Equal(t, ErrFenced, write(deposed))
+	assert.NoError(t, write(fence))
+	assert.NoError(t, write(NoFence))
+	assert.Equal(t, "2", redisClient.Get("test_fence").Val())
+}
@@ -0,0 +1,224 @@
+package redis_ts
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	gcScannedSeries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_gc_scanned_series_total",
+		Help: "Series checked by the garbage collection of stale series.",
+	})
+	gcDeletedSeries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_gc_deleted_series_total",
+		Help: "Stale series deleted by the garbage collection.",
+	})
+)
+
+// gcScript unlinks KEYS if the series in KEYS[1] has no sample newer than
+// ARGV[1], in ms. Checking again within the script keeps series that got a
+// sample since they were found stale, whoever wrote it. It returns whether
+// the keys were unlinked.
+var gcScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local last = redis.call('TS.GET', KEYS[1])
+if last[1] and tonumber(last[1]) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('UNLINK', unpack(KEYS))
+return 1
+`)
+
+// GCConfig configures the garbage collection of stale series.
+type GCConfig struct {
+	// MaxAge is how old the last sample of a series may be before it is
+	// deleted.
+	MaxAge time.Duration
+	// MaxAgeOverrides replaces MaxAge for some metrics. Zero keeps their
+	// series.
+	MaxAgeOverrides map[string]time.Duration
+	// BatchSize bounds the series checked and deleted at once, and
+	// BatchInterval is the pause between two batches.
+	BatchSize     int
+	BatchInterval time.Duration
+	// DryRun only reports the stale series.
+	DryRun bool
+}
+
+// ParseMaxAgeOverrides parses per metric maximum ages, given as
+// "metric=duration,metric=duration".
+func ParseMaxAgeOverrides(s string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	if s == "" {
+		return overrides, nil
+	}
+	for _, override := range strings.Split(s, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid max age override %q, must be metric=duration", override)
+		}
+		maxAge, err := time.ParseDuration(parts[1])
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("invalid max age in %q", override)
+		}
+		overrides[parts[0]] = maxAge
+	}
+	return overrides, nil
+}
+
+func (cfg *GCConfig) maxAge(metric string) time.Duration {
+	if maxAge, ok := cfg.MaxAgeOverrides[metric]; ok {
+		return maxAge
+	}
+	return cfg.MaxAge
+}
+
+// GCReport is what a garbage collection found.
+type GCReport struct {
+	Scanned int
+	// Stale counts the stale series found, by metric.
+	Stale   map[string]int
+	Deleted int
+}
+
+// gcKeys returns, for a key holding the samples of a series, its metric and
+// the keys to delete with it: its exemplars, and the other keys of a native
+// histogram series. ok is false for every other key.
+func gcKeys(key string) (metric string, keys []string, ok bool) {
+	base := strings.TrimSuffix(key, histogramCountSuffix)
+	open, end := strings.Index(base, "{"), strings.LastIndex(base, "}")
+	if open <= 0 || end < open {
+		return "", nil, false
+	}
+	// Partition keys end with @period.
+	if rest := base[end+1:]; rest != "" && (!strings.HasPrefix(rest, "@") || strings.Contains(rest, ":")) {
+		return "", nil, false
+	}
+	if base == key {
+		return base[:open], []string{key, exemplarsKey(key)}, true
+	}
+	return base[:open], []string{key, base + histogramSumSuffix, base + histogramsKeySuffix, exemplarsKey(base)}, true
+}
+
+// gcCandidate is a series whose last sample is checked.
+type gcCandidate struct {
+	metric    string
+	keys      []string
+	threshold int64
+	last      *redis.SliceCmd
+}
+
+// CollectGarbage deletes the series whose last sample is older than their
+// metric's maximum age, in batches, until it scanned every key or stop is
+// closed. Several adapters may collect the same Redis at once: each series is
+// checked again as it is deleted. Deletions stop with ErrFenced once a newer
+// leader than fence took over.
+func (c *Client) CollectGarbage(cfg GCConfig, now time.Time, fence Fence, stop <-chan struct{}) (GCReport, error) {
+	report := GCReport{Stale: make(map[string]int)}
+	if err := c.raiseFence(fence); err != nil {
+		return report, err
+	}
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(cursor, "*}*", int64(cfg.BatchSize)).Result()
+		if err != nil {
+			return report, err
+		}
+		checked, stale, err := c.findStale(cfg, keys, now)
+		if err != nil {
+			return report, err
+		}
+		report.Scanned += checked
+		for _, candidate := range stale {
+			report.Stale[candidate.metric]++
+			if cfg.DryRun {
+				continue
+			}
+			if stopped(stop) {
+				return report, nil
+			}
+			var cmd *redis.Cmd
+			err := c.fenced(fence, func(tx *redis.Tx) error {
+				_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+					cmd = gcScript.Eval(pipe, candidate.keys, candidate.threshold)
+					return nil
+				})
+				return err
+			})
+			if err != nil {
+				return report, err
+			}
+			if deleted, _ := cmd.Int64(); deleted == 1 {
+				c.retentions.forget(candidate.keys...)
+				report.Deleted++
+				gcDeletedSeries.Inc()
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return report, nil
+		}
+		select {
+		case <-time.After(cfg.BatchInterval):
+		case <-stop:
+			return report, nil
+		}
+	}
+}
+
+// findStale gets the last sample of the series among keys, and returns how
+// many it checked and those too old.
+func (c *Client) findStale(cfg GCConfig, keys []string, now time.Time) (int, []*gcCandidate, error) {
+	pipe := c.Pipeline()
+	defer pipe.Close()
+	var checked []*gcCandidate
+	for _, key := range keys {
+		metric, deleted, ok := gcKeys(key)
+		if !ok {
+			continue
+		}
+		maxAge := cfg.maxAge(metric)
+		if maxAge <= 0 {
+			continue
+		}
+		candidate := &gcCandidate{
+			metric:    metric,
+			keys:      deleted,
+			threshold: now.Add(-maxAge).UnixNano() / int64(time.Millisecond),
+			last:      redis.NewSliceCmd("TS.GET", key),
+		}
+		if err := pipe.Process(candidate.last); err != nil {
+			return 0, nil, err
+		}
+		checked = append(checked, candidate)
+	}
+	if len(checked) == 0 {
+		return 0, nil, nil
+	}
+	// Keys that are not series, or are gone already, fail on their own.
+	_, _ = pipe.Exec()
+
+	gcScannedSeries.Add(float64(len(checked)))
+	var stale []*gcCandidate
+	for _, candidate := range checked {
+		if candidate.last.Err() != nil {
+			continue
+		}
+		// A series without samples left is stale too.
+		if last := candidate.last.Val(); len(last) > 0 {
+			if timestamp, ok := last[0].(int64); !ok || timestamp > candidate.threshold {
+				continue
+			}
+		}
+		stale = append(stale, candidate)
+	}
+	return len(checked), stale, nil
+}
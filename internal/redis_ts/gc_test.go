@@ -0,0 +1,77 @@
+package redis_ts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaxAgeOverrides(t *testing.T) {
+	overrides, err := ParseMaxAgeOverrides("up=1h,job:up:sum=0s")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"up": time.Hour, "job:up:sum": 0}, overrides)
+
+	for _, s := range []string{"up", "=1h", "up=x", "up=-1h"} {
+		_, err := ParseMaxAgeOverrides(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestGCKeys(t *testing.T) {
+	metric, keys, ok := gcKeys("up{job=api}")
+	assert.True(t, ok)
+	assert.Equal(t, "up", metric)
+	assert.Equal(t, []string{"up{job=api}", "up{job=api}:exemplars"}, keys)
+
+	metric, keys, ok = gcKeys("rpc{}@20240501T000000Z:histogram_count")
+	assert.True(t, ok)
+	assert.Equal(t, "rpc", metric)
+	assert.Equal(t, []string{
+		"rpc{}@20240501T000000Z:histogram_count",
+		"rpc{}@20240501T000000Z:histogram_sum",
+		"rpc{}@20240501T000000Z:histograms",
+		"rpc{}@20240501T000000Z:exemplars",
+	}, keys)
+
+	for _, key := range []string{"up{job=api}:exemplars", "rpc{}:histogram_sum", "rpc{}:histograms", "__metadata__", "{}"} {
+		_, _, ok := gcKeys(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	redisClient.Del("test_gc_stale{}", "test_gc_fresh{}", "test_gc_kept{}")
+
+	now := time.Now()
+	old := now.Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	err := client.Write([]*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_gc_stale"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: old}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_gc_kept"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: old}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_gc_fresh"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: now.UnixNano() / int64(time.Millisecond)}}},
+	})
+	assert.NoError(t, err)
+
+	cfg := GCConfig{
+		MaxAge:          time.Hour,
+		MaxAgeOverrides: map[string]time.Duration{"test_gc_kept": 0},
+		BatchSize:       100,
+		DryRun:          true,
+	}
+	report, err := client.CollectGarbage(cfg, now, NoFence, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Stale["test_gc_stale"])
+	assert.Equal(t, 0, report.Deleted)
+	assert.Equal(t, int64(1), redisClient.Exists("test_gc_stale{}").Val())
+
+	cfg.DryRun = false
+	report, err = client.CollectGarbage(cfg, now, NoFence, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Stale["test_gc_stale"])
+	assert.Zero(t, report.Stale["test_gc_fresh"])
+	assert.Zero(t, report.Stale["test_gc_kept"])
+	assert.Equal(t, int64(0), redisClient.Exists("test_gc_stale{}").Val())
+	assert.Equal(t, int64(2), redisClient.Exists("test_gc_fresh{}", "test_gc_kept{}").Val())
+}
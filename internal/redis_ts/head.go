@@ -0,0 +1,284 @@
+package redis_ts
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	headSamples = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_head_samples",
+		Help: "Samples and histograms held in the in-memory head.",
+	})
+	headSeriesCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_head_series",
+		Help: "Series held in the in-memory head.",
+	})
+	headEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_head_evicted_samples_total",
+		Help: "Samples and histograms evicted from the head before leaving its window, to stay within its memory bound.",
+	})
+	headReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_head_reads_total",
+		Help: "Queries read with the head enabled, by source: memory, redis, or both.",
+	}, []string{"source"})
+)
+
+// head holds the samples and histograms written in the last window, as
+// stored in Redis, so that queries of recent data are answered from memory.
+// It has every sample written by this client with a timestamp from lower on,
+// as long as no other process writes the same series.
+type head struct {
+	window     int64
+	maxSamples int
+	now        func() time.Time
+
+	mu sync.RWMutex
+	// lower is the oldest timestamp the head has every sample from: when
+	// the client was created, or the start of the window if later.
+	lower    int64
+	trimmed  int64
+	samples  int
+	bySeries map[string]*headSeries
+}
+
+type headSeries struct {
+	labels     []*prompb.Label
+	samples    []prompb.Sample
+	histograms []remotepb.Histogram
+}
+
+func newHead(window time.Duration, maxSamples int, now func() time.Time) *head {
+	lower := now().UnixNano() / int64(time.Millisecond)
+	return &head{
+		window:     int64(window / time.Millisecond),
+		maxSamples: maxSamples,
+		now:        now,
+		lower:      lower,
+		trimmed:    lower,
+		bySeries:   make(map[string]*headSeries),
+	}
+}
+
+// EnableHead keeps the samples and histograms written in the last window in
+// memory, at most maxSamples of them, and answers the queries of that window
+// from there. Queries reaching further back read the rest from Redis. Only
+// enable it when this client writes every sample of the series it reads.
+func (c *Client) EnableHead(window time.Duration, maxSamples int) {
+	c.head = newHead(window, maxSamples, time.Now)
+}
+
+// headWrites tracks the commands queued on a write pipeline for what the head
+// records once it is written.
+type headWrites struct {
+	samples    []headSample
+	histograms []headHistograms
+}
+
+type headSample struct {
+	labels []*prompb.Label
+	sample prompb.Sample
+	cmd    redis.Cmder
+}
+
+type headHistograms struct {
+	labels     []*prompb.Label
+	histograms []remotepb.Histogram
+	cmd        *redis.IntCmd
+}
+
+// record adds what an executed pipeline wrote to the head.
+func (h *head) record(w *headWrites) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.advance()
+	for _, s := range w.samples {
+		if s.cmd.Err() != nil || s.sample.Timestamp < h.lower {
+			continue
+		}
+		// Redis keeps the value as it was sent, with 6 decimals.
+		value, _ := strconv.ParseFloat(strconv.FormatFloat(s.sample.Value, 'f', 6, 64), 64)
+		h.addSample(h.seriesOf(s.labels), prompb.Sample{Value: value, Timestamp: s.sample.Timestamp})
+	}
+	for _, hs := range w.histograms {
+		if hs.cmd.Err() != nil {
+			continue
+		}
+		for _, histogram := range hs.histograms {
+			if histogram.Timestamp >= h.lower && math.Float64bits(histogram.Sum) != staleNaN {
+				h.addHistogram(h.seriesOf(hs.labels), histogram)
+			}
+		}
+	}
+	for h.maxSamples > 0 && h.samples > h.maxSamples {
+		// Give up the older half of what is held, up to now or to the newest
+		// sample if later, as senders' clocks may run ahead. lower moves by
+		// at least one, so that it passes the newest sample at worst.
+		before := h.samples
+		upper := h.now().UnixNano() / int64(time.Millisecond)
+		if newest := h.newest(); newest > upper {
+			upper = newest
+		}
+		h.lower += (upper-h.lower)/2 + 1
+		h.trim()
+		headEvictions.Add(float64(before - h.samples))
+	}
+	headSamples.Set(float64(h.samples))
+	headSeriesCount.Set(float64(len(h.bySeries)))
+}
+
+// newest returns the timestamp of the newest sample or histogram held.
+func (h *head) newest() int64 {
+	newest := int64(math.MinInt64)
+	for _, s := range h.bySeries {
+		if n := len(s.samples); n > 0 && s.samples[n-1].Timestamp > newest {
+			newest = s.samples[n-1].Timestamp
+		}
+		if n := len(s.histograms); n > 0 && s.histograms[n-1].Timestamp > newest {
+			newest = s.histograms[n-1].Timestamp
+		}
+	}
+	return newest
+}
+
+func (h *head) seriesOf(labels []*prompb.Label) *headSeries {
+	labels, _ = withoutPartition(labels)
+	labels = promseries.NormalizeLabels(labels)
+	key := promseries.LabelsKey(labels)
+	s, ok := h.bySeries[key]
+	if !ok {
+		s = &headSeries{labels: labels}
+		h.bySeries[key] = s
+	}
+	return s
+}
+
+// addSample inserts sample in time order, replacing one with the same
+// timestamp as Redis does when it accepts it.
+func (h *head) addSample(s *headSeries, sample prompb.Sample) {
+	i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp >= sample.Timestamp })
+	if i < len(s.samples) && s.samples[i].Timestamp == sample.Timestamp {
+		s.samples[i] = sample
+		return
+	}
+	s.samples = append(s.samples, prompb.Sample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample
+	h.samples++
+}
+
+func (h *head) addHistogram(s *headSeries, histogram remotepb.Histogram) {
+	i := sort.Search(len(s.histograms), func(i int) bool { return s.histograms[i].Timestamp >= histogram.Timestamp })
+	if i < len(s.histograms) && s.histograms[i].Timestamp == histogram.Timestamp {
+		s.histograms[i] = histogram
+		return
+	}
+	s.histograms = append(s.histograms, remotepb.Histogram{})
+	copy(s.histograms[i+1:], s.histograms[i:])
+	s.histograms[i] = histogram
+	h.samples++
+}
+
+// advance moves lower to the start of the window, and drops what left it
+// once the window moved by a tenth of its length.
+func (h *head) advance() {
+	start := h.now().UnixNano()/int64(time.Millisecond) - h.window
+	if start > h.lower {
+		h.lower = start
+	}
+	if h.lower-h.trimmed >= h.window/10 {
+		h.trim()
+	}
+}
+
+// trim drops the samples and histograms older than lower.
+func (h *head) trim() {
+	for key, s := range h.bySeries {
+		i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp >= h.lower })
+		j := sort.Search(len(s.histograms), func(j int) bool { return s.histograms[j].Timestamp >= h.lower })
+		h.samples -= i + j
+		s.samples = append(s.samples[:0], s.samples[i:]...)
+		s.histograms = append(s.histograms[:0], s.histograms[j:]...)
+		if len(s.samples) == 0 && len(s.histograms) == 0 {
+			delete(h.bySeries, key)
+		}
+	}
+	h.trimmed = h.lower
+}
+
+// read returns copies of the series matching matchers, with their samples
+// and histograms between start and end, and lower, the oldest timestamp the
+// head answers for. Series without any in the range are left out.
+func (h *head) read(matchers []*prompb.LabelMatcher, start, end int64) ([]*remotepb.TimeSeries, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	// Samples may have left the window since the last write.
+	lower := h.lower
+	if windowStart := h.now().UnixNano()/int64(time.Millisecond) - h.window; windowStart > lower {
+		lower = windowStart
+	}
+	if start < lower {
+		start = lower
+	}
+
+	var series []*remotepb.TimeSeries
+	for _, s := range h.bySeries {
+		if !matchLabels(s.labels, matchers) {
+			continue
+		}
+		from := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp >= start })
+		to := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp > end })
+		hFrom := sort.Search(len(s.histograms), func(i int) bool { return s.histograms[i].Timestamp >= start })
+		hTo := sort.Search(len(s.histograms), func(i int) bool { return s.histograms[i].Timestamp > end })
+		if from >= to && hFrom >= hTo {
+			continue
+		}
+		ts := &remotepb.TimeSeries{Labels: s.labels}
+		if from < to {
+			ts.Samples = append([]prompb.Sample(nil), s.samples[from:to]...)
+		}
+		if hFrom < hTo {
+			ts.Histograms = append([]remotepb.Histogram(nil), s.histograms[hFrom:hTo]...)
+		}
+		series = append(series, ts)
+	}
+	return series, lower
+}
+
+// matchLabels tells whether labels match every matcher, a missing label
+// having the empty value. Only equality matchers are supported, as by
+// TS.MRANGE filters.
+func matchLabels(labels []*prompb.Label, matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range labels {
+			if l.Name == m.Name {
+				value = l.Value
+				break
+			}
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if value != m.Value {
+				return false
+			}
+		case prompb.LabelMatcher_NEQ:
+			if value == m.Value {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
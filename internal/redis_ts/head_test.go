@@ -0,0 +1,179 @@
+package redis_ts
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHead(t *testing.T) {
+	now := time.Unix(100, 0)
+	h := newHead(time.Minute, 0, func() time.Time { return now })
+	up := []*prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}}
+	down := []*prompb.Label{{Name: "__name__", Value: "down"}, {Name: partitionLabel, Value: "19700101T000000Z"}}
+	ok := redis.NewStatusResult("OK", nil)
+	failed := redis.NewStatusResult("", errors.New("ERR TSDB: compaction"))
+
+	now = now.Add(30 * time.Second)
+	h.record(&headWrites{
+		samples: []headSample{
+			{labels: up, sample: prompb.Sample{Value: 2, Timestamp: 120000}, cmd: ok},
+			{labels: up, sample: prompb.Sample{Value: 1.0000001, Timestamp: 110000}, cmd: ok},
+			// Older than the head.
+			{labels: up, sample: prompb.Sample{Value: 0, Timestamp: 90000}, cmd: ok},
+			{labels: up, sample: prompb.Sample{Value: 3, Timestamp: 125000}, cmd: failed},
+			{labels: down, sample: prompb.Sample{Value: 4, Timestamp: 120000}, cmd: ok},
+		},
+		histograms: []headHistograms{{
+			labels:     down,
+			histograms: []remotepb.Histogram{{Timestamp: 115000}, {Timestamp: 116000, Sum: math.Float64frombits(staleNaN)}},
+			cmd:        redis.NewIntResult(1, nil),
+		}},
+	})
+	assert.Equal(t, 4, h.samples)
+
+	series, lower := h.read([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}, 0, 200000)
+	assert.Equal(t, int64(100000), lower, "the head starts when it was created")
+	assert.Equal(t, []*remotepb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 110000}, {Value: 2, Timestamp: 120000}},
+	}}, series)
+
+	series, _ = h.read([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: ""}}, 0, 200000)
+	assert.Equal(t, []*remotepb.TimeSeries{{
+		Labels:     []*prompb.Label{{Name: "__name__", Value: "down"}},
+		Samples:    []prompb.Sample{{Value: 4, Timestamp: 120000}},
+		Histograms: []remotepb.Histogram{{Timestamp: 115000}},
+	}}, series)
+
+	// Samples leave the window as time goes by.
+	now = now.Add(45 * time.Second)
+	series, lower = h.read([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "db"}}, 0, 200000)
+	assert.Equal(t, int64(115000), lower)
+	assert.Len(t, series, 2)
+	h.record(&headWrites{})
+	assert.Equal(t, 3, h.samples)
+}
+
+func TestHeadMemoryBound(t *testing.T) {
+	now := time.Unix(0, 0)
+	h := newHead(time.Hour, 10, func() time.Time { return now })
+	now = now.Add(100 * time.Second)
+	w := &headWrites{}
+	for i := int64(0); i < 20; i++ {
+		w.samples = append(w.samples, headSample{
+			labels: []*prompb.Label{{Name: "__name__", Value: "up"}},
+			sample: prompb.Sample{Value: float64(i), Timestamp: i * 5000},
+			cmd:    redis.NewStatusResult("OK", nil),
+		})
+	}
+	h.record(w)
+	assert.True(t, h.samples <= 10)
+
+	// The head no longer answers for what it evicted.
+	series, lower := h.read(nil, 0, math.MaxInt64)
+	assert.True(t, series[0].Samples[0].Timestamp >= lower)
+	assert.Len(t, series[0].Samples, h.samples)
+}
+
+func TestHeadMemoryBoundFutureSamples(t *testing.T) {
+	now := time.Unix(0, 0)
+	h := newHead(time.Hour, 10, func() time.Time { return now })
+	// A sender whose clock runs ahead stamps every sample after now.
+	w := &headWrites{}
+	for i := int64(0); i < 20; i++ {
+		w.samples = append(w.samples, headSample{
+			labels: []*prompb.Label{{Name: "__name__", Value: "up"}},
+			sample: prompb.Sample{Value: float64(i), Timestamp: 5000 + i},
+			cmd:    redis.NewStatusResult("OK", nil),
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		h.record(w)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recording samples stamped after now does not return")
+	}
+	assert.True(t, h.samples <= 10)
+	series, lower := h.read(nil, 0, math.MaxInt64)
+	if assert.Len(t, series, 1) {
+		assert.True(t, series[0].Samples[0].Timestamp >= lower)
+		assert.Equal(t, int64(5019), series[0].Samples[len(series[0].Samples)-1].Timestamp)
+	}
+}
+
+func TestHeadRead(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	redisClient.Del("test_head{}")
+	labels := []*prompb.Label{{Name: "__name__", Value: "test_head"}}
+	client.EnableHead(time.Hour, 1000)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	assert.NoError(t, client.Write([]*prompb.TimeSeries{{Labels: labels, Samples: []prompb.Sample{{Value: 2, Timestamp: now}}}}))
+
+	read := func(start int64) []prompb.Sample {
+		resp, err := client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+			StartTimestampMs: start,
+			EndTimestampMs:   now,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_head"}},
+		}}})
+		assert.NoError(t, err)
+		if assert.Len(t, resp.Results[0].Timeseries, 1) {
+			return resp.Results[0].Timeseries[0].Samples
+		}
+		return nil
+	}
+	// Only read from memory, while Redis lost the series.
+	redisClient.Del("test_head{}")
+	assert.Equal(t, []prompb.Sample{{Value: 2, Timestamp: now}}, read(now))
+	// Samples from before the head was enabled are read from Redis.
+	assert.NoError(t, client.Write([]*prompb.TimeSeries{{Labels: labels, Samples: []prompb.Sample{{Value: 1, Timestamp: now - 60000}}}}))
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: now - 60000}, {Value: 2, Timestamp: now}}, read(now-120000))
+}
+
+func TestHeadReadLimits(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	client.EnableHead(time.Hour, 1000)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	w := &headWrites{}
+	for _, job := range []string{"api", "db"} {
+		for i := int64(0); i < 3; i++ {
+			w.samples = append(w.samples, headSample{
+				labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}},
+				sample: prompb.Sample{Value: 1, Timestamp: now + i},
+				cmd:    redis.NewStatusResult("OK", nil),
+			})
+		}
+	}
+	client.head.record(w)
+
+	// Only read from memory.
+	q := &prompb.Query{
+		StartTimestampMs: now,
+		EndTimestampMs:   now + 10,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}
+	client.ReadLimits = readlimit.Limits{MaxSeries: 1}
+	_, err := client.Query(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+	assert.Equal(t, fmt.Errorf("query 0: %w", &readlimit.LimitError{Limit: readlimit.LimitSeries, Max: 1}), err)
+
+	client.ReadLimits = readlimit.Limits{MaxSamples: 5}
+	err = client.Stream(q, readlimit.NewTracker(client.ReadLimits), func(*remotepb.TimeSeries) error { return nil })
+	assert.Equal(t, &readlimit.LimitError{Limit: readlimit.LimitSamples, Max: 5}, err)
+
+	client.ReadLimits = readlimit.Limits{MaxSeries: 2, MaxSamples: 6}
+	resp, err := client.Query(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Results[0].Timeseries, 2)
+}
@@ -0,0 +1,175 @@
+package redis_ts
+
+import (
+	"math"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Native histograms do not fit in a RedisTimeSeries sample, so a histogram
+// series with key K is stored in three keys:
+//
+//	K:histogram_count  a time series of the histograms' count
+//	K:histogram_sum    a time series of the histograms' sum
+//	K:histograms       a sorted set of the protobuf encoded histograms,
+//	                   scored by timestamp
+//
+// The two time series carry the labels of the series plus a __histogram__
+// label ("count" or "sum"), so tools reading RedisTimeSeries directly can use
+// them. Float reads filter on an empty __histogram__ label to skip them.
+// Remote read finds histogram series through their count series and rebuilds
+// the histograms from the sorted set, which follows the count series'
+// retention.
+const (
+	histogramLabel       = "__histogram__"
+	histogramCountSuffix = ":histogram_count"
+	histogramSumSuffix   = ":histogram_sum"
+	histogramsKeySuffix  = ":histograms"
+)
+
+// staleNaN is the NaN Prometheus uses to mark a series as stale.
+const staleNaN = 0x7ff0000000000002
+
+type histogramAdd struct {
+	cmd   *redis.IntCmd
+	count int
+}
+
+// withLabel returns a copy of labels with one label added.
+func withLabel(labels []*prompb.Label, name string, value string) []*prompb.Label {
+	result := make([]*prompb.Label, 0, len(labels)+1)
+	result = append(result, labels...)
+	return append(result, &prompb.Label{Name: name, Value: value})
+}
+
+func histogramCount(h *remotepb.Histogram) float64 {
+	if h.CountFloat != nil {
+		return *h.CountFloat
+	}
+	if h.CountInt != nil {
+		return float64(*h.CountInt)
+	}
+	return 0
+}
+
+func (c *Client) addHistograms(pipe redis.Pipeliner, adds *[]histogramAdd, lookups retentionLookups, key string, labels []*prompb.Label, metric *string, histograms []remotepb.Histogram) error {
+	countKey := key + histogramCountSuffix
+	sumKey := key + histogramSumSuffix
+	setKey := key + histogramsKeySuffix
+	countLabels := withLabel(labels, histogramLabel, "count")
+	sumLabels := withLabel(labels, histogramLabel, "sum")
+
+	members := make([]redis.Z, 0, len(histograms))
+	newest := int64(math.MinInt64)
+	for i := range histograms {
+		h := &histograms[i]
+		if math.Float64bits(h.Sum) == staleNaN {
+			continue
+		}
+
+		count := histogramCount(h)
+		if err := pipe.Process(c.add(&countKey, countLabels, metric, &h.Timestamp, &count)); err != nil {
+			return err
+		}
+		if !math.IsNaN(h.Sum) && !math.IsInf(h.Sum, 0) {
+			if err := pipe.Process(c.add(&sumKey, sumLabels, metric, &h.Timestamp, &h.Sum)); err != nil {
+				return err
+			}
+		}
+
+		encoded, err := proto.Marshal(h)
+		if err != nil {
+			return err
+		}
+		// Replace whatever was stored for the same timestamp.
+		pipe.ZRemRangeByScore(setKey, formatScore(h.Timestamp), formatScore(h.Timestamp))
+		members = append(members, redis.Z{Score: float64(h.Timestamp), Member: string(encoded)})
+		if h.Timestamp > newest {
+			newest = h.Timestamp
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	*adds = append(*adds, histogramAdd{cmd: pipe.ZAdd(setKey, members...), count: len(members)})
+	return c.trimToRetention(pipe, lookups, countKey, setKey, newest)
+}
+
+func histogramsWritten(adds []histogramAdd) (written int) {
+	for _, add := range adds {
+		if add.cmd.Err() == nil {
+			written += add.count
+		}
+	}
+	return written
+}
+
+// histogramSeries is a histogram series found by a read, before its
+// histograms are fetched.
+type histogramSeries struct {
+	labels []*prompb.Label
+	cmd    *redis.StringSliceCmd
+}
+
+// findHistograms queues the lookup of the histogram series matching a
+// query's label filter.
+func findHistograms(pipe redis.Pipeliner, labelMatchers []interface{}) (*redis.SliceCmd, error) {
+	args := make([]interface{}, 0, len(labelMatchers)+4)
+	args = append(args, "TS.MGET", "WITHLABELS", "FILTER")
+	args = append(args, labelMatchers...)
+	args = append(args, histogramLabel+"=count")
+	cmd := redis.NewSliceCmd(args...)
+	return cmd, pipe.Process(cmd)
+}
+
+// rangeHistograms queues the range lookups for the series found by
+// findHistograms.
+func rangeHistograms(pipe redis.Pipeliner, found *redis.SliceCmd, start int64, end int64) []histogramSeries {
+	series := make([]histogramSeries, 0, len(found.Val()))
+	for _, ts := range found.Val() {
+		tsSlice := ts.([]interface{})
+		countKey := tsSlice[0].(string)
+		key := countKey[:len(countKey)-len(histogramCountSuffix)]
+
+		series = append(series, histogramSeries{
+			labels: withoutHistogramLabel(parseLabels(tsSlice[1].([]interface{}))),
+			cmd: pipe.ZRangeByScore(key+histogramsKeySuffix, redis.ZRangeBy{
+				Min: formatScore(start),
+				Max: formatScore(end),
+			}),
+		})
+	}
+	return series
+}
+
+// withoutHistogramLabel removes the label telling the count and sum of a
+// histogram series apart from labels.
+func withoutHistogramLabel(labels []*prompb.Label) []*prompb.Label {
+	seriesLabels := labels[:0]
+	for _, l := range labels {
+		if l.Name != histogramLabel {
+			seriesLabels = append(seriesLabels, l)
+		}
+	}
+	return seriesLabels
+}
+
+// toTimeSeries decodes the fetched histograms. It returns nil if the series
+// has no histograms in the queried range.
+func (s *histogramSeries) toTimeSeries() (*remotepb.TimeSeries, error) {
+	members := s.cmd.Val()
+	if len(members) == 0 {
+		return nil, nil
+	}
+	histograms := make([]remotepb.Histogram, len(members))
+	for i, member := range members {
+		if err := proto.Unmarshal([]byte(member), &histograms[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &remotepb.TimeSeries{Labels: s.labels, Histograms: histograms}, nil
+}
@@ -0,0 +1,75 @@
+package redis_ts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHistogram(timestamp int64) remotepb.Histogram {
+	count, zeroCount := uint64(0), uint64(2)
+	return remotepb.Histogram{
+		CountInt:       &count,
+		Sum:            -12.5,
+		Schema:         -1,
+		ZeroThreshold:  0.001,
+		ZeroCountInt:   &zeroCount,
+		NegativeSpans:  []remotepb.BucketSpan{{Offset: -2, Length: 2}},
+		NegativeDeltas: []int64{3, -1},
+		PositiveSpans:  []remotepb.BucketSpan{{Offset: 0, Length: 1}, {Offset: 3, Length: 1}},
+		PositiveDeltas: []int64{1, 0},
+		ResetHint:      remotepb.ResetHintNo,
+		Timestamp:      timestamp,
+	}
+}
+
+func TestHistogramEncoding(t *testing.T) {
+	histogram := testHistogram(1000)
+	encoded, err := proto.Marshal(&histogram)
+	assert.Nil(t, err)
+
+	var decoded remotepb.Histogram
+	assert.Nil(t, proto.Unmarshal(encoded, &decoded))
+	assert.Equal(t, histogram, decoded)
+	assert.False(t, decoded.IsFloatHistogram())
+	assert.Equal(t, float64(0), histogramCount(&decoded))
+
+	count := 4.5
+	floatHistogram := remotepb.Histogram{CountFloat: &count, PositiveCounts: []float64{4.5}, Timestamp: 1000}
+	encoded, err = proto.Marshal(&floatHistogram)
+	assert.Nil(t, err)
+	assert.Nil(t, proto.Unmarshal(encoded, &decoded))
+	assert.True(t, decoded.IsFloatHistogram())
+	assert.Equal(t, 4.5, histogramCount(&decoded))
+}
+
+func TestWriteAndReadHistograms(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key := "test_histogram{job=api}"
+	redisClient.Del(key+histogramCountSuffix, key+histogramSumSuffix, key+histogramsKeySuffix)
+
+	labels := []*prompb.Label{{Name: "__name__", Value: "test_histogram"}, {Name: "job", Value: "api"}}
+	histograms := []remotepb.Histogram{testHistogram(now), testHistogram(now + 1)}
+	client := NewClient(redisAddress, redisAuth)
+	stats, err := client.Ingest(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:     labels,
+		Histograms: histograms,
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStats{Histograms: 2}, stats)
+
+	resp, err := client.Query(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: now,
+		EndTimestampMs:   now + 10,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_histogram"}},
+	}}})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Results, 1)
+	assert.Len(t, resp.Results[0].Timeseries, 1)
+	assert.ElementsMatch(t, labels, resp.Results[0].Timeseries[0].Labels)
+	assert.Equal(t, histograms, resp.Results[0].Timeseries[0].Histograms)
+}
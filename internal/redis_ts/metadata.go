@@ -0,0 +1,83 @@
+package redis_ts
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+)
+
+// Metric metadata is kept in a single hash, with one field per metric
+// family. The latest metadata sent for a family wins.
+const metadataKey = "__metadata__"
+
+type storedMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+func addMetadata(pipe redis.Pipeliner, metadata []*remotepb.MetricMetadata) error {
+	fields := make(map[string]interface{}, len(metadata))
+	for _, m := range metadata {
+		if m.MetricFamilyName == "" {
+			continue
+		}
+		encoded, err := json.Marshal(&storedMetadata{Type: m.Type.String(), Help: m.Help, Unit: m.Unit})
+		if err != nil {
+			return err
+		}
+		fields[m.MetricFamilyName] = string(encoded)
+	}
+	if len(fields) > 0 {
+		pipe.HMSet(metadataKey, fields)
+	}
+	return nil
+}
+
+func decodeMetadata(family string, encoded string) (*remotepb.MetricMetadata, error) {
+	var stored storedMetadata
+	if err := json.Unmarshal([]byte(encoded), &stored); err != nil {
+		return nil, err
+	}
+	return &remotepb.MetricMetadata{
+		Type:             remotepb.ParseMetricType(stored.Type),
+		MetricFamilyName: family,
+		Help:             stored.Help,
+		Unit:             stored.Unit,
+	}, nil
+}
+
+// Metadata returns the stored metadata of a metric family, or of all
+// families if metric is empty, sorted by family name.
+func (c *Client) Metadata(metric string) ([]*remotepb.MetricMetadata, error) {
+	var fields map[string]string
+	if metric != "" {
+		encoded, err := c.HGet(metadataKey, metric).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = map[string]string{metric: encoded}
+	} else {
+		var err error
+		fields, err = c.HGetAll(metadataKey).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*remotepb.MetricMetadata, 0, len(fields))
+	for family, encoded := range fields {
+		metadata, err := decodeMetadata(family, encoded)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, metadata)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].MetricFamilyName < result[j].MetricFamilyName })
+	return result, nil
+}
@@ -0,0 +1,30 @@
+package redis_ts
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAndReadMetadata(t *testing.T) {
+	redisClient.HDel(metadataKey, "test_metadata_total")
+
+	client := NewClient(redisAddress, redisAuth)
+	metadata := &remotepb.MetricMetadata{
+		Type:             remotepb.MetricTypeCounter,
+		MetricFamilyName: "test_metadata_total",
+		Help:             "Number of test runs.",
+		Unit:             "runs",
+	}
+	_, err := client.Ingest(&remotepb.WriteRequest{Metadata: []*remotepb.MetricMetadata{metadata}})
+	assert.Nil(t, err)
+
+	result, err := client.Metadata("test_metadata_total")
+	assert.Nil(t, err)
+	assert.Equal(t, []*remotepb.MetricMetadata{metadata}, result)
+
+	result, err = client.Metadata("test_metadata_missing")
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+}
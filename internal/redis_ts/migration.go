@@ -0,0 +1,404 @@
+package redis_ts
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationKey is the hash, in the new backend, holding the progress of the
+// backfill.
+const migrationKey = "__migration__"
+
+// backfillPageSize bounds the keys scanned and the samples copied at once.
+const backfillPageSize = 1000
+
+var (
+	oldBackendWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_migration_old_write_failures_total",
+		Help: "Writes to the old backend that failed during a migration.",
+	})
+	backfilledKeys = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_migration_backfilled_keys_total",
+		Help: "Keys copied from the old backend to the new one, by type.",
+	}, []string{"type"})
+	backfillDone = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_migration_backfill_done",
+		Help: "Whether the backfill of the new backend is done.",
+	})
+)
+
+// Migration moves the data of one Redis deployment to another. It writes to
+// both, and reads the time before the cutover, when dual writes started,
+// from the old one until Backfill copied it to the new one.
+type Migration struct {
+	Old *Client
+	New *Client
+	// Cutover is when dual writes started, in ms. The new backend has all
+	// the data after it.
+	Cutover int64
+
+	backfilled int32
+}
+
+// NewMigration creates a Migration, resuming from the backfill progress
+// recorded in the new backend.
+func NewMigration(old *Client, new *Client, cutover int64) (*Migration, error) {
+	m := &Migration{Old: old, New: new, Cutover: cutover}
+	done, err := new.HGet(migrationKey, "done").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if done == "1" {
+		m.setBackfilled()
+	}
+	return m, nil
+}
+
+func (m *Migration) Name() string {
+	return "migration"
+}
+
+func (m *Migration) isBackfilled() bool {
+	return atomic.LoadInt32(&m.backfilled) == 1
+}
+
+func (m *Migration) setBackfilled() {
+	atomic.StoreInt32(&m.backfilled, 1)
+	backfillDone.Set(1)
+}
+
+// Ingest writes req to both backends. Only the new backend's result counts:
+// the old one is kept up to date for a rollback, on a best effort basis.
+func (m *Migration) Ingest(req *remotepb.WriteRequest) (WriteStats, error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := m.Old.Ingest(req); err != nil {
+			oldBackendWriteFailures.Inc()
+			log.WithFields(log.Fields{"err": err, "num_series": len(req.Timeseries)}).Warn("Could not write to the old backend")
+		}
+	}()
+	stats, err := m.New.Ingest(req)
+	wg.Wait()
+	return stats, err
+}
+
+// FlushThinned flushes the thinned samples of both backends.
+func (m *Migration) FlushThinned(until int64) error {
+	if err := m.Old.FlushThinned(until); err != nil {
+		oldBackendWriteFailures.Inc()
+		log.WithFields(log.Fields{"err": err}).Warn("Could not write thinned samples to the old backend")
+	}
+	return m.New.FlushThinned(until)
+}
+
+// Query reads the time before the cutover from the old backend and the rest
+// from the new one, and merges the series found on both sides.
+func (m *Migration) Query(req *prompb.ReadRequest) (*remotepb.ReadResponse, error) {
+	oldReq, newReq := &prompb.ReadRequest{}, &prompb.ReadRequest{}
+	var oldIndexes, newIndexes []int
+	for i, q := range req.Queries {
+		if m.isBackfilled() || q.StartTimestampMs >= m.Cutover {
+			newReq.Queries = append(newReq.Queries, q)
+			newIndexes = append(newIndexes, i)
+			continue
+		}
+		if q.EndTimestampMs < m.Cutover {
+			oldReq.Queries = append(oldReq.Queries, q)
+			oldIndexes = append(oldIndexes, i)
+			continue
+		}
+		before, after := *q, *q
+		before.EndTimestampMs = m.Cutover - 1
+		after.StartTimestampMs = m.Cutover
+		oldReq.Queries = append(oldReq.Queries, &before)
+		oldIndexes = append(oldIndexes, i)
+		newReq.Queries = append(newReq.Queries, &after)
+		newIndexes = append(newIndexes, i)
+	}
+
+	var oldResp, newResp *remotepb.ReadResponse
+	var oldErr, newErr error
+	var wg sync.WaitGroup
+	if len(oldReq.Queries) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			oldResp, oldErr = m.Old.Query(oldReq)
+		}()
+	}
+	if len(newReq.Queries) > 0 {
+		newResp, newErr = m.New.Query(newReq)
+	}
+	wg.Wait()
+	if newErr != nil {
+		return nil, newErr
+	}
+	if oldErr != nil {
+		return nil, oldErr
+	}
+
+	// The old backend's part of a query comes before the new one's, so its
+	// samples go first.
+	results := make([][][]*remotepb.TimeSeries, len(req.Queries))
+	if oldResp != nil {
+		for i, result := range oldResp.Results {
+			results[oldIndexes[i]] = append(results[oldIndexes[i]], result.Timeseries)
+		}
+	}
+	if newResp != nil {
+		for i, result := range newResp.Results {
+			results[newIndexes[i]] = append(results[newIndexes[i]], result.Timeseries)
+		}
+	}
+	resp := &remotepb.ReadResponse{Results: make([]*remotepb.QueryResult, 0, len(results))}
+	for _, parts := range results {
+		resp.Results = append(resp.Results, &remotepb.QueryResult{Timeseries: promseries.Merge(parts...)})
+	}
+	return resp, nil
+}
+
+// QueryExemplars queries the new backend only: exemplars are short lived,
+// and the backfill copies the old ones.
+func (m *Migration) QueryExemplars(selectors [][]*prompb.LabelMatcher, start int64, end int64) ([]SeriesExemplars, error) {
+	return m.New.QueryExemplars(selectors, start, end)
+}
+
+// Metadata queries the new backend only: Prometheus sends the metadata of
+// every metric again regularly.
+func (m *Migration) Metadata(metric string) ([]*remotepb.MetricMetadata, error) {
+	return m.New.Metadata(metric)
+}
+
+// Backfill copies the history of the old backend to the new one, until it
+// is done or stop is closed. Its progress is recorded in the new backend, so
+// that it resumes where it stopped after a restart. Once done, reads only
+// use the new backend. Its writes stop with ErrFenced once a newer leader
+// than fence took over.
+func (m *Migration) Backfill(fence Fence, stop <-chan struct{}) error {
+	if m.isBackfilled() {
+		return nil
+	}
+	if err := m.New.raiseFence(fence); err != nil {
+		return err
+	}
+	cursor, err := m.New.HGet(migrationKey, "cursor").Uint64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	for {
+		var keys []string
+		keys, cursor, err = m.Old.Scan(cursor, "", backfillPageSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := m.copyKey(key, fence, stop); err != nil {
+				return err
+			}
+			// What was copied of the page is copied again on resuming.
+			if stopped(stop) {
+				return nil
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+		if err := m.write(fence, func(pipe redis.Pipeliner) { pipe.HSet(migrationKey, "cursor", cursor) }); err != nil {
+			return err
+		}
+	}
+
+	if err := m.write(fence, func(pipe redis.Pipeliner) { pipe.HSet(migrationKey, "done", "1") }); err != nil {
+		return err
+	}
+	m.setBackfilled()
+	log.Info("Backfill of the new backend done")
+	return nil
+}
+
+// copyKey copies a series, a sorted set of exemplars or histograms, a set
+// such as a partition index, or a hash such as the metadata, merging it with what dual writes put in the new
+// backend already.
+func (m *Migration) copyKey(key string, fence Fence, stop <-chan struct{}) error {
+	keyType, err := m.Old.Type(key).Result()
+	if err != nil {
+		return err
+	}
+	switch keyType {
+	case "TSDB-TYPE":
+		err = m.copySeries(key, fence, stop)
+	case "zset":
+		err = m.copySortedSet(key, fence, stop)
+	case "set":
+		err = m.copySet(key, fence)
+	case "hash":
+		err = m.copyHash(key, fence)
+	default:
+		log.WithFields(log.Fields{"key": key, "type": keyType}).Debug("Not backfilling key")
+		return nil
+	}
+	if err == redis.Nil {
+		// The key expired or was removed since it was scanned.
+		return nil
+	}
+	if err == nil {
+		backfilledKeys.WithLabelValues(keyType).Inc()
+	}
+	return err
+}
+
+// write runs the commands queued by fn on the new backend, fenced.
+func (m *Migration) write(fence Fence, fn func(pipe redis.Pipeliner)) error {
+	return m.New.fenced(fence, func(tx *redis.Tx) error {
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			fn(pipe)
+			return nil
+		})
+		return err
+	})
+}
+
+// copySeries copies the samples of a series before the cutover, a page at a
+// time until stop is closed. The new backend must accept samples older than
+// those dual writes added, as RedisTimeSeries does since 1.4.
+func (m *Migration) copySeries(key string, fence Fence, stop <-chan struct{}) error {
+	info, err := m.Old.Do("TS.INFO", key).Result()
+	if err != nil {
+		return err
+	}
+	infoSlice, _ := info.([]interface{})
+	retention, err := retentionFromInfo(infoSlice)
+	if err != nil {
+		return err
+	}
+	labels := labelsFromInfo(infoSlice)
+
+	from := int64(0)
+	for !stopped(stop) {
+		samples, err := m.Old.Do("TS.RANGE", key, from, m.Cutover-1, "COUNT", backfillPageSize).Result()
+		if err != nil {
+			return err
+		}
+		page, _ := samples.([]interface{})
+		if len(page) == 0 {
+			return nil
+		}
+
+		err = m.write(fence, func(pipe redis.Pipeliner) {
+			for _, s := range page {
+				sample := s.([]interface{})
+				args := []interface{}{"TS.ADD", key, sample[0], sample[1], "RETENTION", retention, "ON_DUPLICATE", "LAST", "LABELS"}
+				for _, l := range labels {
+					args = append(args, l.Name, l.Value)
+				}
+				pipe.Process(redis.NewStatusCmd(args...))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if len(page) < backfillPageSize {
+			return nil
+		}
+		from = page[len(page)-1].([]interface{})[0].(int64) + 1
+	}
+	return nil
+}
+
+// copySortedSet copies a sorted set a page at a time until stop is closed,
+// with its expiry, as exemplars and histograms expire with their series. An
+// expiry dual writes pushed further already is kept.
+func (m *Migration) copySortedSet(key string, fence Fence, stop <-chan struct{}) error {
+	cursor := uint64(0)
+	for !stopped(stop) {
+		var page []string
+		var err error
+		page, cursor, err = m.Old.ZScan(key, cursor, "", backfillPageSize).Result()
+		if err != nil {
+			return err
+		}
+		members := make([]redis.Z, 0, len(page)/2)
+		for i := 0; i+1 < len(page); i += 2 {
+			score, err := strconv.ParseFloat(page[i+1], 64)
+			if err != nil {
+				return err
+			}
+			members = append(members, redis.Z{Score: score, Member: page[i]})
+		}
+		ttl, err := m.Old.PTTL(key).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			if err := m.copyMembers(key, members, ttl, fence); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// copyMembers adds members to the sorted set at key on the new backend, and
+// sets it to expire in ttl unless it expires later, fenced.
+func (m *Migration) copyMembers(key string, members []redis.Z, ttl time.Duration, fence Fence) error {
+	return m.New.fenced(fence, func(tx *redis.Tx) error {
+		current, err := tx.PTTL(key).Result()
+		if err != nil {
+			return err
+		}
+		// -2ms for a missing key, -1ms for one that does not expire.
+		expire := ttl > 0 && (current == -2*time.Millisecond || current > 0 && current < ttl)
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(key, members...)
+			if expire {
+				pipe.PExpire(key, ttl)
+			}
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (m *Migration) copySet(key string, fence Fence) error {
+	members, err := m.Old.SMembers(key).Result()
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	args := make([]interface{}, 0, len(members))
+	for _, member := range members {
+		args = append(args, member)
+	}
+	return m.write(fence, func(pipe redis.Pipeliner) { pipe.SAdd(key, args...) })
+}
+
+func (m *Migration) copyHash(key string, fence Fence) error {
+	if key == migrationKey {
+		return nil
+	}
+	fields, err := m.Old.HGetAll(key).Result()
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	// Fields written since the cutover are newer than the old ones.
+	return m.write(fence, func(pipe redis.Pipeliner) {
+		for field, value := range fields {
+			pipe.HSetNX(key, field, value)
+		}
+	})
+}
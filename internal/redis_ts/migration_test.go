@@ -0,0 +1,84 @@
+package redis_ts
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigration(t *testing.T) {
+	old := NewClient(redisAddress, redisAuth)
+	new := &Client{Client: redis.NewClient(&redis.Options{Addr: redisAddress, Password: redisAuth, DB: 1})}
+	key := "test_migration{job=api}"
+	old.Del(key)
+	new.Del(key, migrationKey)
+
+	series := func(timestamps ...int64) []*prompb.TimeSeries {
+		ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "test_migration"}, {Name: "job", Value: "api"}}}
+		for _, timestamp := range timestamps {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(timestamp), Timestamp: timestamp})
+		}
+		return []*prompb.TimeSeries{ts}
+	}
+	// Only the old server has the samples before the cutover.
+	assert.NoError(t, old.Write(series(1000)))
+
+	migration, err := NewMigration(old, new, 2000)
+	assert.NoError(t, err)
+	_, err = migration.Ingest(&remotepb.WriteRequest{Timeseries: remotepb.FromPrompb(series(3000))})
+	assert.NoError(t, err)
+
+	query := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   5000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_migration"}},
+	}}}
+	samples := func() []prompb.Sample {
+		resp, err := migration.Query(query)
+		assert.NoError(t, err)
+		if assert.Len(t, resp.Results, 1) && assert.Len(t, resp.Results[0].Timeseries, 1) {
+			return resp.Results[0].Timeseries[0].Samples
+		}
+		return nil
+	}
+	expected := []prompb.Sample{{Value: 1000, Timestamp: 1000}, {Value: 3000, Timestamp: 3000}}
+	assert.Equal(t, expected, samples())
+
+	assert.NoError(t, migration.Backfill(NoFence, make(chan struct{})))
+	assert.True(t, migration.isBackfilled())
+	assert.Equal(t, expected, samples(), "the new server has everything once backfilled")
+	assert.Equal(t, "1", new.HGet(migrationKey, "done").Val())
+}
+
+func TestMigrationSortedSets(t *testing.T) {
+	old := NewClient(redisAddress, redisAuth)
+	new := &Client{Client: redis.NewClient(&redis.Options{Addr: redisAddress, Password: redisAuth, DB: 1})}
+	key := exemplarsKey("test_migration_zset{job=api}")
+	old.Del(key)
+	new.Del(key, migrationKey)
+
+	// More members than a page, expiring.
+	members := make([]redis.Z, 0, 2*backfillPageSize+1)
+	for i := 0; i < cap(members); i++ {
+		members = append(members, redis.Z{Score: float64(i), Member: strconv.Itoa(i)})
+	}
+	assert.NoError(t, old.ZAdd(key, members...).Err())
+	assert.NoError(t, old.PExpire(key, time.Hour).Err())
+
+	migration, err := NewMigration(old, new, 2000)
+	assert.NoError(t, err)
+	assert.NoError(t, migration.Backfill(NoFence, make(chan struct{})))
+	assert.Equal(t, members, new.ZRangeWithScores(key, 0, -1).Val())
+	ttl := new.PTTL(key).Val()
+	assert.True(t, ttl > 0 && ttl <= time.Hour, ttl)
+
+	// An expiry dual writes pushed further is kept.
+	assert.NoError(t, new.PExpire(key, 2*time.Hour).Err())
+	assert.NoError(t, migration.copySortedSet(key, NoFence, make(chan struct{})))
+	assert.True(t, new.PTTL(key).Val() > time.Hour)
+}
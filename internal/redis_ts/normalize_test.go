@@ -0,0 +1,83 @@
+package redis_ts
+
+import (
+	"regexp"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// assertConformant checks series against what Prometheus' remote read client
+// and storage expect of a query result.
+func assertConformant(t *testing.T, series []*remotepb.TimeSeries) {
+	seen := make(map[string]bool)
+	for i, ts := range series {
+		for j, l := range ts.Labels {
+			assert.Regexp(t, labelNamePattern, l.Name)
+			assert.NotEmpty(t, l.Value, "label %s has an empty value", l.Name)
+			assert.True(t, utf8.ValidString(l.Value), "label %s is not valid UTF-8", l.Name)
+			if l.Name == "__name__" {
+				assert.Regexp(t, metricNamePattern, l.Value)
+			}
+			if j > 0 {
+				assert.True(t, ts.Labels[j-1].Name < l.Name, "labels %v are not sorted and unique", ts.Labels)
+			}
+		}
+		key := promseries.LabelsKey(ts.Labels)
+		assert.False(t, seen[key], "labelset %v is returned twice", ts.Labels)
+		seen[key] = true
+		if i > 0 {
+			assert.True(t, promseries.CompareLabels(series[i-1].Labels, ts.Labels) < 0, "series %v and %v are not sorted", series[i-1].Labels, ts.Labels)
+		}
+		for j := 1; j < len(ts.Samples); j++ {
+			assert.True(t, ts.Samples[j-1].Timestamp < ts.Samples[j].Timestamp, "samples of %v are not in time order", ts.Labels)
+		}
+		for j := 1; j < len(ts.Histograms); j++ {
+			assert.True(t, ts.Histograms[j-1].Timestamp < ts.Histograms[j].Timestamp, "histograms of %v are not in time order", ts.Labels)
+		}
+	}
+}
+
+func TestReadConformance(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	client.PartitionPeriod = 24 * time.Hour
+	for _, key := range redisClient.Keys("test_conformance{*").Val() {
+		redisClient.Del(key)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	err := client.Write([]*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "zone", Value: "b"}, {Name: "__name__", Value: "test_conformance"}, {Name: "job", Value: "api"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now - day}, {Value: 2, Timestamp: now}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "test_conformance"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: now}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "test_conformance"}, {Name: "job", Value: "api"}, {Name: "zone", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 4, Timestamp: now}},
+		},
+	})
+	assert.NoError(t, err)
+
+	resp, err := client.Query(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: now - 2*day,
+		EndTimestampMs:   now,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_conformance"}},
+	}}})
+	assert.NoError(t, err)
+	assertConformant(t, resp.Results[0].Timeseries)
+	assert.Len(t, resp.Results[0].Timeseries, 3)
+}
@@ -0,0 +1,249 @@
+package redis_ts
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DefaultReadBatchSize is the series read at once by paginated queries, when
+// ReadBatchSize is not set.
+const DefaultReadBatchSize = 100
+
+var readSubqueries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "redis_ts_adapter_read_subqueries_total",
+	Help: "Commands run to read paginated queries, by batch of series, time window and page.",
+})
+
+// paginated tells whether queries are read in bounded sub-queries.
+func (c *Client) paginated() bool {
+	return c.ReadWindow > 0 || c.ReadPageSize > 0 || c.ReadBatchSize > 0
+}
+
+func (c *Client) readBatchSize() int {
+	if c.ReadBatchSize > 0 {
+		return c.ReadBatchSize
+	}
+	return DefaultReadBatchSize
+}
+
+// readWindows splits [start, end] into consecutive windows of ReadWindow.
+func (c *Client) readWindows(start, end int64) [][2]int64 {
+	window := int64(c.ReadWindow / time.Millisecond)
+	if window <= 0 {
+		return [][2]int64{{start, end}}
+	}
+	var windows [][2]int64
+	for from := start; from <= end; from += window {
+		to := from + window - 1
+		if to > end || to < from {
+			to = end
+		}
+		windows = append(windows, [2]int64{from, to})
+		if to == end {
+			break
+		}
+	}
+	return windows
+}
+
+// listedKey is a key of a series matching a paginated query, with its labels
+// and those of its series.
+type listedKey struct {
+	key    string
+	labels []*prompb.Label
+	// series are the labels of the series, normalized and without the
+	// partition label.
+	series []*prompb.Label
+}
+
+// readBatches splits keys, sorted by series, into batches of at most the read
+// batch size, keeping the partitions of a series in the same batch, so that
+// each batch holds whole series.
+func (c *Client) readBatches(keys []listedKey) [][]listedKey {
+	size := c.readBatchSize()
+	var batches [][]listedKey
+	for len(keys) > 0 {
+		n := size
+		if n > len(keys) {
+			n = len(keys)
+		}
+		for n < len(keys) && promseries.CompareLabels(keys[n].series, keys[n-1].series) == 0 {
+			n++
+		}
+		batches = append(batches, keys[:n])
+		keys = keys[n:]
+	}
+	return batches
+}
+
+// rangePaginated reads the series matching labelMatchers between start and
+// end from server: it lists their keys, then reads them a batch of series at
+// a time, each batch one window at a time, and each series in a window one
+// page at a time. Each batch is passed to emit once read whole, its
+// partitions stitched, batches in the order of their labels. The series and
+// each page of samples are counted with count as they are read.
+func (c *Client) rangePaginated(server *redis.Client, labelMatchers []interface{}, start, end int64, count *readCount, emit func([]*remotepb.TimeSeries) error) error {
+	keys, err := c.listKeys(server, labelMatchers, count)
+	if err != nil {
+		return err
+	}
+	for _, batch := range c.readBatches(keys) {
+		series, err := c.rangeKeys(server, batch, start, end, count)
+		if err != nil {
+			return err
+		}
+		if err := emit(stitchPartitions(series)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listKeys lists the keys of the series matching labelMatchers, then reads
+// their labels a batch at a time, counting the series with count. The keys
+// are returned sorted by the labels of their series, then by key, and those
+// removed meanwhile are left out.
+func (c *Client) listKeys(server *redis.Client, labelMatchers []interface{}, count *readCount) ([]listedKey, error) {
+	index := redis.NewStringSliceCmd(append([]interface{}{"TS.QUERYINDEX"}, labelMatchers...)...)
+	readSubqueries.Inc()
+	if err := server.Process(index); err != nil {
+		return nil, err
+	}
+
+	pipe := server.Pipeline()
+	defer pipe.Close()
+	var keys []listedKey
+	names := index.Val()
+	for from := 0; from < len(names); from += c.readBatchSize() {
+		to := from + c.readBatchSize()
+		if to > len(names) {
+			to = len(names)
+		}
+		infos := make([]*redis.SliceCmd, to-from)
+		for i := range infos {
+			infos[i] = redis.NewSliceCmd("TS.INFO", names[from+i])
+			if err := pipe.Process(infos[i]); err != nil {
+				return nil, err
+			}
+		}
+		readSubqueries.Inc()
+		// Missing keys fail on their own, and are checked below.
+		_, _ = pipe.Exec()
+
+		for i, info := range infos {
+			if err := info.Err(); err != nil {
+				if isMissingKey(err) {
+					continue
+				}
+				return nil, err
+			}
+			labels := labelsFromInfo(info.Val())
+			if err := count.add(labels, 0); err != nil {
+				return nil, err
+			}
+			series, _ := withoutPartition(labels)
+			keys = append(keys, listedKey{key: names[from+i], labels: labels, series: promseries.NormalizeLabels(series)})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if cmp := promseries.CompareLabels(keys[i].series, keys[j].series); cmp != 0 {
+			return cmp < 0
+		}
+		return keys[i].key < keys[j].key
+	})
+	return keys, nil
+}
+
+// rangeKeys reads the samples of the series at keys between start and end,
+// a window and a page at a time, counting them with count. Series removed
+// since their keys were listed are left out.
+func (c *Client) rangeKeys(server *redis.Client, keys []listedKey, start, end int64, count *readCount) ([]*remotepb.TimeSeries, error) {
+	pipe := server.Pipeline()
+	defer pipe.Close()
+	series := make([]*remotepb.TimeSeries, len(keys))
+	for i, key := range keys {
+		series[i] = &remotepb.TimeSeries{Labels: key.labels}
+	}
+	removed := make([]bool, len(keys))
+
+	for _, window := range c.readWindows(start, end) {
+		// The first page of every series, then the next pages of those that
+		// filled theirs.
+		from := make([]int64, len(keys))
+		pending := make([]int, len(keys))
+		for i := range keys {
+			from[i], pending[i] = window[0], i
+		}
+		for len(pending) > 0 {
+			cmds := make([]*redis.SliceCmd, len(pending))
+			for j, i := range pending {
+				args := []interface{}{"TS.RANGE", keys[i].key, from[i], window[1]}
+				if c.ReadPageSize > 0 {
+					args = append(args, "COUNT", c.ReadPageSize)
+				}
+				cmds[j] = redis.NewSliceCmd(args...)
+				if err := pipe.Process(cmds[j]); err != nil {
+					return nil, err
+				}
+			}
+			readSubqueries.Inc()
+			_, _ = pipe.Exec()
+
+			var next []int
+			for j, i := range pending {
+				if err := cmds[j].Err(); err != nil {
+					if isMissingKey(err) {
+						removed[i] = true
+						continue
+					}
+					return nil, err
+				}
+				samples, err := parseSamples(cmds[j].Val())
+				if err != nil {
+					return nil, err
+				}
+				if err := count.add(series[i].Labels, len(samples)); err != nil {
+					return nil, err
+				}
+				series[i].Samples = append(series[i].Samples, samples...)
+				if c.ReadPageSize > 0 && len(samples) == c.ReadPageSize {
+					if from[i] = samples[len(samples)-1].Timestamp + 1; from[i] <= window[1] {
+						next = append(next, i)
+					}
+				}
+			}
+			pending = next
+		}
+	}
+
+	read := series[:0]
+	for i, ts := range series {
+		if !removed[i] {
+			read = append(read, ts)
+		}
+	}
+	return read, nil
+}
+
+// labelsFromInfo extracts the labels of a TS.INFO reply.
+func labelsFromInfo(info []interface{}) []*prompb.Label {
+	for i := 0; i+1 < len(info); i += 2 {
+		if name, ok := info[i].(string); ok && name == "labels" {
+			pairs, _ := info[i+1].([]interface{})
+			return parseLabels(pairs)
+		}
+	}
+	return nil
+}
+
+func isMissingKey(err error) bool {
+	return strings.Contains(err.Error(), "key does not exist")
+}
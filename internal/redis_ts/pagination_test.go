@@ -0,0 +1,88 @@
+package redis_ts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadWindows(t *testing.T) {
+	client := &Client{}
+	assert.Equal(t, [][2]int64{{0, 100}}, client.readWindows(0, 100))
+
+	client.ReadWindow = 40 * time.Millisecond
+	assert.Equal(t, [][2]int64{{0, 39}, {40, 79}, {80, 100}}, client.readWindows(0, 100))
+	assert.Equal(t, [][2]int64{{0, 39}, {40, 79}}, client.readWindows(0, 79))
+	assert.Equal(t, [][2]int64{{5, 5}}, client.readWindows(5, 5))
+}
+
+func TestReadBatches(t *testing.T) {
+	client := &Client{ReadBatchSize: 2}
+	series := func(name string) []*prompb.Label { return []*prompb.Label{{Name: "__name__", Value: name}} }
+	keys := []listedKey{
+		{key: "a{}", series: series("a")},
+		{key: "b{}@20200101T000000Z", series: series("b")},
+		{key: "b{}@20200102T000000Z", series: series("b")},
+		{key: "c{}", series: series("c")},
+		{key: "d{}", series: series("d")},
+	}
+	assert.Equal(t, [][]listedKey{keys[:3], keys[3:]}, client.readBatches(keys))
+	assert.Nil(t, client.readBatches(nil))
+}
+
+func TestReadCount(t *testing.T) {
+	count := newReadCount(readlimit.NewTracker(readlimit.Limits{MaxSeries: 1, MaxSamples: 10}))
+	labels := []*prompb.Label{{Name: "__name__", Value: "up"}}
+	assert.NoError(t, count.add(withLabel(labels, partitionLabel, "20200101T000000Z"), 4))
+	assert.NoError(t, count.add(withLabel(labels, partitionLabel, "20200102T000000Z"), 4))
+	assert.NoError(t, count.add(labels, 2))
+	assert.Equal(t, &readlimit.LimitError{Limit: readlimit.LimitSamples, Max: 10}, count.add(labels, 1))
+
+	count = newReadCount(readlimit.NewTracker(readlimit.Limits{MaxSeries: 1}))
+	assert.NoError(t, count.add(labels, 0))
+	assert.Equal(t, &readlimit.LimitError{Limit: readlimit.LimitSeries, Max: 1}, count.add([]*prompb.Label{{Name: "__name__", Value: "down"}}, 0))
+}
+
+func TestPaginatedRead(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	redisClient.Del("test_paginated{}", "test_paginated{page=2}")
+
+	var samples []prompb.Sample
+	for i := int64(0); i < 25; i++ {
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: 1000 + i*10})
+	}
+	err := client.Write([]*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_paginated"}}, Samples: samples},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_paginated"}, {Name: "page", Value: "2"}}, Samples: samples[20:]},
+	})
+	assert.NoError(t, err)
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   2000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_paginated"}},
+	}}}
+	expected, err := client.Read(req)
+	assert.NoError(t, err)
+	assert.Len(t, expected.Results[0].Timeseries, 2)
+
+	client.ReadWindow = 70 * time.Millisecond
+	client.ReadPageSize = 3
+	resp, err := client.Read(req)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, resp)
+
+	client.ReadBatchSize = 1
+	resp, err = client.Read(req)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, resp)
+
+	client.ReadLimits = readlimit.Limits{MaxSamples: 20}
+	_, err = client.Read(req)
+	var limitErr *readlimit.LimitError
+	assert.True(t, errors.As(err, &limitErr))
+}
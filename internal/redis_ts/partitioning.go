@@ -0,0 +1,252 @@
+package redis_ts
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// partitionLabel holds the start of the period a partition key covers.
+	partitionLabel = "__partition__"
+	// partitionsKey is the sorted set of the periods written, scored by
+	// their end. Each period has a set of its keys, at partitionsKey:period.
+	partitionsKey   = "__partitions__"
+	partitionFormat = "20060102T150405Z"
+	// dropPageSize bounds the keys unlinked at once.
+	dropPageSize = 1000
+)
+
+var (
+	droppedPartitions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_dropped_partitions_total",
+		Help: "Periods of partitioned series dropped.",
+	})
+	droppedPartitionKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_dropped_partition_keys_total",
+		Help: "Series keys unlinked with the periods they belonged to.",
+	})
+)
+
+func partitionIndexKey(period string) string {
+	return partitionsKey + ":" + period
+}
+
+// partitionOf returns the name and end, in ms, of the period holding
+// timestamp.
+func (c *Client) partitionOf(timestamp int64) (string, int64) {
+	period := int64(c.PartitionPeriod / time.Millisecond)
+	start := timestamp - promseries.Mod(timestamp, period)
+	return time.Unix(0, start*int64(time.Millisecond)).UTC().Format(partitionFormat), start + period
+}
+
+// seriesPart is what a request writes to one key of a series.
+type seriesPart struct {
+	key string
+	// period and end are those of a partition key, in ms.
+	period     string
+	end        int64
+	labels     []*prompb.Label
+	samples    []prompb.Sample
+	histograms []remotepb.Histogram
+	exemplars  []remotepb.Exemplar
+}
+
+// partitionIndex records the partition keys written, once per pipeline.
+type partitionIndex map[string]bool
+
+// add records the key of part in its period, once its writes are queued.
+// Recording it after them means that a key a drop of its period raced with
+// is recorded again, and dropped with the period next time.
+func (index partitionIndex) add(pipe redis.Pipeliner, part *seriesPart) {
+	if part.period == "" || index[part.key] {
+		return
+	}
+	index[part.key] = true
+	pipe.SAdd(partitionIndexKey(part.period), part.key)
+	pipe.ZAdd(partitionsKey, redis.Z{Score: float64(part.end), Member: part.period})
+}
+
+// partition splits what ts writes to the series at key by period, when
+// series are partitioned. Their keys are recorded by partitionIndex.add.
+func (c *Client) partition(key string, ts *remotepb.TimeSeries, samples []prompb.Sample) []*seriesPart {
+	if c.PartitionPeriod <= 0 {
+		return []*seriesPart{{key: key, labels: ts.Labels, samples: samples, histograms: ts.Histograms, exemplars: ts.Exemplars}}
+	}
+
+	var parts []*seriesPart
+	byPeriod := make(map[string]*seriesPart)
+	partOf := func(timestamp int64) *seriesPart {
+		period, end := c.partitionOf(timestamp)
+		part, ok := byPeriod[period]
+		if !ok {
+			part = &seriesPart{key: key + "@" + period, period: period, end: end, labels: withLabel(ts.Labels, partitionLabel, period)}
+			byPeriod[period] = part
+			parts = append(parts, part)
+		}
+		return part
+	}
+	for _, s := range samples {
+		part := partOf(s.Timestamp)
+		part.samples = append(part.samples, s)
+	}
+	for _, h := range ts.Histograms {
+		part := partOf(h.Timestamp)
+		part.histograms = append(part.histograms, h)
+	}
+	for _, e := range ts.Exemplars {
+		part := partOf(e.Timestamp)
+		part.exemplars = append(part.exemplars, e)
+	}
+	return parts
+}
+
+// withoutPartition returns labels without the partition label, and whether
+// it was there.
+func withoutPartition(labels []*prompb.Label) ([]*prompb.Label, bool) {
+	for i, l := range labels {
+		if l.Name == partitionLabel {
+			result := make([]*prompb.Label, 0, len(labels)-1)
+			result = append(result, labels[:i]...)
+			return append(result, labels[i+1:]...), true
+		}
+	}
+	return labels, false
+}
+
+// stitchPartitions joins the partitions of each series into one series, in
+// time order. Series that are not partitioned are returned as they are.
+func stitchPartitions(series []*remotepb.TimeSeries) []*remotepb.TimeSeries {
+	var order []string
+	groups := make(map[string][]*remotepb.TimeSeries)
+	partitioned := make(map[string]bool)
+	for _, ts := range series {
+		labels, ok := withoutPartition(ts.Labels)
+		key := promseries.LabelsKey(labels)
+		if _, seen := groups[key]; !seen {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], ts)
+		partitioned[key] = partitioned[key] || ok
+	}
+
+	stitched := make([]*remotepb.TimeSeries, 0, len(order))
+	for _, key := range order {
+		parts := groups[key]
+		if !partitioned[key] && len(parts) == 1 {
+			stitched = append(stitched, parts[0])
+			continue
+		}
+		labels, _ := withoutPartition(parts[0].Labels)
+		ts := &remotepb.TimeSeries{Labels: labels}
+		for _, part := range parts {
+			ts.Samples = append(ts.Samples, part.Samples...)
+			ts.Histograms = append(ts.Histograms, part.Histograms...)
+		}
+		sort.SliceStable(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+		sort.SliceStable(ts.Histograms, func(i, j int) bool { return ts.Histograms[i].Timestamp < ts.Histograms[j].Timestamp })
+		stitched = append(stitched, ts)
+	}
+	return stitched
+}
+
+// DropPartitions unlinks every key of the periods that ended at or before
+// until, in ms, and returns how many periods it dropped, until done or stop
+// is closed. Running it from several adapters at once is safe. It stops with
+// ErrFenced once a newer leader than fence took over.
+func (c *Client) DropPartitions(until int64, fence Fence, stop <-chan struct{}) (int, error) {
+	if err := c.raiseFence(fence); err != nil {
+		return 0, err
+	}
+	periods, err := c.ZRangeByScore(partitionsKey, redis.ZRangeBy{Min: "-inf", Max: formatScore(until)}).Result()
+	if err != nil {
+		return 0, err
+	}
+	for i, period := range periods {
+		dropped, err := c.dropPartition(period, fence, stop)
+		if err != nil || !dropped {
+			return i, err
+		}
+		droppedPartitions.Inc()
+		log.WithFields(log.Fields{"period": period}).Info("Dropped partition")
+	}
+	return len(periods), nil
+}
+
+// dropPartition unlinks the keys of period, removing them from its index as
+// it goes, and forgets the period once its index is empty. Late writes may
+// record keys meanwhile: they are dropped too, or if they come after the
+// period was forgotten, they record it again for the next drop. It returns
+// whether the period was dropped before stop was closed.
+func (c *Client) dropPartition(period string, fence Fence, stop <-chan struct{}) (bool, error) {
+	indexKey := partitionIndexKey(period)
+	for {
+		done, err := c.dropPartitionKeys(indexKey, fence, stop)
+		if err != nil || !done {
+			return false, err
+		}
+		err = c.fenced(fence, func(tx *redis.Tx) error {
+			left, err := tx.SCard(indexKey).Result()
+			if err != nil {
+				return err
+			}
+			if left > 0 {
+				return errPartitionWritten
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Unlink(indexKey)
+				pipe.ZRem(partitionsKey, period)
+				return nil
+			})
+			return err
+		}, indexKey)
+		if err != errPartitionWritten {
+			return err == nil, err
+		}
+	}
+}
+
+// errPartitionWritten tells that keys were recorded in a period being
+// dropped.
+var errPartitionWritten = errors.New("partition written while dropped")
+
+// dropPartitionKeys unlinks the keys recorded in indexKey, a page at a time,
+// and returns whether it unlinked them all before stop was closed.
+func (c *Client) dropPartitionKeys(indexKey string, fence Fence, stop <-chan struct{}) (bool, error) {
+	for !stopped(stop) {
+		// Unlinked keys leave the index, so any of those left will do.
+		keys, err := c.SRandMemberN(indexKey, dropPageSize).Result()
+		if err != nil || len(keys) == 0 {
+			return err == nil, err
+		}
+		unlinked := make([]string, 0, 5*len(keys))
+		members := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			unlinked = append(unlinked, key, exemplarsKey(key),
+				key+histogramCountSuffix, key+histogramSumSuffix, key+histogramsKeySuffix)
+			members = append(members, key)
+		}
+		err = c.fenced(fence, func(tx *redis.Tx) error {
+			_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Unlink(unlinked...)
+				pipe.SRem(indexKey, members...)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		c.retentions.forget(unlinked...)
+		droppedPartitionKeys.Add(float64(len(keys)))
+	}
+	return false, nil
+}
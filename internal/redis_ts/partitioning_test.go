@@ -0,0 +1,99 @@
+package redis_ts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+const day = int64(24 * time.Hour / time.Millisecond)
+
+func TestPartition(t *testing.T) {
+	client := &Client{PartitionPeriod: 24 * time.Hour}
+	period, end := client.partitionOf(day + 5)
+	assert.Equal(t, "19700102T000000Z", period)
+	assert.Equal(t, 2*day, end)
+	period, _ = client.partitionOf(-1)
+	assert.Equal(t, "19691231T000000Z", period)
+
+	pipe := redisClient.Pipeline()
+	defer pipe.Close()
+	ts := &remotepb.TimeSeries{
+		Labels:     []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Histograms: []remotepb.Histogram{{Timestamp: 2*day + 1}},
+	}
+	samples := []prompb.Sample{{Value: 1, Timestamp: 10}, {Value: 2, Timestamp: day + 10}, {Value: 3, Timestamp: 20}}
+	index := make(partitionIndex)
+	parts := client.partition("up{}", ts, samples)
+	assert.Len(t, parts, 3)
+	assert.Equal(t, "up{}@19700101T000000Z", parts[0].key)
+	assert.Equal(t, []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: partitionLabel, Value: "19700101T000000Z"}}, parts[0].labels)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 10}, {Value: 3, Timestamp: 20}}, parts[0].samples)
+	assert.Equal(t, []prompb.Sample{{Value: 2, Timestamp: day + 10}}, parts[1].samples)
+	assert.Equal(t, "up{}@19700103T000000Z", parts[2].key)
+	assert.Len(t, parts[2].histograms, 1)
+	for _, part := range parts {
+		index.add(pipe, part)
+	}
+	assert.Len(t, index, 3)
+
+	client.PartitionPeriod = 0
+	parts = client.partition("up{}", ts, samples)
+	index.add(pipe, parts[0])
+	assert.Len(t, parts, 1)
+	assert.Len(t, index, 3, "keys that are not partitioned are not recorded")
+	assert.Equal(t, "up{}", parts[0].key)
+	assert.Equal(t, samples, parts[0].samples)
+}
+
+func TestStitchPartitions(t *testing.T) {
+	name := &prompb.Label{Name: "__name__", Value: "up"}
+	other := &remotepb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "other"}}, Samples: []prompb.Sample{{Value: 9, Timestamp: 1}}}
+	series := []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{name, {Name: partitionLabel, Value: "19700102T000000Z"}}, Samples: []prompb.Sample{{Value: 2, Timestamp: day}}},
+		other,
+		{Labels: []*prompb.Label{name, {Name: partitionLabel, Value: "19700101T000000Z"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+		// Written before the series was partitioned.
+		{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 0, Timestamp: 0}}},
+	}
+
+	assert.Equal(t, []*remotepb.TimeSeries{
+		{Labels: []*prompb.Label{name}, Samples: []prompb.Sample{{Value: 0, Timestamp: 0}, {Value: 1, Timestamp: 1}, {Value: 2, Timestamp: day}}},
+		other,
+	}, stitchPartitions(series))
+}
+
+func TestWriteReadAndDropPartitions(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	client.PartitionPeriod = 24 * time.Hour
+	for _, key := range redisClient.Keys("test_partitioned{}@*").Val() {
+		redisClient.Del(key)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	err := client.Write([]*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "test_partitioned"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: now - 2*day}, {Value: 2, Timestamp: now - day}, {Value: 3, Timestamp: now}},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, redisClient.Keys("test_partitioned{}@*").Val(), 3)
+
+	resp, err := client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: now - 3*day,
+		EndTimestampMs:   now,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_partitioned"}},
+	}}})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Results[0].Timeseries, 1)
+	assert.Equal(t, []*prompb.Label{{Name: "__name__", Value: "test_partitioned"}}, resp.Results[0].Timeseries[0].Labels)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: now - 2*day}, {Value: 2, Timestamp: now - day}, {Value: 3, Timestamp: now}},
+		resp.Results[0].Timeseries[0].Samples)
+
+	// Only the oldest period ended before yesterday's sample.
+	_, err = client.DropPartitions(now-day, NoFence, nil)
+	assert.NoError(t, err)
+	assert.Len(t, redisClient.Keys("test_partitioned{}@*").Val(), 2)
+}
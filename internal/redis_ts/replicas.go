@@ -0,0 +1,231 @@
+package redis_ts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// heartbeatKeyPrefix starts the key each adapter reading from replicas
+// writes its clock to on the master, to tell how far behind each replica is.
+const heartbeatKeyPrefix = "__replication_heartbeat__:"
+
+var (
+	replicaLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_ts_adapter_replica_lag_seconds",
+		Help: "How far behind the master each replica is, from the replication heartbeat.",
+	}, []string{"replica"})
+	replicaReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_replica_reads_total",
+		Help: "Queries read with replica reads enabled, by target: replica, or master when no replica could serve them.",
+	}, []string{"target"})
+)
+
+// ReplicaConfig configures reads from the replicas of a Sentinel master.
+type ReplicaConfig struct {
+	SentinelAddrs []string
+	MasterName    string
+	Password      string
+	// MaxStaleness is how far behind the master a replica may be and still
+	// serve reads.
+	MaxStaleness time.Duration
+	// CheckInterval is how often replicas are discovered, and their lag
+	// measured.
+	CheckInterval time.Duration
+}
+
+// replicas finds the replicas of the master through Sentinel, and hands out
+// those that lag little enough.
+type replicas struct {
+	cfg          ReplicaConfig
+	heartbeatKey string
+
+	mu      sync.RWMutex
+	clients map[string]*redis.Client
+	healthy []*redis.Client
+	next    uint32
+}
+
+// ReadFromReplicas sends the reads of series to the replicas of the master,
+// chosen in turn among those lagging at most cfg.MaxStaleness behind, once
+// WatchReplicas found them. Reads go to the master while there is none.
+func (c *Client) ReadFromReplicas(cfg ReplicaConfig) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	c.replicas = &replicas{
+		cfg:          cfg,
+		heartbeatKey: heartbeatKeyPrefix + hex.EncodeToString(id),
+		clients:      make(map[string]*redis.Client),
+	}
+	return nil
+}
+
+// WatchReplicas checks the replicas every check interval until stop is
+// closed.
+func (c *Client) WatchReplicas(stop <-chan struct{}) {
+	if c.replicas == nil {
+		return
+	}
+	ticker := time.NewTicker(c.replicas.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.checkReplicas(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("Could not check replicas")
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			c.replicas.close()
+			return
+		}
+	}
+}
+
+// checkReplicas compares the heartbeat each replica has with the master's,
+// keeps those close enough, and writes the next heartbeat. The lag is thus
+// measured in check intervals.
+func (c *Client) checkReplicas() error {
+	r := c.replicas
+	addrs, err := r.discover()
+	if err != nil {
+		r.setHealthy(nil)
+		return err
+	}
+	written, err := c.Get(r.heartbeatKey).Int64()
+	if err != nil && err != redis.Nil {
+		r.setHealthy(nil)
+		return err
+	}
+
+	var healthy []*redis.Client
+	if err == nil {
+		for _, addr := range addrs {
+			client := r.client(addr)
+			replicated, err := client.Get(r.heartbeatKey).Int64()
+			if err != nil {
+				log.WithFields(log.Fields{"replica": addr, "err": err}).Debug("Could not read the replication heartbeat")
+				replicaLag.DeleteLabelValues(addr)
+				continue
+			}
+			lag := time.Duration(written-replicated) * time.Millisecond
+			replicaLag.WithLabelValues(addr).Set(lag.Seconds())
+			if lag <= r.cfg.MaxStaleness {
+				healthy = append(healthy, client)
+			}
+		}
+	}
+	r.setHealthy(healthy)
+	r.forget(addrs)
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	return c.Set(r.heartbeatKey, now, 10*r.cfg.CheckInterval+r.cfg.MaxStaleness).Err()
+}
+
+// discover asks the Sentinels in turn for the replicas of the master that
+// are up and connected to it.
+func (r *replicas) discover() ([]string, error) {
+	var lastErr error
+	for _, sentinelAddr := range r.cfg.SentinelAddrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{Addr: sentinelAddr})
+		cmd := redis.NewSliceCmd("SENTINEL", "slaves", r.cfg.MasterName)
+		lastErr = sentinel.Process(cmd)
+		sentinel.Close()
+		if lastErr != nil {
+			continue
+		}
+		var addrs []string
+		for _, reply := range cmd.Val() {
+			fields, ok := reply.([]interface{})
+			if !ok {
+				continue
+			}
+			if addr, ok := replicaAddr(fields); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs, nil
+	}
+	return nil, lastErr
+}
+
+// replicaAddr returns the address of a replica from its SENTINEL slaves
+// fields, unless Sentinel sees it down or disconnected from the master.
+func replicaAddr(fields []interface{}) (string, bool) {
+	values := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		values[name] = value
+	}
+	for _, flag := range strings.Split(values["flags"], ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return "", false
+		}
+	}
+	if values["master-link-status"] != "ok" || values["ip"] == "" || values["port"] == "" {
+		return "", false
+	}
+	return net.JoinHostPort(values["ip"], values["port"]), true
+}
+
+func (r *replicas) client(addr string) *redis.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[addr]
+	if !ok {
+		client = redis.NewClient(&redis.Options{Addr: addr, Password: r.cfg.Password})
+		r.clients[addr] = client
+	}
+	return client
+}
+
+func (r *replicas) setHealthy(healthy []*redis.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.healthy = healthy
+}
+
+// forget closes the clients of the replicas Sentinel no longer lists.
+func (r *replicas) forget(addrs []string) {
+	listed := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		listed[addr] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, client := range r.clients {
+		if !listed[addr] {
+			client.Close()
+			delete(r.clients, addr)
+			replicaLag.DeleteLabelValues(addr)
+		}
+	}
+}
+
+// pick returns one of the healthy replicas, in turn, or nil if there is
+// none.
+func (r *replicas) pick() *redis.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.healthy) == 0 {
+		return nil
+	}
+	return r.healthy[atomic.AddUint32(&r.next, 1)%uint32(len(r.healthy))]
+}
+
+func (r *replicas) close() {
+	r.setHealthy(nil)
+	r.forget(nil)
+}
@@ -0,0 +1,80 @@
+package redis_ts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaAddr(t *testing.T) {
+	fields := func(pairs ...string) []interface{} {
+		result := make([]interface{}, 0, len(pairs))
+		for _, p := range pairs {
+			result = append(result, p)
+		}
+		return result
+	}
+	addr, ok := replicaAddr(fields("name", "10.0.0.2:6379", "ip", "10.0.0.2", "port", "6379", "flags", "slave", "master-link-status", "ok"))
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2:6379", addr)
+
+	_, ok = replicaAddr(fields("ip", "10.0.0.2", "port", "6379", "flags", "slave,s_down", "master-link-status", "ok"))
+	assert.False(t, ok)
+	_, ok = replicaAddr(fields("ip", "10.0.0.2", "port", "6379", "flags", "slave", "master-link-status", "err"))
+	assert.False(t, ok)
+	_, ok = replicaAddr(fields("ip", "::1", "port", "6380", "flags", "slave", "master-link-status", "ok"))
+	assert.True(t, ok)
+}
+
+func TestPickReplica(t *testing.T) {
+	r := &replicas{}
+	assert.Nil(t, r.pick())
+
+	a := redis.NewClient(&redis.Options{Addr: "a:6379"})
+	b := redis.NewClient(&redis.Options{Addr: "b:6379"})
+	r.setHealthy([]*redis.Client{a, b})
+	picked := map[*redis.Client]int{}
+	for i := 0; i < 4; i++ {
+		picked[r.pick()]++
+	}
+	assert.Equal(t, map[*redis.Client]int{a: 2, b: 2}, picked)
+}
+
+func TestReadFromReplicas(t *testing.T) {
+	client := NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    sentinelMasterName,
+		SentinelAddrs: []string{sentinelAddress},
+	})
+	err := client.ReadFromReplicas(ReplicaConfig{
+		SentinelAddrs: []string{sentinelAddress},
+		MasterName:    sentinelMasterName,
+		MaxStaleness:  time.Second,
+		CheckInterval: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	client.Del("test_replicas{}")
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	series := []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "test_replicas"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+	}}
+	assert.NoError(t, client.Write(series))
+
+	// The first check only writes the heartbeat.
+	assert.NoError(t, client.checkReplicas())
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, client.checkReplicas())
+	assert.NotNil(t, client.replicas.pick(), "a replica is in sync")
+
+	resp, err := client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: now,
+		EndTimestampMs:   now,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_replicas"}},
+	}}})
+	assert.NoError(t, err)
+	assert.Equal(t, series, resp.Results[0].Timeseries)
+	client.replicas.close()
+}
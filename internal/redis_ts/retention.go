@@ -0,0 +1,149 @@
+package redis_ts
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Data kept outside of RedisTimeSeries, like exemplars, lives in sorted sets
+// scored by timestamp. They follow the retention of the series they belong
+// to: each write drops entries older than one retention period before the
+// newest one, and pushes the set's expiry to one retention period ahead.
+
+var errMissingRetention = errors.New("TS.INFO reply has no retentionTime")
+
+// maxCachedRetentions bounds the series whose retention is cached. Beyond,
+// an arbitrary one is forgotten, and looked up again on its next write.
+const maxCachedRetentions = 100000
+
+// retentionCache remembers the retention of series, as reported by TS.INFO.
+type retentionCache struct {
+	mu         sync.RWMutex
+	retentions map[string]int64
+}
+
+func (r *retentionCache) get(key string) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	retention, ok := r.retentions[key]
+	return retention, ok
+}
+
+func (r *retentionCache) set(key string, retention int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retentions == nil {
+		r.retentions = make(map[string]int64)
+	}
+	if _, ok := r.retentions[key]; !ok && len(r.retentions) >= maxCachedRetentions {
+		for evicted := range r.retentions {
+			delete(r.retentions, evicted)
+			break
+		}
+	}
+	r.retentions[key] = retention
+}
+
+// forget drops the retentions of deleted series.
+func (r *retentionCache) forget(keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.retentions, key)
+	}
+}
+
+// retentionLookups are the TS.INFO commands queued on a write pipeline, for
+// series whose retention is not cached yet, with the trims waiting for them.
+type retentionLookups map[string]*retentionLookup
+
+type retentionLookup struct {
+	info  *redis.SliceCmd
+	trims []retentionTrim
+}
+
+type retentionTrim struct {
+	setKey string
+	newest int64
+}
+
+// trimToRetention queues the commands that bound setKey to the retention of
+// seriesKey. When the retention is not cached yet, it is looked up on the
+// same pipeline, and the trim applied by applyRetentions once it has run.
+func (c *Client) trimToRetention(pipe redis.Pipeliner, lookups retentionLookups, seriesKey string, setKey string, newest int64) error {
+	retention, ok := c.retentions.get(seriesKey)
+	if !ok {
+		lookup, queued := lookups[seriesKey]
+		if !queued {
+			lookup = &retentionLookup{info: redis.NewSliceCmd("TS.INFO", seriesKey)}
+			if err := pipe.Process(lookup.info); err != nil {
+				return err
+			}
+			lookups[seriesKey] = lookup
+		}
+		lookup.trims = append(lookup.trims, retentionTrim{setKey: setKey, newest: newest})
+		return nil
+	}
+	trim(pipe, setKey, newest, retention)
+	return nil
+}
+
+func trim(pipe redis.Pipeliner, setKey string, newest int64, retention int64) {
+	if retention > 0 {
+		pipe.ZRemRangeByScore(setKey, "-inf", "("+formatScore(newest-retention))
+		pipe.PExpire(setKey, time.Duration(retention)*time.Millisecond)
+	}
+}
+
+// applyRetentions caches the retentions looked up by an executed pipeline,
+// and applies the trims that waited for them.
+func (c *Client) applyRetentions(lookups retentionLookups) {
+	if len(lookups) == 0 {
+		return
+	}
+	pipe := c.Pipeline()
+	defer pipe.Close()
+	for key, lookup := range lookups {
+		err := lookup.info.Err()
+		var retention int64
+		if err == nil {
+			retention, err = retentionFromInfo(lookup.info.Val())
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"key": key, "err": err}).Debug("Could not read series retention")
+			continue
+		}
+		c.retentions.set(key, retention)
+		for _, t := range lookup.trims {
+			trim(pipe, t.setKey, t.newest, retention)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Could not trim to series retention")
+	}
+}
+
+// retentionFromInfo extracts retentionTime from a TS.INFO reply.
+func retentionFromInfo(info []interface{}) (int64, error) {
+	for i := 0; i+1 < len(info); i += 2 {
+		if name, ok := info[i].(string); ok && name == "retentionTime" {
+			switch retention := info[i+1].(type) {
+			case int64:
+				return retention, nil
+			case string:
+				return strconv.ParseInt(retention, 10, 64)
+			}
+		}
+	}
+	return 0, errMissingRetention
+}
+
+// formatScore formats a timestamp as a sorted set score bound.
+func formatScore(timestamp int64) string {
+	return strconv.FormatInt(timestamp, 10)
+}
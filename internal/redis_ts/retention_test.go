@@ -0,0 +1,34 @@
+package redis_ts
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionFromInfo(t *testing.T) {
+	retention, err := retentionFromInfo([]interface{}{"totalSamples", int64(3), "retentionTime", int64(60000), "chunkCount", int64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(60000), retention)
+
+	_, err = retentionFromInfo([]interface{}{"totalSamples", int64(3)})
+	assert.NotNil(t, err)
+}
+
+func TestRetentionCacheBound(t *testing.T) {
+	var cache retentionCache
+	for i := 0; i < maxCachedRetentions+10; i++ {
+		cache.set(strconv.Itoa(i), int64(i))
+	}
+	assert.Len(t, cache.retentions, maxCachedRetentions)
+
+	cache.set("kept", 1000)
+	retention, ok := cache.get("kept")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1000), retention)
+
+	cache.forget("kept", "missing")
+	_, ok = cache.get("kept")
+	assert.False(t, ok)
+}
@@ -0,0 +1,174 @@
+package redis_ts
+
+import (
+	"strings"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Stream reads the float series matching q, as Query does, but passes them
+// to emit as they are read, in the order of their labels, instead of
+// returning them: a batch of series at a time when reads are paginated, all
+// of them at once otherwise. What the head holds is counted against tracker
+// first, then what Redis returns as it is parsed. Native histograms are left out: queries HasHistograms
+// finds some for are to be read with Query.
+func (c *Client) Stream(q *prompb.Query, tracker *readlimit.Tracker, emit func(*remotepb.TimeSeries) error) error {
+	labelMatchers, err := labelMatchers(q.Matchers)
+	if err != nil {
+		return err
+	}
+	headSeries, older := c.splitHead(q)
+	merge := &seriesMerge{head: promseries.Merge(floatSeries(headSeries)), emit: emit}
+	if older == nil {
+		if err := newReadCount(tracker).addSeries(merge.head); err != nil {
+			return err
+		}
+		return merge.finish()
+	}
+	err = c.readRedis(func(server *redis.Client, count *readCount) error {
+		if err := count.addSeries(merge.head); err != nil {
+			return err
+		}
+		return c.rangeFloats(server, older, labelMatchers, count, merge.batch)
+	}, tracker, func() bool { return !merge.emitted })
+	if err != nil {
+		return err
+	}
+	return merge.finish()
+}
+
+// HasHistograms tells whether native histograms match q, in which case
+// Stream would leave them out.
+func (c *Client) HasHistograms(q *prompb.Query) (bool, error) {
+	labelMatchers, err := labelMatchers(q.Matchers)
+	if err != nil {
+		return false, err
+	}
+	headSeries, older := c.splitHead(q)
+	for _, ts := range headSeries {
+		if len(ts.Histograms) > 0 {
+			return true, nil
+		}
+	}
+	if older == nil {
+		return false, nil
+	}
+	found := false
+	err = c.readRedis(func(server *redis.Client, _ *readCount) error {
+		found, err = hasHistograms(server, older, labelMatchers)
+		return err
+	}, nil, nil)
+	return found, err
+}
+
+// hasHistograms tells whether a histogram series matching labelMatchers has
+// histograms in the range of q on server.
+func hasHistograms(server *redis.Client, q *prompb.Query, labelMatchers []interface{}) (bool, error) {
+	args := append([]interface{}{"TS.QUERYINDEX"}, labelMatchers...)
+	index := redis.NewStringSliceCmd(append(args, histogramLabel+"=count")...)
+	if err := server.Process(index); err != nil {
+		return false, err
+	}
+	if len(index.Val()) == 0 {
+		return false, nil
+	}
+	pipe := server.Pipeline()
+	defer pipe.Close()
+	counts := make([]*redis.IntCmd, 0, len(index.Val()))
+	for _, countKey := range index.Val() {
+		key := strings.TrimSuffix(countKey, histogramCountSuffix)
+		counts = append(counts, pipe.ZCount(key+histogramsKeySuffix, formatScore(q.StartTimestampMs), formatScore(q.EndTimestampMs)))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return false, err
+	}
+	for _, count := range counts {
+		if count.Val() > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rangeFloats reads the float series matching q from server, passing them to
+// emit a batch at a time.
+func (c *Client) rangeFloats(server *redis.Client, q *prompb.Query, labelMatchers []interface{}, count *readCount, emit func([]*remotepb.TimeSeries) error) error {
+	floatMatchers := append(labelMatchers[:len(labelMatchers):len(labelMatchers)], histogramLabel+"=")
+	if c.paginated() {
+		return c.rangePaginated(server, floatMatchers, q.StartTimestampMs, q.EndTimestampMs, count, emit)
+	}
+	cmd := c.rangeByLabels(floatMatchers, q.StartTimestampMs, q.EndTimestampMs, 0)
+	if err := server.Process(cmd); err != nil {
+		return err
+	}
+	timeSeries, err := parseRange(cmd, count)
+	if err != nil {
+		return err
+	}
+	return emit(stitchPartitions(timeSeries))
+}
+
+// floatSeries returns the series of head reads with float samples, without
+// their histograms.
+func floatSeries(series []*remotepb.TimeSeries) []*remotepb.TimeSeries {
+	floats := make([]*remotepb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		if len(ts.Samples) > 0 {
+			floats = append(floats, &remotepb.TimeSeries{Labels: ts.Labels, Samples: ts.Samples})
+		}
+	}
+	return floats
+}
+
+// seriesMerge passes batches of series read from Redis, in the order of
+// their labels, on to emit, with the series of the head merged into them in
+// order.
+type seriesMerge struct {
+	// head holds the normalized head series not passed on yet.
+	head    []*remotepb.TimeSeries
+	emit    func(*remotepb.TimeSeries) error
+	emitted bool
+}
+
+// batch passes on the series of batch, after the head series ordered before
+// them.
+func (m *seriesMerge) batch(batch []*remotepb.TimeSeries) error {
+	for _, ts := range promseries.Merge(batch) {
+		for len(m.head) > 0 {
+			cmp := promseries.CompareLabels(m.head[0].Labels, ts.Labels)
+			if cmp > 0 {
+				break
+			}
+			if cmp == 0 {
+				ts = promseries.Merge([]*remotepb.TimeSeries{ts, m.head[0]})[0]
+			} else if err := m.send(m.head[0]); err != nil {
+				return err
+			}
+			m.head = m.head[1:]
+		}
+		if err := m.send(ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish passes on the head series left.
+func (m *seriesMerge) finish() error {
+	for _, ts := range m.head {
+		if err := m.send(ts); err != nil {
+			return err
+		}
+	}
+	m.head = nil
+	return nil
+}
+
+func (m *seriesMerge) send(ts *remotepb.TimeSeries) error {
+	m.emitted = true
+	return m.emit(ts)
+}
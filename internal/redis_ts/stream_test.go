@@ -0,0 +1,114 @@
+package redis_ts
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/readlimit"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesMerge(t *testing.T) {
+	series := func(name string, timestamps ...int64) *remotepb.TimeSeries {
+		ts := &remotepb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: name}}}
+		for _, timestamp := range timestamps {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: timestamp})
+		}
+		return ts
+	}
+	var emitted []*remotepb.TimeSeries
+	merge := &seriesMerge{
+		head: []*remotepb.TimeSeries{series("a", 9), series("c", 9), series("e", 9)},
+		emit: func(ts *remotepb.TimeSeries) error {
+			emitted = append(emitted, ts)
+			return nil
+		},
+	}
+	assert.NoError(t, merge.batch([]*remotepb.TimeSeries{series("c", 1), series("b", 1)}))
+	assert.True(t, merge.emitted)
+	assert.NoError(t, merge.batch([]*remotepb.TimeSeries{series("d", 1)}))
+	assert.NoError(t, merge.finish())
+	assert.Equal(t, []*remotepb.TimeSeries{
+		series("a", 9), series("b", 1), series("c", 1, 9), series("d", 1), series("e", 9),
+	}, emitted)
+}
+
+func TestStream(t *testing.T) {
+	client := NewClient(redisAddress, redisAuth)
+	redisClient.Del("test_stream{}", "test_stream{page=2}", "test_stream{page=3}")
+
+	var samples []prompb.Sample
+	for i := int64(0); i < 25; i++ {
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: 1000 + i*10})
+	}
+	err := client.Write([]*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_stream"}, {Name: "page", Value: "3"}}, Samples: samples[:5]},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_stream"}}, Samples: samples},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test_stream"}, {Name: "page", Value: "2"}}, Samples: samples[20:]},
+	})
+	assert.NoError(t, err)
+
+	q := &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   2000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_stream"}},
+	}
+	expected, err := client.Query(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+	assert.NoError(t, err)
+	assert.Len(t, expected.Results[0].Timeseries, 3)
+
+	stream := func() ([]*remotepb.TimeSeries, error) {
+		var streamed []*remotepb.TimeSeries
+		err := client.Stream(q, readlimit.NewTracker(client.ReadLimits), func(ts *remotepb.TimeSeries) error {
+			streamed = append(streamed, ts)
+			return nil
+		})
+		return streamed, err
+	}
+	streamed, err := stream()
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Results[0].Timeseries, streamed)
+
+	client.ReadPageSize = 3
+	client.ReadBatchSize = 1
+	streamed, err = stream()
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Results[0].Timeseries, streamed)
+	assertConformant(t, streamed)
+
+	client.ReadLimits = readlimit.Limits{MaxSeries: 2}
+	_, err = stream()
+	assert.Equal(t, &readlimit.LimitError{Limit: readlimit.LimitSeries, Max: 2}, err)
+}
+
+func TestHasHistograms(t *testing.T) {
+	key := "test_stream_histogram{}"
+	redisClient.Del(key+histogramCountSuffix, key+histogramSumSuffix, key+histogramsKeySuffix)
+	client := NewClient(redisAddress, redisAuth)
+	_, err := client.Ingest(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{{
+		Labels:     []*prompb.Label{{Name: "__name__", Value: "test_stream_histogram"}},
+		Histograms: []remotepb.Histogram{testHistogram(1000)},
+	}}})
+	assert.NoError(t, err)
+
+	query := func(name string, start, end int64) *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: start,
+			EndTimestampMs:   end,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name}},
+		}
+	}
+	for _, test := range []struct {
+		q        *prompb.Query
+		expected bool
+	}{
+		{query("test_stream_histogram", 0, 2000), true},
+		{query("test_stream_histogram", 1001, 2000), false},
+		{query("test_stream_missing", 0, 2000), false},
+	} {
+		histograms, err := client.HasHistograms(test.q)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, histograms, "%v", test.q)
+	}
+}
@@ -0,0 +1,246 @@
+package redis_ts
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/promseries"
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ThinningMode picks the sample kept for each interval.
+type ThinningMode string
+
+const (
+	// ThinFirst keeps the first sample of each interval, as it arrives.
+	ThinFirst ThinningMode = "first"
+	// ThinLast keeps the newest sample of each interval, once it ended.
+	ThinLast ThinningMode = "last"
+	// ThinAvg keeps the average of each interval, stamped with its newest
+	// sample, once it ended.
+	ThinAvg ThinningMode = "avg"
+)
+
+// ThinningRule keeps at most one sample per interval of each series of a
+// metric.
+type ThinningRule struct {
+	Interval time.Duration
+	Mode     ThinningMode
+}
+
+// ParseThinningRules parses per metric rules, given as
+// "metric=interval:mode,metric=interval:mode".
+func ParseThinningRules(s string) (map[string]ThinningRule, error) {
+	rules := make(map[string]ThinningRule)
+	if s == "" {
+		return rules, nil
+	}
+	for _, rule := range strings.Split(s, ",") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid thinning rule %q, must be metric=interval:mode", rule)
+		}
+		settings := strings.SplitN(parts[1], ":", 2)
+		if len(settings) != 2 {
+			return nil, fmt.Errorf("invalid thinning rule %q, must be metric=interval:mode", rule)
+		}
+		interval, err := time.ParseDuration(settings[0])
+		if err != nil || interval < time.Millisecond {
+			return nil, fmt.Errorf("invalid thinning interval in %q", rule)
+		}
+		switch mode := ThinningMode(settings[1]); mode {
+		case ThinFirst, ThinLast, ThinAvg:
+			rules[parts[0]] = ThinningRule{Interval: interval, Mode: mode}
+		default:
+			return nil, fmt.Errorf("unknown thinning mode %q, must be one of first, last, avg", settings[1])
+		}
+	}
+	return rules, nil
+}
+
+var (
+	thinnedSamples = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_thinned_samples_total",
+		Help: "Samples dropped by ingest-time thinning.",
+	})
+	thinningLateSamples = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_thinning_late_samples_total",
+		Help: "Samples dropped by ingest-time thinning because their interval was already written.",
+	})
+)
+
+// thinnedSeries is the thinning state of one series.
+type thinnedSeries struct {
+	rule   ThinningRule
+	labels []*prompb.Label
+	metric string
+
+	// interval is the start of the current interval.
+	interval int64
+	// pending tells that the current interval's last or avg sample is not
+	// written yet.
+	pending bool
+	newest  prompb.Sample
+	sum     float64
+	count   int
+}
+
+func (s *thinnedSeries) intervalMs() int64 {
+	return int64(s.rule.Interval / time.Millisecond)
+}
+
+func (s *thinnedSeries) update(sample prompb.Sample) {
+	if !s.pending || sample.Timestamp >= s.newest.Timestamp {
+		s.newest = sample
+	}
+	s.sum += sample.Value
+	s.count++
+	s.pending = true
+}
+
+// result returns the sample kept for the current interval.
+func (s *thinnedSeries) result() prompb.Sample {
+	if s.rule.Mode == ThinAvg {
+		return prompb.Sample{Value: s.sum / float64(s.count), Timestamp: s.newest.Timestamp}
+	}
+	return s.newest
+}
+
+// thinner holds the thinning state of every thinned series. A single lock
+// makes each keep-or-drop decision atomic, so concurrent requests carrying
+// samples of the same series never both write an interval.
+type thinner struct {
+	rules map[string]ThinningRule
+
+	mu     sync.Mutex
+	series map[string]*thinnedSeries
+}
+
+func newThinner(rules map[string]ThinningRule) *thinner {
+	return &thinner{rules: rules, series: make(map[string]*thinnedSeries)}
+}
+
+// thin returns the samples of the series at key to write now. These are the
+// first samples of new intervals in first mode, and the results of the
+// intervals that ended in the other modes.
+func (t *thinner) thin(key string, labels []*prompb.Label, metric string, samples []prompb.Sample) []prompb.Sample {
+	rule, ok := t.rules[metric]
+	if !ok {
+		return samples
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.series[key]
+	if !ok {
+		s = &thinnedSeries{rule: rule, labels: labels, metric: metric, interval: math.MinInt64}
+		t.series[key] = s
+	}
+
+	var kept []prompb.Sample
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		interval := sample.Timestamp - promseries.Mod(sample.Timestamp, s.intervalMs())
+		switch {
+		case interval < s.interval:
+			thinningLateSamples.Inc()
+		case interval == s.interval:
+			if rule.Mode == ThinFirst {
+				thinnedSamples.Inc()
+				continue
+			}
+			s.update(sample)
+			thinnedSamples.Inc()
+		default:
+			if s.pending {
+				kept = append(kept, s.result())
+			}
+			s.interval, s.pending, s.sum, s.count = interval, false, 0, 0
+			if rule.Mode == ThinFirst {
+				kept = append(kept, sample)
+				continue
+			}
+			s.update(sample)
+		}
+	}
+	return kept
+}
+
+// flush removes the series whose interval ended at least one more interval
+// before until, or that never got a sample, and returns the pending results
+// among them.
+func (t *thinner) flush(until int64) map[string]*thinnedSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flushed := make(map[string]*thinnedSeries)
+	for key, s := range t.series {
+		if s.interval != math.MinInt64 && s.interval > until-2*s.intervalMs() {
+			continue
+		}
+		delete(t.series, key)
+		if s.pending {
+			flushed[key] = s
+		}
+	}
+	return flushed
+}
+
+// SetThinningRules thins the series of the metrics in rules as they are
+// written. It must be called before the first write.
+func (c *Client) SetThinningRules(rules map[string]ThinningRule) {
+	if len(rules) > 0 {
+		c.thinner = newThinner(rules)
+	}
+}
+
+// FlushThinned writes the last and avg results of series that got no sample
+// for an interval since the one that ended before until, so that series
+// that stop reporting are not left unwritten. Pass math.MaxInt64 on
+// shutdown to write every pending result.
+func (c *Client) FlushThinned(until int64) error {
+	if c.thinner == nil {
+		return nil
+	}
+	flushed := c.thinner.flush(until)
+	if len(flushed) == 0 {
+		return nil
+	}
+
+	pipe := c.Pipeline()
+	defer pipe.Close()
+	index := make(partitionIndex)
+	heads := &headWrites{}
+	for key, s := range flushed {
+		metric := s.metric
+		series := &remotepb.TimeSeries{Labels: s.labels}
+		for _, part := range c.partition(key, series, []prompb.Sample{s.result()}) {
+			sample := &part.samples[0]
+			cmd := c.add(&part.key, part.labels, &metric, &sample.Timestamp, &sample.Value)
+			if err := pipe.Process(cmd); err != nil {
+				return err
+			}
+			index.add(pipe, part)
+			heads.samples = append(heads.samples, headSample{labels: part.labels, sample: *sample, cmd: cmd})
+		}
+	}
+	wait, err := c.queueWait(pipe)
+	if err != nil {
+		return err
+	}
+	_, err = pipe.Exec()
+	if c.head != nil {
+		c.head.record(heads)
+	}
+	if waitErr := c.checkWait(wait); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package redis_ts
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThinningRules(t *testing.T) {
+	rules, err := ParseThinningRules("node_load1=1m:avg,job:up:sum=30s:first")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]ThinningRule{
+		"node_load1": {Interval: time.Minute, Mode: ThinAvg},
+		"job:up:sum": {Interval: 30 * time.Second, Mode: ThinFirst},
+	}, rules)
+
+	for _, s := range []string{"node_load1", "node_load1=1m", "node_load1=x:avg", "node_load1=1m:median"} {
+		_, err := ParseThinningRules(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestThin(t *testing.T) {
+	thinner := newThinner(map[string]ThinningRule{
+		"first": {Interval: time.Minute, Mode: ThinFirst},
+		"last":  {Interval: time.Minute, Mode: ThinLast},
+		"avg":   {Interval: time.Minute, Mode: ThinAvg},
+	})
+	samples := []prompb.Sample{
+		{Value: 1, Timestamp: 5000},
+		{Value: 2, Timestamp: 30000},
+		{Value: 6, Timestamp: 55000},
+		{Value: 10, Timestamp: 65000},
+	}
+
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 5000}, {Value: 10, Timestamp: 65000}},
+		thinner.thin("first", nil, "first", samples))
+	assert.Equal(t, []prompb.Sample{{Value: 6, Timestamp: 55000}},
+		thinner.thin("last", nil, "last", samples))
+	assert.Equal(t, []prompb.Sample{{Value: 3, Timestamp: 55000}},
+		thinner.thin("avg", nil, "avg", samples))
+	assert.Equal(t, samples, thinner.thin("other", nil, "other", samples))
+
+	// Samples of intervals already left behind are late.
+	assert.Empty(t, thinner.thin("last", nil, "last", []prompb.Sample{{Value: 7, Timestamp: 59000}}))
+
+	flushed := thinner.flush(180000)
+	assert.Len(t, flushed, 2)
+	assert.Equal(t, prompb.Sample{Value: 10, Timestamp: 65000}, flushed["last"].result())
+	assert.Equal(t, prompb.Sample{Value: 10, Timestamp: 65000}, flushed["avg"].result())
+	assert.Empty(t, thinner.flush(math.MaxInt64))
+}
+
+func TestThinConcurrently(t *testing.T) {
+	thinner := newThinner(map[string]ThinningRule{"first": {Interval: time.Minute, Mode: ThinFirst}})
+
+	var mu sync.Mutex
+	var kept []prompb.Sample
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			samples := thinner.thin("first", nil, "first", []prompb.Sample{{Value: float64(i), Timestamp: int64(i * 1000)}})
+			mu.Lock()
+			kept = append(kept, samples...)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, kept, 1, "one sample per interval, whatever the order of requests")
+}
@@ -0,0 +1,257 @@
+// Package remotepb holds the parts of the Prometheus remote storage protocol
+// that the vendored prompb package predates: exemplars, native histograms,
+// metric metadata and streamed remote read responses. The messages are wire
+// compatible with Prometheus' prompb/types.proto and prompb/remote.proto and
+// reuse prompb's Label and Sample types, so a WriteRequest decoded here
+// carries everything a plain prompb.WriteRequest does.
+//
+// The structs are decoded and encoded through gogo/protobuf's reflection
+// support, so they only need struct tags and the proto.Message methods.
+package remotepb
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// WriteRequest is the remote-write 1.0 request, including metadata.
+type WriteRequest struct {
+	Timeseries []*TimeSeries     `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+	Metadata   []*MetricMetadata `protobuf:"bytes,3,rep,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteRequest) ProtoMessage()    {}
+
+// TimeSeries is a prompb.TimeSeries with exemplars and native histograms.
+type TimeSeries struct {
+	Labels     []*prompb.Label `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples    []prompb.Sample `protobuf:"bytes,2,rep,name=samples" json:"samples"`
+	Exemplars  []Exemplar      `protobuf:"bytes,3,rep,name=exemplars" json:"exemplars"`
+	Histograms []Histogram     `protobuf:"bytes,4,rep,name=histograms" json:"histograms"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+// Prompb returns the labels and float samples of the series as a
+// prompb.TimeSeries. The slices are shared, not copied.
+func (m *TimeSeries) Prompb() *prompb.TimeSeries {
+	return &prompb.TimeSeries{Labels: m.Labels, Samples: m.Samples}
+}
+
+// FromPrompb wraps prompb series, which only ever carry float samples.
+func FromPrompb(timeseries []*prompb.TimeSeries) []*TimeSeries {
+	result := make([]*TimeSeries, 0, len(timeseries))
+	for _, ts := range timeseries {
+		result = append(result, &TimeSeries{Labels: ts.Labels, Samples: ts.Samples})
+	}
+	return result
+}
+
+// Exemplar is an example observation, usually carrying a trace id label.
+type Exemplar struct {
+	Labels    []*prompb.Label `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Value     float64         `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64           `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *Exemplar) Reset()         { *m = Exemplar{} }
+func (m *Exemplar) String() string { return proto.CompactTextString(m) }
+func (*Exemplar) ProtoMessage()    {}
+
+// MetricType mirrors prompb.MetricMetadata_MetricType.
+type MetricType int32
+
+const (
+	MetricTypeUnknown        MetricType = 0
+	MetricTypeCounter        MetricType = 1
+	MetricTypeGauge          MetricType = 2
+	MetricTypeHistogram      MetricType = 3
+	MetricTypeGaugeHistogram MetricType = 4
+	MetricTypeSummary        MetricType = 5
+	MetricTypeInfo           MetricType = 6
+	MetricTypeStateset       MetricType = 7
+)
+
+var metricTypeNames = map[MetricType]string{
+	MetricTypeUnknown:        "unknown",
+	MetricTypeCounter:        "counter",
+	MetricTypeGauge:          "gauge",
+	MetricTypeHistogram:      "histogram",
+	MetricTypeGaugeHistogram: "gaugehistogram",
+	MetricTypeSummary:        "summary",
+	MetricTypeInfo:           "info",
+	MetricTypeStateset:       "stateset",
+}
+
+// String returns the type as Prometheus' metadata API spells it.
+func (t MetricType) String() string {
+	if name, ok := metricTypeNames[t]; ok {
+		return name
+	}
+	return metricTypeNames[MetricTypeUnknown]
+}
+
+// ParseMetricType is the inverse of MetricType.String.
+func ParseMetricType(s string) MetricType {
+	for t, name := range metricTypeNames {
+		if name == s {
+			return t
+		}
+	}
+	return MetricTypeUnknown
+}
+
+// MetricMetadata describes a metric family.
+type MetricMetadata struct {
+	Type             MetricType `protobuf:"varint,1,opt,name=type,proto3,enum=prometheus.MetricMetadata_MetricType" json:"type,omitempty"`
+	MetricFamilyName string     `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3" json:"metric_family_name,omitempty"`
+	Help             string     `protobuf:"bytes,4,opt,name=help,proto3" json:"help,omitempty"`
+	Unit             string     `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *MetricMetadata) Reset()         { *m = MetricMetadata{} }
+func (m *MetricMetadata) String() string { return proto.CompactTextString(m) }
+func (*MetricMetadata) ProtoMessage()    {}
+
+// ResetHint tells whether a histogram is a counter reset.
+type ResetHint int32
+
+const (
+	ResetHintUnknown ResetHint = 0
+	ResetHintYes     ResetHint = 1
+	ResetHintNo      ResetHint = 2
+	ResetHintGauge   ResetHint = 3
+)
+
+// Histogram is a native (sparse) histogram sample. It is shared by
+// remote-write 1.0 and 2.0.
+//
+// The protocol declares count and zero_count as oneofs of an integer and a
+// float variant. They are modelled as optional pointer fields, which encode
+// to the same bytes and keep track of which variant was sent.
+type Histogram struct {
+	CountInt       *uint64      `protobuf:"varint,1,opt,name=count_int" json:"count_int,omitempty"`
+	CountFloat     *float64     `protobuf:"fixed64,2,opt,name=count_float" json:"count_float,omitempty"`
+	Sum            float64      `protobuf:"fixed64,3,opt,name=sum,proto3" json:"sum,omitempty"`
+	Schema         int32        `protobuf:"zigzag32,4,opt,name=schema,proto3" json:"schema,omitempty"`
+	ZeroThreshold  float64      `protobuf:"fixed64,5,opt,name=zero_threshold,proto3" json:"zero_threshold,omitempty"`
+	ZeroCountInt   *uint64      `protobuf:"varint,6,opt,name=zero_count_int" json:"zero_count_int,omitempty"`
+	ZeroCountFloat *float64     `protobuf:"fixed64,7,opt,name=zero_count_float" json:"zero_count_float,omitempty"`
+	NegativeSpans  []BucketSpan `protobuf:"bytes,8,rep,name=negative_spans" json:"negative_spans"`
+	NegativeDeltas []int64      `protobuf:"zigzag64,9,rep,packed,name=negative_deltas" json:"negative_deltas,omitempty"`
+	NegativeCounts []float64    `protobuf:"fixed64,10,rep,packed,name=negative_counts" json:"negative_counts,omitempty"`
+	PositiveSpans  []BucketSpan `protobuf:"bytes,11,rep,name=positive_spans" json:"positive_spans"`
+	PositiveDeltas []int64      `protobuf:"zigzag64,12,rep,packed,name=positive_deltas" json:"positive_deltas,omitempty"`
+	PositiveCounts []float64    `protobuf:"fixed64,13,rep,packed,name=positive_counts" json:"positive_counts,omitempty"`
+	ResetHint      ResetHint    `protobuf:"varint,14,opt,name=reset_hint,proto3,enum=prometheus.Histogram_ResetHint" json:"reset_hint,omitempty"`
+	Timestamp      int64        `protobuf:"varint,15,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CustomValues   []float64    `protobuf:"fixed64,16,rep,packed,name=custom_values" json:"custom_values,omitempty"`
+}
+
+func (m *Histogram) Reset()         { *m = Histogram{} }
+func (m *Histogram) String() string { return proto.CompactTextString(m) }
+func (*Histogram) ProtoMessage()    {}
+
+// IsFloatHistogram reports whether the histogram carries float counts.
+func (m *Histogram) IsFloatHistogram() bool {
+	return m.CountFloat != nil
+}
+
+// BucketSpan describes a run of consecutive populated buckets.
+type BucketSpan struct {
+	Offset int32  `protobuf:"zigzag32,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint32 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+}
+
+func (m *BucketSpan) Reset()         { *m = BucketSpan{} }
+func (m *BucketSpan) String() string { return proto.CompactTextString(m) }
+func (*BucketSpan) ProtoMessage()    {}
+
+// ReadResponse is a prompb.ReadResponse whose series can carry native
+// histograms.
+type ReadResponse struct {
+	// In same order as the request's queries.
+	Results []*QueryResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *ReadResponse) Reset()         { *m = ReadResponse{} }
+func (m *ReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ReadResponse) ProtoMessage()    {}
+
+// QueryResult holds the series matching one query.
+type QueryResult struct {
+	// Samples within a time series must be ordered by time.
+	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *QueryResult) Reset()         { *m = QueryResult{} }
+func (m *QueryResult) String() string { return proto.CompactTextString(m) }
+func (*QueryResult) ProtoMessage()    {}
+
+// ReadRequest_ResponseType is a response type a remote read client accepts.
+type ReadRequest_ResponseType int32
+
+const (
+	// ReadRequest_SAMPLES is a snappy compressed ReadResponse.
+	ReadRequest_SAMPLES ReadRequest_ResponseType = 0
+	// ReadRequest_STREAMED_XOR_CHUNKS is a stream of framed
+	// ChunkedReadResponse messages, whose series carry XOR chunks.
+	ReadRequest_STREAMED_XOR_CHUNKS ReadRequest_ResponseType = 1
+)
+
+// ReadRequest is a prompb.ReadRequest with the response types the client
+// accepts, in order of preference.
+type ReadRequest struct {
+	Queries               []*prompb.Query            `protobuf:"bytes,1,rep,name=queries" json:"queries,omitempty"`
+	AcceptedResponseTypes []ReadRequest_ResponseType `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes,enum=prometheus.ReadRequest_ResponseType" json:"accepted_response_types,omitempty"`
+}
+
+func (m *ReadRequest) Reset()         { *m = ReadRequest{} }
+func (m *ReadRequest) String() string { return proto.CompactTextString(m) }
+func (*ReadRequest) ProtoMessage()    {}
+
+// ChunkedReadResponse is one frame of a streamed remote read response.
+type ChunkedReadResponse struct {
+	ChunkedSeries []*ChunkedSeries `protobuf:"bytes,1,rep,name=chunked_series,json=chunkedSeries" json:"chunked_series,omitempty"`
+	// QueryIndex is the index of the query in the request.
+	QueryIndex int64 `protobuf:"varint,2,opt,name=query_index,json=queryIndex,proto3" json:"query_index,omitempty"`
+}
+
+func (m *ChunkedReadResponse) Reset()         { *m = ChunkedReadResponse{} }
+func (m *ChunkedReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ChunkedReadResponse) ProtoMessage()    {}
+
+// ChunkedSeries is a series and chunks of its samples, in time order.
+type ChunkedSeries struct {
+	Labels []*prompb.Label `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Chunks []Chunk         `protobuf:"bytes,2,rep,name=chunks" json:"chunks"`
+}
+
+func (m *ChunkedSeries) Reset()         { *m = ChunkedSeries{} }
+func (m *ChunkedSeries) String() string { return proto.CompactTextString(m) }
+func (*ChunkedSeries) ProtoMessage()    {}
+
+// Chunk_Encoding is the encoding of a chunk's data.
+type Chunk_Encoding int32
+
+const (
+	Chunk_UNKNOWN Chunk_Encoding = 0
+	Chunk_XOR     Chunk_Encoding = 1
+)
+
+// Chunk is an encoded run of samples, between MinTimeMs and MaxTimeMs
+// included.
+type Chunk struct {
+	MinTimeMs int64          `protobuf:"varint,1,opt,name=min_time_ms,json=minTimeMs,proto3" json:"min_time_ms,omitempty"`
+	MaxTimeMs int64          `protobuf:"varint,2,opt,name=max_time_ms,json=maxTimeMs,proto3" json:"max_time_ms,omitempty"`
+	Type      Chunk_Encoding `protobuf:"varint,3,opt,name=type,proto3,enum=prometheus.Chunk_Encoding" json:"type,omitempty"`
+	Data      []byte         `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()         { *m = Chunk{} }
+func (m *Chunk) String() string { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()    {}
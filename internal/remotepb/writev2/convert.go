@@ -0,0 +1,110 @@
+package writev2
+
+import (
+	"fmt"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const nameLabel = "__name__"
+
+// ToWriteRequest resolves all symbol references and returns the request in
+// its remote-write 1.0 form. Per-series metadata becomes one MetricMetadata
+// entry per metric family. Created timestamps have no 1.0 equivalent and
+// are dropped.
+func (m *Request) ToWriteRequest() (*remotepb.WriteRequest, error) {
+	if len(m.Symbols) > 0 && m.Symbols[0] != "" {
+		return nil, fmt.Errorf("first symbol must be an empty string, got %q", m.Symbols[0])
+	}
+
+	req := &remotepb.WriteRequest{Timeseries: make([]*remotepb.TimeSeries, 0, len(m.Timeseries))}
+	seenMetadata := make(map[string]bool)
+	for i := range m.Timeseries {
+		ts := &m.Timeseries[i]
+		labels, err := m.labels(ts.LabelsRefs)
+		if err != nil {
+			return nil, fmt.Errorf("timeseries %d: %v", i, err)
+		}
+
+		exemplars := make([]remotepb.Exemplar, 0, len(ts.Exemplars))
+		for j := range ts.Exemplars {
+			exemplarLabels, err := m.labels(ts.Exemplars[j].LabelsRefs)
+			if err != nil {
+				return nil, fmt.Errorf("timeseries %d, exemplar %d: %v", i, j, err)
+			}
+			exemplars = append(exemplars, remotepb.Exemplar{
+				Labels:    exemplarLabels,
+				Value:     ts.Exemplars[j].Value,
+				Timestamp: ts.Exemplars[j].Timestamp,
+			})
+		}
+
+		req.Timeseries = append(req.Timeseries, &remotepb.TimeSeries{
+			Labels:     labels,
+			Samples:    ts.Samples,
+			Exemplars:  exemplars,
+			Histograms: ts.Histograms,
+		})
+
+		metadata, err := m.metadata(&ts.Metadata, labels)
+		if err != nil {
+			return nil, fmt.Errorf("timeseries %d: %v", i, err)
+		}
+		if metadata != nil && !seenMetadata[metadata.MetricFamilyName] {
+			seenMetadata[metadata.MetricFamilyName] = true
+			req.Metadata = append(req.Metadata, metadata)
+		}
+	}
+	return req, nil
+}
+
+func (m *Request) symbol(ref uint32) (string, error) {
+	if int(ref) >= len(m.Symbols) {
+		return "", fmt.Errorf("symbol reference %d out of range, %d symbols", ref, len(m.Symbols))
+	}
+	return m.Symbols[ref], nil
+}
+
+func (m *Request) labels(refs []uint32) ([]*prompb.Label, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references: %d", len(refs))
+	}
+	labels := make([]*prompb.Label, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		name, err := m.symbol(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := m.symbol(refs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, &prompb.Label{Name: name, Value: value})
+	}
+	return labels, nil
+}
+
+func (m *Request) metadata(md *Metadata, labels []*prompb.Label) (*remotepb.MetricMetadata, error) {
+	if md.Type == remotepb.MetricTypeUnknown && md.HelpRef == 0 && md.UnitRef == 0 {
+		return nil, nil
+	}
+	var family string
+	for _, l := range labels {
+		if l.Name == nameLabel {
+			family = l.Value
+		}
+	}
+	if family == "" {
+		return nil, nil
+	}
+	help, err := m.symbol(md.HelpRef)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := m.symbol(md.UnitRef)
+	if err != nil {
+		return nil, err
+	}
+	return &remotepb.MetricMetadata{Type: md.Type, MetricFamilyName: family, Help: help, Unit: unit}, nil
+}
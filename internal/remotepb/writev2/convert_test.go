@@ -0,0 +1,73 @@
+package writev2
+
+import (
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToWriteRequest(t *testing.T) {
+	count := uint64(3)
+	request := &Request{
+		Symbols: []string{"", "__name__", "http_requests_total", "job", "api", "trace_id", "abc123", "Total requests.", "requests"},
+		Timeseries: []TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []prompb.Sample{{Value: 1, Timestamp: 1000}},
+				Exemplars:  []Exemplar{{LabelsRefs: []uint32{5, 6}, Value: 0.5, Timestamp: 1000}},
+				Histograms: []remotepb.Histogram{{CountInt: &count, Sum: 4.5, Timestamp: 1000}},
+				Metadata:   Metadata{Type: remotepb.MetricTypeCounter, HelpRef: 7, UnitRef: 8},
+			},
+		},
+	}
+
+	buf, err := proto.Marshal(request)
+	assert.Nil(t, err)
+	var decoded Request
+	assert.Nil(t, proto.Unmarshal(buf, &decoded))
+
+	req, err := decoded.ToWriteRequest()
+	assert.Nil(t, err)
+	assert.Len(t, req.Timeseries, 1)
+	ts := req.Timeseries[0]
+	assert.Equal(t, []*prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "job", Value: "api"}}, ts.Labels)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 1000}}, ts.Samples)
+	assert.Equal(t, []*prompb.Label{{Name: "trace_id", Value: "abc123"}}, ts.Exemplars[0].Labels)
+	assert.Equal(t, uint64(3), *ts.Histograms[0].CountInt)
+	assert.False(t, ts.Histograms[0].IsFloatHistogram())
+	assert.Equal(t, []*remotepb.MetricMetadata{{
+		Type:             remotepb.MetricTypeCounter,
+		MetricFamilyName: "http_requests_total",
+		Help:             "Total requests.",
+		Unit:             "requests",
+	}}, req.Metadata)
+}
+
+func TestToWriteRequestInvalidRefs(t *testing.T) {
+	request := &Request{
+		Symbols:    []string{"", "__name__"},
+		Timeseries: []TimeSeries{{LabelsRefs: []uint32{1, 7}}},
+	}
+	_, err := request.ToWriteRequest()
+	assert.NotNil(t, err)
+
+	request.Timeseries[0].LabelsRefs = []uint32{1}
+	_, err = request.ToWriteRequest()
+	assert.NotNil(t, err)
+}
+
+func TestV1RequestDecodes(t *testing.T) {
+	v1 := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 5}},
+	}}}
+	buf, err := proto.Marshal(v1)
+	assert.Nil(t, err)
+
+	var req remotepb.WriteRequest
+	assert.Nil(t, proto.Unmarshal(buf, &req))
+	assert.Equal(t, v1.Timeseries[0], req.Timeseries[0].Prompb())
+}
@@ -0,0 +1,58 @@
+// Package writev2 holds the Remote Write 2.0 messages
+// (io.prometheus.write.v2.Request) and their conversion to the 1.0 form the
+// rest of the adapter works with.
+package writev2
+
+import (
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Request is a Remote Write 2.0 request. Label names and values, help
+// texts and units are interned in Symbols and referenced by index.
+type Request struct {
+	Symbols    []string     `protobuf:"bytes,4,rep,name=symbols" json:"symbols,omitempty"`
+	Timeseries []TimeSeries `protobuf:"bytes,5,rep,name=timeseries" json:"timeseries"`
+}
+
+func (m *Request) Reset()         { *m = Request{} }
+func (m *Request) String() string { return proto.CompactTextString(m) }
+func (*Request) ProtoMessage()    {}
+
+// TimeSeries is a single series with all its data and metadata.
+type TimeSeries struct {
+	LabelsRefs       []uint32             `protobuf:"varint,1,rep,packed,name=labels_refs" json:"labels_refs,omitempty"`
+	Samples          []prompb.Sample      `protobuf:"bytes,2,rep,name=samples" json:"samples"`
+	Histograms       []remotepb.Histogram `protobuf:"bytes,3,rep,name=histograms" json:"histograms"`
+	Exemplars        []Exemplar           `protobuf:"bytes,4,rep,name=exemplars" json:"exemplars"`
+	Metadata         Metadata             `protobuf:"bytes,5,opt,name=metadata" json:"metadata"`
+	CreatedTimestamp int64                `protobuf:"varint,6,opt,name=created_timestamp,proto3" json:"created_timestamp,omitempty"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+// Exemplar is an exemplar whose labels are symbol references.
+type Exemplar struct {
+	LabelsRefs []uint32 `protobuf:"varint,1,rep,packed,name=labels_refs" json:"labels_refs,omitempty"`
+	Value      float64  `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp  int64    `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *Exemplar) Reset()         { *m = Exemplar{} }
+func (m *Exemplar) String() string { return proto.CompactTextString(m) }
+func (*Exemplar) ProtoMessage()    {}
+
+// Metadata is the per-series metric metadata. Its type values match
+// remotepb.MetricType.
+type Metadata struct {
+	Type    remotepb.MetricType `protobuf:"varint,1,opt,name=type,proto3,enum=io.prometheus.write.v2.Metadata_MetricType" json:"type,omitempty"`
+	HelpRef uint32              `protobuf:"varint,3,opt,name=help_ref,proto3" json:"help_ref,omitempty"`
+	UnitRef uint32              `protobuf:"varint,4,opt,name=unit_ref,proto3" json:"unit_ref,omitempty"`
+}
+
+func (m *Metadata) Reset()         { *m = Metadata{} }
+func (m *Metadata) String() string { return proto.CompactTextString(m) }
+func (*Metadata) ProtoMessage()    {}
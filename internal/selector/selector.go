@@ -0,0 +1,288 @@
+// Package selector extracts the series selectors of the PromQL expressions
+// the adapter's query endpoints accept, such as the
+// `http_requests_total{job="api",code!="200"}` of
+// `rate(http_requests_total{job="api",code!="200"}[5m])`, as Prometheus does
+// for its exemplars API. Expressions are only parsed as far as needed to
+// find their selectors, not checked.
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const nameLabel = "__name__"
+
+// keywords are the PromQL words that cannot start a selector: aggregations,
+// operators and modifiers, and the number literals Inf and NaN.
+var keywords = map[string]bool{
+	"sum": true, "min": true, "max": true, "avg": true, "group": true, "stddev": true, "stdvar": true,
+	"count": true, "count_values": true, "bottomk": true, "topk": true, "quantile": true,
+	"limitk": true, "limit_ratio": true,
+	"and": true, "or": true, "unless": true, "atan2": true, "bool": true, "offset": true,
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+	"inf": true, "nan": true,
+}
+
+// groupingKeywords are followed by a list of label names, which are not
+// selectors.
+var groupingKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+}
+
+// Parse returns the matchers of every vector selector of the expression, in
+// order.
+func Parse(expr string) ([][]*prompb.LabelMatcher, error) {
+	p := &parser{input: expr}
+	p.skipSpace()
+	if p.done() {
+		return nil, p.errorf("no expression found in input")
+	}
+	var selectors [][]*prompb.LabelMatcher
+	for {
+		p.skipSpace()
+		if p.done() {
+			return selectors, nil
+		}
+		switch c := p.peek(); {
+		case c == '{' || isNameChar(c, true) && !isDigit(c):
+			start := p.pos
+			word := p.name(true)
+			p.skipSpace()
+			if word != "" && keywords[strings.ToLower(word)] {
+				if groupingKeywords[strings.ToLower(word)] && p.peek() == '(' {
+					if err := p.skipPast(')'); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			if word != "" && p.peek() == '(' {
+				// A function call: its arguments follow.
+				continue
+			}
+			p.pos = start
+			matchers, err := p.selector()
+			if err != nil {
+				return nil, err
+			}
+			selectors = append(selectors, matchers)
+		case c == '"' || c == '\'' || c == '`':
+			if _, err := p.quoted(); err != nil {
+				return nil, err
+			}
+		case c == '[':
+			// Ranges and subqueries only hold durations.
+			if err := p.skipPast(']'); err != nil {
+				return nil, err
+			}
+		case isDigit(c) || c == '.':
+			p.number()
+		case c == '#':
+			for !p.done() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			// Operators, parentheses and commas.
+			p.pos++
+		}
+	}
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at char %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) keyword(word string) bool {
+	end := p.pos + len(word)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], word) {
+		return false
+	}
+	if end < len(p.input) && isNameChar(p.input[end], true) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// number skips a number or duration literal, such as 1.5e-3, 0x1f or 1h30m.
+func (p *parser) number() {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		exponent := (c == '+' || c == '-') && strings.ContainsAny(p.input[p.pos-1:p.pos], "eE") &&
+			!strings.HasPrefix(strings.ToLower(p.input[start:]), "0x")
+		if !exponent && c != '.' && !isNameChar(c, false) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// skipPast skips what is left of a bracketed list, up to its closing
+// bracket, without looking into it.
+func (p *parser) skipPast(closing byte) error {
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		if c == closing {
+			return nil
+		}
+	}
+	return p.errorf("expected %q", closing)
+}
+
+func isNameChar(c byte, metric bool) bool {
+	return c == '_' || (metric && c == ':') ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *parser) name(metric bool) string {
+	start := p.pos
+	for !p.done() && isNameChar(p.input[p.pos], metric) {
+		if p.pos == start && '0' <= p.input[p.pos] && p.input[p.pos] <= '9' {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) selector() ([]*prompb.LabelMatcher, error) {
+	p.skipSpace()
+	var matchers []*prompb.LabelMatcher
+	if metric := p.name(true); metric != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: nameLabel, Value: metric})
+	}
+
+	p.skipSpace()
+	if p.peek() != '{' {
+		if len(matchers) == 0 {
+			return nil, p.errorf("expected metric name or '{'")
+		}
+		return matchers, nil
+	}
+	p.pos++
+
+	for {
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+		matcher, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return nil, p.errorf("expected ',' or '}'")
+		}
+	}
+
+	if len(matchers) == 0 {
+		return nil, p.errorf("selector must contain at least one matcher")
+	}
+	return matchers, nil
+}
+
+func (p *parser) matcher() (*prompb.LabelMatcher, error) {
+	name := p.name(false)
+	if name == "" {
+		return nil, p.errorf("expected label name")
+	}
+
+	p.skipSpace()
+	var matchType prompb.LabelMatcher_Type
+	switch {
+	case strings.HasPrefix(p.input[p.pos:], "=~"):
+		matchType = prompb.LabelMatcher_RE
+	case strings.HasPrefix(p.input[p.pos:], "!~"):
+		matchType = prompb.LabelMatcher_NRE
+	case strings.HasPrefix(p.input[p.pos:], "!="):
+		matchType = prompb.LabelMatcher_NEQ
+	case strings.HasPrefix(p.input[p.pos:], "="):
+		matchType = prompb.LabelMatcher_EQ
+	default:
+		return nil, p.errorf("expected match operator")
+	}
+	if matchType == prompb.LabelMatcher_EQ {
+		p.pos++
+	} else {
+		p.pos += 2
+	}
+
+	p.skipSpace()
+	value, err := p.quoted()
+	if err != nil {
+		return nil, err
+	}
+	return &prompb.LabelMatcher{Type: matchType, Name: name, Value: value}, nil
+}
+
+func (p *parser) quoted() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf("expected quoted string")
+	}
+	start := p.pos
+	p.pos++
+	for !p.done() && p.input[p.pos] != quote {
+		if p.input[p.pos] == '\\' && quote != '`' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.done() {
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+
+	literal := p.input[start:p.pos]
+	if quote == '\'' {
+		// strconv only unquotes a single character in single quotes.
+		inner := strings.Replace(literal[1:len(literal)-1], `\'`, `'`, -1)
+		literal = `"` + strings.Replace(inner, `"`, `\"`, -1) + `"`
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		return "", p.errorf("invalid string %s", literal)
+	}
+	return value, nil
+}
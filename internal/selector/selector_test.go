@@ -0,0 +1,67 @@
+package selector
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	selectors, err := Parse(`http_requests_total{job="api", code!='500', path=~"/v1/.*",} or {instance!~` + "`a\\b`" + `}`)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]*prompb.LabelMatcher{
+		{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "code", Value: "500"},
+			{Type: prompb.LabelMatcher_RE, Name: "path", Value: "/v1/.*"},
+		},
+		{
+			{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: `a\b`},
+		},
+	}, selectors)
+}
+
+func TestParseMetricName(t *testing.T) {
+	selectors, err := Parse("  job:up:sum ")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]*prompb.LabelMatcher{
+		{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "job:up:sum"}},
+	}, selectors)
+}
+
+func TestParseExpressions(t *testing.T) {
+	name := func(metric string) []*prompb.LabelMatcher {
+		return []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: metric}}
+	}
+	job := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}
+	for expr, expected := range map[string][][]*prompb.LabelMatcher{
+		`rate(up[5m])`: {name("up")},
+		`up and down`:  {name("up"), name("down")},
+		`sum by (job) (rate(errors{job="api"}[5m:1m]))`:                                             {append(name("errors"), job)},
+		`histogram_quantile(0.99, sum without (instance) (rate(latency_bucket[1h30m] offset -5m)))`: {name("latency_bucket")},
+		`SUM(up) BY (job) > bool 1e-3 * on(job) group_left(team) owners @ start()`:                  {name("up"), name("owners")},
+		`label_replace(up, "dst", "$1", "src", "(.*)") / Inf # or down`:                             {name("up")},
+		`count_values("value", {job="api"}) - 0x1f`:                                                 {{job}},
+	} {
+		selectors, err := Parse(expr)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, expected, selectors, expr)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"{}",
+		`up{job="api"`,
+		`up{job=api}`,
+		`up{job="api} `,
+		`rate(up[5m)`,
+		`sum by (job`,
+	} {
+		_, err := Parse(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
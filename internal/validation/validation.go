@@ -0,0 +1,176 @@
+// Package validation checks incoming series against ingestion limits before
+// they turn into RedisTimeSeries keys and LABELS lists.
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const nameLabel = "__name__"
+
+// Reasons a series is rejected for.
+const (
+	ReasonMissingMetricName  = "missing_metric_name"
+	ReasonInvalidMetricName  = "invalid_metric_name"
+	ReasonInvalidLabelName   = "invalid_label_name"
+	ReasonEmptyLabelValue    = "empty_label_value"
+	ReasonDuplicateLabelName = "duplicate_label_name"
+	ReasonLabelsNotSorted    = "labels_not_sorted"
+	ReasonTooManyLabels      = "too_many_labels"
+	ReasonLabelNameTooLong   = "label_name_too_long"
+	ReasonLabelValueTooLong  = "label_value_too_long"
+)
+
+var (
+	// DefaultLabelNamePattern is Prometheus' label name charset.
+	DefaultLabelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	rejectedSeries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_rejected_series_total",
+		Help: "Series rejected by ingestion validation, by reason.",
+	}, []string{"reason"})
+	rejectedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ts_adapter_rejected_samples_total",
+		Help: "Samples and histograms rejected by ingestion validation, by reason.",
+	}, []string{"reason"})
+)
+
+// Config holds the ingestion limits. Zero limits are not enforced.
+type Config struct {
+	MaxLabelNames       int
+	MaxLabelNameLength  int
+	MaxLabelValueLength int
+	LabelNamePattern    *regexp.Regexp
+
+	// Strict rejects every series that breaks a rule. Otherwise, series
+	// with unsorted labels, empty label values or repeated identical labels
+	// are repaired and kept, like Prometheus itself treats them.
+	Strict bool
+}
+
+// Rejection describes a series, or some of its samples, that was dropped.
+type Rejection struct {
+	Series string
+	Reason string
+	Detail string
+}
+
+func (r Rejection) String() string {
+	return fmt.Sprintf("series %s: %s: %s", r.Series, r.Reason, r.Detail)
+}
+
+// Validator filters write requests.
+type Validator struct {
+	cfg Config
+}
+
+// NewValidator creates a Validator.
+func NewValidator(cfg Config) *Validator {
+	if cfg.LabelNamePattern == nil {
+		cfg.LabelNamePattern = DefaultLabelNamePattern
+	}
+	return &Validator{cfg: cfg}
+}
+
+// Validate removes the series breaking the limits from req, repairing what
+// lenient mode allows, and returns what it removed.
+func (v *Validator) Validate(req *remotepb.WriteRequest) []Rejection {
+	var rejections []Rejection
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		labels, reason, detail := v.validateLabels(ts.Labels)
+		if reason != "" {
+			rejectedSeries.WithLabelValues(reason).Inc()
+			rejectedSamples.WithLabelValues(reason).Add(float64(len(ts.Samples) + len(ts.Histograms)))
+			rejections = append(rejections, Rejection{Series: formatLabels(ts.Labels), Reason: reason, Detail: detail})
+			continue
+		}
+		ts.Labels = labels
+		kept = append(kept, ts)
+	}
+	req.Timeseries = kept
+	return rejections
+}
+
+func (v *Validator) validateLabels(labels []*prompb.Label) ([]*prompb.Label, string, string) {
+	if !v.cfg.Strict {
+		labels = repair(labels)
+	}
+
+	if v.cfg.MaxLabelNames > 0 && len(labels) > v.cfg.MaxLabelNames {
+		return nil, ReasonTooManyLabels, fmt.Sprintf("%d labels, limit is %d", len(labels), v.cfg.MaxLabelNames)
+	}
+
+	hasName := false
+	for i, l := range labels {
+		if l.Name == nameLabel {
+			hasName = true
+			if !metricNamePattern.MatchString(l.Value) {
+				return nil, ReasonInvalidMetricName, fmt.Sprintf("%q", l.Value)
+			}
+		} else if !v.cfg.LabelNamePattern.MatchString(l.Name) {
+			return nil, ReasonInvalidLabelName, fmt.Sprintf("%q", l.Name)
+		}
+		if v.cfg.MaxLabelNameLength > 0 && len(l.Name) > v.cfg.MaxLabelNameLength {
+			return nil, ReasonLabelNameTooLong, fmt.Sprintf("%q is %d bytes, limit is %d", l.Name, len(l.Name), v.cfg.MaxLabelNameLength)
+		}
+		if v.cfg.MaxLabelValueLength > 0 && len(l.Value) > v.cfg.MaxLabelValueLength {
+			return nil, ReasonLabelValueTooLong, fmt.Sprintf("value of %q is %d bytes, limit is %d", l.Name, len(l.Value), v.cfg.MaxLabelValueLength)
+		}
+		if l.Value == "" {
+			return nil, ReasonEmptyLabelValue, fmt.Sprintf("%q", l.Name)
+		}
+		if i > 0 {
+			switch previous := labels[i-1].Name; {
+			case previous == l.Name:
+				return nil, ReasonDuplicateLabelName, fmt.Sprintf("%q", l.Name)
+			case previous > l.Name:
+				return nil, ReasonLabelsNotSorted, fmt.Sprintf("%q after %q", l.Name, previous)
+			}
+		}
+	}
+	if !hasName {
+		return nil, ReasonMissingMetricName, "no __name__ label"
+	}
+	return labels, "", ""
+}
+
+// repair sorts labels, and drops those with empty values and exact
+// duplicates. Duplicate names with different values are left for
+// validateLabels to reject.
+func repair(labels []*prompb.Label) []*prompb.Label {
+	repaired := make([]*prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Value != "" {
+			repaired = append(repaired, l)
+		}
+	}
+	sort.SliceStable(repaired, func(i, j int) bool { return repaired[i].Name < repaired[j].Name })
+
+	deduplicated := make([]*prompb.Label, 0, len(repaired))
+	for _, l := range repaired {
+		if last := len(deduplicated) - 1; last >= 0 && deduplicated[last].Name == l.Name && deduplicated[last].Value == l.Value {
+			continue
+		}
+		deduplicated = append(deduplicated, l)
+	}
+	return deduplicated
+}
+
+func formatLabels(labels []*prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,66 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func series(labels ...string) *remotepb.TimeSeries {
+	ts := &remotepb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func TestValidateLenient(t *testing.T) {
+	validator := NewValidator(Config{MaxLabelNames: 3, MaxLabelValueLength: 8})
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		series("job", "api", "__name__", "up", "empty", "", "job", "api"),
+		series("__name__", "up", "job", "api", "job", "web"),
+		series("__name__", "up", "a", "1", "b", "2", "c", "3"),
+		series("__name__", "up", "job", strings.Repeat("x", 9)),
+		series("__name__", "up", "bad-name", "x"),
+		series("__name__", "9up"),
+		series("job", "api"),
+	}}
+
+	rejections := validator.Validate(req)
+	assert.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}, req.Timeseries[0].Labels)
+
+	reasons := make([]string, 0, len(rejections))
+	for _, r := range rejections {
+		reasons = append(reasons, r.Reason)
+	}
+	assert.Equal(t, []string{
+		ReasonDuplicateLabelName,
+		ReasonTooManyLabels,
+		ReasonLabelValueTooLong,
+		ReasonInvalidLabelName,
+		ReasonInvalidMetricName,
+		ReasonMissingMetricName,
+	}, reasons)
+}
+
+func TestValidateStrict(t *testing.T) {
+	validator := NewValidator(Config{Strict: true})
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{
+		series("__name__", "up", "job", "api"),
+		series("job", "api", "__name__", "up"),
+		series("__name__", "up", "job", ""),
+		series("__name__", "up", "job", "api", "job", "api"),
+	}}
+
+	rejections := validator.Validate(req)
+	assert.Len(t, req.Timeseries, 1)
+	assert.Len(t, rejections, 3)
+	assert.Equal(t, ReasonLabelsNotSorted, rejections[0].Reason)
+	assert.Equal(t, ReasonEmptyLabelValue, rejections[1].Reason)
+	assert.Equal(t, ReasonDuplicateLabelName, rejections[2].Reason)
+	assert.Equal(t, `series {job="api", __name__="up"}: labels_not_sorted: "__name__" after "job"`, rejections[0].String())
+}
@@ -0,0 +1,232 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Reasons samples are rejected for.
+const (
+	ReasonTooFarInFuture = "too_far_in_future"
+	ReasonTooOld         = "too_old"
+)
+
+// LatePolicy says what happens to samples older than the acceptance window.
+type LatePolicy string
+
+const (
+	// LateReject drops late samples.
+	LateReject LatePolicy = "reject"
+	// LateClamp moves the last late sample of each series to the start of the
+	// window, and drops the others.
+	LateClamp LatePolicy = "clamp"
+	// LateAccept writes late samples as they are, leaving it to the series'
+	// retention and duplicate policy whether RedisTimeSeries takes them.
+	LateAccept LatePolicy = "accept"
+)
+
+// ParseLatePolicy parses a LatePolicy.
+func ParseLatePolicy(s string) (LatePolicy, error) {
+	switch policy := LatePolicy(s); policy {
+	case LateReject, LateClamp, LateAccept:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown late sample policy %q, must be one of reject, clamp, accept", s)
+}
+
+// ParseLatePolicyOverrides parses per metric policies, given as
+// "metric=policy,metric=policy".
+func ParseLatePolicyOverrides(s string) (map[string]LatePolicy, error) {
+	overrides := make(map[string]LatePolicy)
+	if s == "" {
+		return overrides, nil
+	}
+	for _, override := range strings.Split(s, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid late sample policy override %q, must be metric=policy", override)
+		}
+		policy, err := ParseLatePolicy(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		overrides[parts[0]] = policy
+	}
+	return overrides, nil
+}
+
+var clampedSamples = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "redis_ts_adapter_clamped_samples_total",
+	Help: "Late samples moved to the start of the acceptance window.",
+})
+
+// WindowConfig bounds the timestamps accepted relative to the adapter's
+// clock. Zero durations are not enforced.
+type WindowConfig struct {
+	MaxFuture           time.Duration
+	MaxAge              time.Duration
+	LatePolicy          LatePolicy
+	LatePolicyOverrides map[string]LatePolicy
+}
+
+// Window enforces the acceptance window.
+type Window struct {
+	cfg WindowConfig
+	now func() time.Time
+}
+
+// NewWindow creates a Window.
+func NewWindow(cfg WindowConfig) *Window {
+	if cfg.LatePolicy == "" {
+		cfg.LatePolicy = LateReject
+	}
+	return &Window{cfg: cfg, now: time.Now}
+}
+
+func (w *Window) latePolicy(labels []*prompb.Label) LatePolicy {
+	for _, l := range labels {
+		if l.Name == nameLabel {
+			if policy, ok := w.cfg.LatePolicyOverrides[l.Value]; ok {
+				return policy
+			}
+		}
+	}
+	return w.cfg.LatePolicy
+}
+
+// Apply drops or clamps the samples and histograms outside of the window and
+// returns one rejection per series and reason.
+func (w *Window) Apply(req *remotepb.WriteRequest) []Rejection {
+	if w.cfg.MaxFuture == 0 && w.cfg.MaxAge == 0 {
+		return nil
+	}
+	now := w.now()
+	maxTimestamp, minTimestamp := int64(0), int64(0)
+	if w.cfg.MaxFuture > 0 {
+		maxTimestamp = timestamp(now.Add(w.cfg.MaxFuture))
+	}
+	if w.cfg.MaxAge > 0 {
+		minTimestamp = timestamp(now.Add(-w.cfg.MaxAge))
+	}
+
+	var rejections []Rejection
+	for _, ts := range req.Timeseries {
+		check := sampleCheck{maxTimestamp: maxTimestamp, minTimestamp: minTimestamp, policy: w.latePolicy(ts.Labels)}
+
+		// Clamped samples all land on the start of the window: only the last
+		// is kept, since RedisTimeSeries rejects duplicate timestamps.
+		samples := ts.Samples[:0]
+		clampedAt := -1
+		for _, s := range ts.Samples {
+			switch check.accept(&s.Timestamp) {
+			case keep:
+				samples = append(samples, s)
+			case clamp:
+				if clampedAt >= 0 {
+					samples[clampedAt] = s
+					check.supersede()
+					continue
+				}
+				clampedAt = len(samples)
+				samples = append(samples, s)
+			}
+		}
+		ts.Samples = samples
+
+		histograms := ts.Histograms[:0]
+		clampedAt = -1
+		for _, h := range ts.Histograms {
+			switch check.accept(&h.Timestamp) {
+			case keep:
+				histograms = append(histograms, h)
+			case clamp:
+				if clampedAt >= 0 {
+					histograms[clampedAt] = h
+					check.supersede()
+					continue
+				}
+				clampedAt = len(histograms)
+				histograms = append(histograms, h)
+			}
+		}
+		ts.Histograms = histograms
+
+		if check.future > 0 {
+			rejectedSamples.WithLabelValues(ReasonTooFarInFuture).Add(float64(check.future))
+			rejections = append(rejections, Rejection{
+				Series: formatLabels(ts.Labels),
+				Reason: ReasonTooFarInFuture,
+				Detail: fmt.Sprintf("%d samples after %s", check.future, formatTimestamp(maxTimestamp)),
+			})
+		}
+		if check.old > 0 {
+			rejectedSamples.WithLabelValues(ReasonTooOld).Add(float64(check.old))
+			rejections = append(rejections, Rejection{
+				Series: formatLabels(ts.Labels),
+				Reason: ReasonTooOld,
+				Detail: fmt.Sprintf("%d samples before %s", check.old, formatTimestamp(minTimestamp)),
+			})
+		}
+		clampedSamples.Add(float64(check.clamped))
+	}
+	return rejections
+}
+
+// sampleCheck checks the samples of one series and counts what it did.
+type sampleCheck struct {
+	maxTimestamp int64
+	minTimestamp int64
+	policy       LatePolicy
+
+	future, old, clamped int
+}
+
+// verdict is what happens to a sample.
+type verdict int
+
+const (
+	drop verdict = iota
+	keep
+	clamp
+)
+
+func (c *sampleCheck) accept(timestamp *int64) verdict {
+	if c.maxTimestamp != 0 && *timestamp > c.maxTimestamp {
+		c.future++
+		return drop
+	}
+	if c.minTimestamp == 0 || *timestamp >= c.minTimestamp {
+		return keep
+	}
+	switch c.policy {
+	case LateClamp:
+		*timestamp = c.minTimestamp
+		c.clamped++
+		return clamp
+	case LateAccept:
+		return keep
+	default:
+		c.old++
+		return drop
+	}
+}
+
+// supersede drops a clamped sample for a later one, counting it as too old.
+func (c *sampleCheck) supersede() {
+	c.clamped--
+	c.old++
+}
+
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(0, timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
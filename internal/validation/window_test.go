@@ -0,0 +1,93 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RedisTimeSeries/prometheus-redistimeseries-adapter/internal/remotepb"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	window := NewWindow(WindowConfig{
+		MaxFuture:           time.Minute,
+		MaxAge:              time.Hour,
+		LatePolicyOverrides: map[string]LatePolicy{"clamped": LateClamp, "accepted": LateAccept},
+	})
+	window.now = func() time.Time { return now }
+
+	nowMs := timestamp(now)
+	minMs := timestamp(now.Add(-time.Hour))
+	samples := func() []prompb.Sample {
+		return []prompb.Sample{
+			{Value: 1, Timestamp: minMs - 1},
+			{Value: 2, Timestamp: nowMs},
+			{Value: 3, Timestamp: nowMs + time.Minute.Milliseconds() + 1},
+		}
+	}
+	rejected, clamped, accepted := series("__name__", "rejected"), series("__name__", "clamped"), series("__name__", "accepted")
+	rejected.Samples, clamped.Samples, accepted.Samples = samples(), samples(), samples()
+	accepted.Histograms = []remotepb.Histogram{{Timestamp: nowMs + time.Hour.Milliseconds()}}
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{rejected, clamped, accepted}}
+
+	rejections := window.Apply(req)
+	assert.Equal(t, []prompb.Sample{{Value: 2, Timestamp: nowMs}}, rejected.Samples)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: minMs}, {Value: 2, Timestamp: nowMs}}, clamped.Samples)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: minMs - 1}, {Value: 2, Timestamp: nowMs}}, accepted.Samples)
+	assert.Empty(t, accepted.Histograms)
+
+	reasons := make([]string, 0, len(rejections))
+	for _, r := range rejections {
+		reasons = append(reasons, r.Series+" "+r.Reason)
+	}
+	assert.Equal(t, []string{
+		`{__name__="rejected"} too_far_in_future`,
+		`{__name__="rejected"} too_old`,
+		`{__name__="clamped"} too_far_in_future`,
+		`{__name__="accepted"} too_far_in_future`,
+	}, reasons)
+	assert.Equal(t, "2 samples after 1970-01-01T00:17:40Z", rejections[3].Detail)
+}
+
+func TestWindowClampKeepsLastLateSample(t *testing.T) {
+	now := time.Unix(1000, 0)
+	window := NewWindow(WindowConfig{MaxAge: time.Hour, LatePolicy: LateClamp})
+	window.now = func() time.Time { return now }
+
+	nowMs := timestamp(now)
+	minMs := timestamp(now.Add(-time.Hour))
+	clamped := series("__name__", "clamped")
+	clamped.Samples = []prompb.Sample{
+		{Value: 1, Timestamp: minMs - 3},
+		{Value: 2, Timestamp: minMs - 2},
+		{Value: 3, Timestamp: minMs - 1},
+		{Value: 4, Timestamp: nowMs},
+	}
+	clamped.Histograms = []remotepb.Histogram{{Sum: 1, Timestamp: minMs - 2}, {Sum: 2, Timestamp: minMs - 1}}
+
+	rejections := window.Apply(&remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{clamped}})
+	assert.Equal(t, []prompb.Sample{{Value: 3, Timestamp: minMs}, {Value: 4, Timestamp: nowMs}}, clamped.Samples)
+	assert.Equal(t, []remotepb.Histogram{{Sum: 2, Timestamp: minMs}}, clamped.Histograms)
+	assert.Len(t, rejections, 1)
+	assert.Equal(t, ReasonTooOld, rejections[0].Reason)
+	assert.Equal(t, "3 samples before 1969-12-31T23:16:40Z", rejections[0].Detail)
+}
+
+func TestWindowDisabled(t *testing.T) {
+	req := &remotepb.WriteRequest{Timeseries: []*remotepb.TimeSeries{series("__name__", "up")}}
+	assert.Empty(t, NewWindow(WindowConfig{}).Apply(req))
+	assert.Len(t, req.Timeseries[0].Samples, 1)
+}
+
+func TestParseLatePolicyOverrides(t *testing.T) {
+	overrides, err := ParseLatePolicyOverrides("up=clamp,job:up:sum=accept")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]LatePolicy{"up": LateClamp, "job:up:sum": LateAccept}, overrides)
+
+	for _, s := range []string{"up", "=clamp", "up=drop"} {
+		_, err := ParseLatePolicyOverrides(s)
+		assert.Error(t, err, s)
+	}
+}